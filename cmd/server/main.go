@@ -1,43 +1,179 @@
 package main
 
 import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/bot"
+	"avito-trainee-assignment/internal/config"
+	"avito-trainee-assignment/internal/logging"
+	"avito-trainee-assignment/internal/outbox"
+	"avito-trainee-assignment/internal/retention"
 	"avito-trainee-assignment/internal/server"
 	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/thumbnail"
+	"avito-trainee-assignment/internal/tracing"
+	"avito-trainee-assignment/internal/webhook"
 	"context"
-	"github.com/caarlos0/env/v6"
-	"go.uber.org/zap"
+	"errors"
+	"flag"
 	"log"
+	"os"
 	"time"
 )
 
 func main() {
-	logger, err := zap.NewDevelopment()
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Fatalf("zap.NewDevelopment: %v", err)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("Cannot load config: %v", err)
 	}
-	defer logger.Sync()
 
-	sugar := logger.Sugar()
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Cannot print config: %v", err)
+		}
+		return
+	}
+
+	logs, err := logging.New(cfg.LoggingOptions()...)
+	if err != nil {
+		log.Fatalf("Cannot create logger: %v", err)
+	}
+	defer logs.Close()
+
+	sugar := logs.Root().Sugar()
 	sugar.Info("Application is starting")
 
 	sugar.Info("Current time:", time.Now())
 
-	cfg := server.EnvConfig{}
-	if err := env.Parse(&cfg); err != nil {
-		sugar.Fatalf("Cannot parse env config: %w", err)
+	if cfg.File != "" {
+		sugar.Infof("Loaded config file %s", cfg.File)
+	}
+
+	traces, err := tracing.New(cfg.TracingOptions()...)
+	if err != nil {
+		sugar.Fatalf("Cannot create tracer provider: %v", err)
+	}
+	defer func() {
+		// spans of the last requests are exported on close, so it is not left to the exporter schedule
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := traces.Close(ctx); err != nil {
+			sugar.Errorf("Cannot export remaining spans: %v", err)
+		}
+	}()
+
+	blobs, err := blob.FromEnvConfig(context.Background(), cfg.BlobEnvConfig())
+	if err != nil {
+		sugar.Fatalf("Cannot create blob store: %v", err)
 	}
 
-	store, err := storage.NewStore(context.Background(), sugar, storage.ConnectionTimeout(30*time.Second))
+	storeOpts := append(cfg.StorageOptions(),
+		storage.QueryLogger(logs.Component(logging.ComponentPgx)),
+		storage.TracerProvider(traces),
+	)
+
+	store, err := storage.NewStore(context.Background(), logs.Component(logging.ComponentStorage).Sugar(), storeOpts...)
 	if err != nil {
 		sugar.Fatalf("Cannot create Store instance: %v", err)
 	}
 
-	serverOpts := []server.Option{
-		server.WithEnvConfig(cfg),
-		server.ReadTimeout(5 * time.Second),
+	thumbnails, err := thumbnail.NewPool(sugar, blobs, store, cfg.ThumbnailOptions()...)
+	if err != nil {
+		sugar.Fatalf("Cannot create thumbnail pool: %v", err)
+	}
+
+	dispatcher, err := webhook.NewDispatcher(sugar, store, cfg.WebhookOptions()...)
+	if err != nil {
+		sugar.Fatalf("Cannot create webhook dispatcher: %v", err)
+	}
+	dispatcher.Start()
+
+	publisher, err := outbox.NewNDJSONFile(cfg.Outbox.File)
+	if err != nil {
+		sugar.Fatalf("Cannot open outbox file: %v", err)
+	}
+
+	relayOpts := append(cfg.OutboxOptions(), outbox.Listen(func(ctx context.Context) (outbox.Waiter, error) {
+		return store.ListenOutbox(ctx)
+	}))
+
+	relay, err := outbox.NewRelay(sugar, store, publisher, relayOpts...)
+	if err != nil {
+		sugar.Fatalf("Cannot create outbox relay: %v", err)
+	}
+	relay.Start()
+
+	bots, err := bot.NewDispatcher(sugar, store)
+	if err != nil {
+		sugar.Fatalf("Cannot create bot dispatcher: %v", err)
+	}
+
+	if err := bots.Load(context.Background()); err != nil {
+		sugar.Fatalf("Cannot load bots: %v", err)
+	}
+
+	janitor, err := retention.NewJanitor(sugar, store, append(cfg.RetentionOptions(), retention.Blobs(blobs))...)
+	if err != nil {
+		sugar.Fatalf("Cannot create retention janitor: %v", err)
+	}
+
+	var srv *server.Server
+
+	// reload applies parameters tagged as reloadable in config.Config: log levels, request timeout and retention
+	// settings. Bot rate limits are stored in the database and re-read. The rest, including server connection
+	// and webhook timeouts, requires restart. applied is the configuration in effect.
+	applied := cfg
+	reload := func() error {
+		next, err := config.Load(os.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		// the janitor is the only one able to reject the configuration, so it goes first
+		err = janitor.Reconfigure(next.RetentionOptions()...)
+		if err != nil {
+			return err
+		}
+
+		// levels are already validated by config.Load
+		level, _ := next.LogLevel()
+		components, _ := next.ComponentLevels()
+		logs.SetLevels(level, components)
+		srv.SetRequestTimeout(next.Server.RequestTimeout)
+
+		// bot rate limits are stored in the database along with other bot settings
+		if err := bots.Load(context.Background()); err != nil {
+			sugar.Errorf("Cannot reload bots: %v", err)
+		}
+
+		for _, key := range applied.RestartRequired(next) {
+			sugar.Warnf("Changed parameter %s is applied only after restart", key)
+		}
+		applied = applied.Reloaded(next)
+
+		return nil
 	}
 
-	srv, err := server.NewServer(sugar, store, serverOpts...)
+	serverOpts := append(cfg.ServerOptions(),
+		server.Attachments(blobs, cfg.Server.MaxUploadSize),
+		server.Thumbnails(thumbnails),
+		server.Bots(bots),
+		server.Retention(janitor),
+		server.OnReload(reload),
+		server.TracerProvider(traces),
+		server.AdminHandler("/log/level", logs.LevelHandler()),
+		server.RegisterAfterShutdown(dispatcher.Close),
+		server.RegisterAfterShutdown(relay.Close),
+		server.RegisterAfterShutdown(func() {
+			if err := publisher.Close(); err != nil {
+				sugar.Errorf("Cannot close outbox file: %v", err)
+			}
+		}),
+	)
+
+	srv, err = server.NewServer(logs.Component(logging.ComponentServer).Sugar(), store, serverOpts...)
 	if err != nil {
 		sugar.Fatalf("Cannot create Server instance: %v", err)
 	}
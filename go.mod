@@ -3,13 +3,24 @@ module avito-trainee-assignment
 go 1.14
 
 require (
-	github.com/caarlos0/env/v6 v6.3.0
+	github.com/BurntSushi/toml v0.3.1
+	github.com/andybalholm/brotli v1.0.1
+	github.com/graph-gophers/dataloader v5.0.0+incompatible
+	github.com/graph-gophers/graphql-go v0.0.0-20200622220639-c1d9693c95a6
 	github.com/jackc/pgconn v1.6.4
 	github.com/jackc/pgerrcode v0.0.0-20190803225404-afa3381909a6
 	github.com/jackc/pgtype v1.4.2
 	github.com/jackc/pgx/v4 v4.8.1
+	github.com/minio/minio-go/v7 v7.0.5
 	github.com/rs/xid v1.2.1
 	github.com/stretchr/testify v1.6.1
 	github.com/valyala/fastjson v1.5.4
+	go.opentelemetry.io/otel v0.14.0
+	go.opentelemetry.io/otel/exporters/stdout v0.14.0
+	go.opentelemetry.io/otel/sdk v0.14.0
 	go.uber.org/zap v1.15.0
+	golang.org/x/image v0.0.0-20200801110659-972c09e46d76
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,69 @@
+// Package blob provides BlobStore interface for binary objects such as message attachments
+// along with local filesystem and S3-compatible implementations.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	ErrNotExist = errors.New("blob does not exist")
+	ErrBadKey   = errors.New("bad blob key")
+)
+
+// BlobStore stores binary objects under slash-separated keys such as "chats/1/attachment"
+type BlobStore interface {
+	// Put stores object read from r under provided key replacing existing one.
+	// size may be -1 when it is not known in advance.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns reader of the object stored under provided key or ErrNotExist.
+	// The caller must close returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes object stored under provided key, deleting missing object is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// EnvConfig defines fields used for parsing from environment variables
+type EnvConfig struct {
+	Backend     string `env:"BLOB_BACKEND" envDefault:"fs"`
+	FSRoot      string `env:"BLOB_FS_ROOT" envDefault:"data/blobs"`
+	S3Endpoint  string `env:"BLOB_S3_ENDPOINT"`
+	S3Region    string `env:"BLOB_S3_REGION"`
+	S3Bucket    string `env:"BLOB_S3_BUCKET" envDefault:"attachments"`
+	S3AccessKey string `env:"BLOB_S3_ACCESS_KEY"`
+	S3SecretKey string `env:"BLOB_S3_SECRET_KEY"`
+	S3UseSSL    bool   `env:"BLOB_S3_USE_SSL" envDefault:"false"`
+}
+
+// FromEnvConfig constructs BlobStore implementation selected by Backend field ("fs" or "s3")
+func FromEnvConfig(ctx context.Context, cfg EnvConfig) (BlobStore, error) {
+	switch cfg.Backend {
+	case "fs":
+		return NewFilesystem(cfg.FSRoot)
+	case "s3":
+		return NewS3(ctx, S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			UseSSL:    cfg.S3UseSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", cfg.Backend)
+	}
+}
+
+// validateKey rejects keys which are not clean relative slash-separated paths
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("%w: %q", ErrBadKey, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Filesystem implements BlobStore on top of local directory.
+// Objects are written into temporary files first and renamed afterwards, so readers never see partial objects.
+type Filesystem struct {
+	root string
+}
+
+// NewFilesystem constructs Filesystem creating root directory if needed
+func NewFilesystem(root string) (*Filesystem, error) {
+	if root == "" {
+		return nil, errors.New("no root directory provided")
+	}
+
+	err := os.MkdirAll(root, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filesystem{root: root}, nil
+}
+
+func (f *Filesystem) path(key string) (string, error) {
+	err := validateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+// Put implements BlobStore interface, content type is not persisted
+func (f *Filesystem) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0750)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	// removing fails after successful rename, that is expected
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get implements BlobStore interface
+func (f *Filesystem) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Delete implements BlobStore interface
+func (f *Filesystem) Delete(_ context.Context, key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func bootstrapFilesystem(t *testing.T) *Filesystem {
+	root, err := ioutil.TempDir("", "blobs")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+
+	f, err := NewFilesystem(root)
+	require.NoError(t, err)
+
+	return f
+}
+
+func TestFilesystemPutGetDelete(t *testing.T) {
+	t.Parallel()
+
+	f := bootstrapFilesystem(t)
+	content := []byte("attachment content")
+
+	err := f.Put(context.Background(), "chats/1/blob", bytes.NewReader(content), int64(len(content)), "text/plain")
+	require.NoError(t, err)
+
+	rc, err := f.Get(context.Background(), "chats/1/blob")
+	require.NoError(t, err)
+	actual, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, content, actual)
+
+	require.NoError(t, f.Delete(context.Background(), "chats/1/blob"))
+	// deleting missing object is not an error
+	require.NoError(t, f.Delete(context.Background(), "chats/1/blob"))
+
+	_, err = f.Get(context.Background(), "chats/1/blob")
+	require.True(t, errors.Is(err, ErrNotExist))
+}
+
+func TestFilesystemBadKey(t *testing.T) {
+	t.Parallel()
+
+	f := bootstrapFilesystem(t)
+
+	for _, key := range []string{"", "/abs", "../escape", "a/../../b", "a//b"} {
+		err := f.Put(context.Background(), key, bytes.NewReader(nil), 0, "")
+		require.Truef(t, errors.Is(err, ErrBadKey), "key %q", key)
+	}
+}
+
+func TestFromEnvConfigUnknownBackend(t *testing.T) {
+	t.Parallel()
+
+	_, err := FromEnvConfig(context.Background(), EnvConfig{Backend: "tape"})
+	require.Error(t, err)
+}
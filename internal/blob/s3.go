@@ -0,0 +1,104 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+)
+
+// S3Config defines connection parameters of S3-compatible storage such as AWS S3 or MinIO
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3 implements BlobStore on top of S3-compatible storage
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 constructs S3 creating configured bucket if it does not exist
+func NewS3(ctx context.Context, cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("no endpoint provided")
+	}
+
+	if cfg.Bucket == "" {
+		return nil, errors.New("no bucket provided")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot check bucket %q: %w", cfg.Bucket, err)
+	}
+
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, fmt.Errorf("cannot create bucket %q: %w", cfg.Bucket, err)
+		}
+	}
+
+	return &S3{
+		client: client,
+		bucket: cfg.Bucket,
+	}, nil
+}
+
+// Put implements BlobStore interface
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+
+	return err
+}
+
+// Get implements BlobStore interface
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	err := validateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, so object existence is checked explicitly
+	_, err = s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+// Delete implements BlobStore interface
+func (s *S3) Delete(ctx context.Context, key string) error {
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
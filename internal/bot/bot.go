@@ -0,0 +1,133 @@
+// Package bot routes slash commands posted into chats to bots and posts their replies back as messages.
+// Bots are served either by Go handlers registered in the application or by outgoing HTTP callbacks.
+package bot
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRateLimit = 30
+	defaultTimeout   = 5 * time.Second
+	// maxReplyLength limits bot replies, longer ones are truncated
+	maxReplyLength = 4096
+)
+
+// ErrBadBot is wrapped by errors describing invalid bot settings
+var ErrBadBot = errors.New("bad bot")
+
+var (
+	// commandRe matches the first token of a command message, e.g. "/deploy" or "/deploy@deploybot"
+	commandRe = regexp.MustCompile(`^/([a-z0-9_]{1,32})(?:@(\S+))?$`)
+	nameRe    = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+)
+
+// Command is a parsed slash command message
+type Command struct {
+	// Name is the command without leading slash
+	Name string `json:"name"`
+	// Args is the rest of the message after the command, trimmed
+	Args    string `json:"args"`
+	Chat    int64  `json:"chat"`
+	Message int64  `json:"message"`
+	Author  int64  `json:"author"`
+}
+
+// Handler handles commands routed to a bot and returns the reply text.
+// Blank reply means the bot stays silent.
+type Handler interface {
+	Handle(ctx context.Context, c Command) (string, error)
+}
+
+// HandlerFunc allows the use of ordinary functions as bot handlers
+type HandlerFunc func(ctx context.Context, c Command) (string, error)
+
+// Handle calls f(ctx, c)
+func (f HandlerFunc) Handle(ctx context.Context, c Command) (string, error) {
+	return f(ctx, c)
+}
+
+// Bot describes a bot registered in Dispatcher
+type Bot struct {
+	// Username of the bot user, the bot is created on registration if it does not exist
+	Username string
+	// Commands routed to the bot, without leading slash
+	Commands []string
+	Handler  Handler
+	// RateLimit is the maximum number of handled commands per minute, extra commands are dropped
+	RateLimit int
+	// Timeout bounds handling of a single command including posting the reply
+	Timeout time.Duration
+}
+
+// validate checks bot fields and fills defaults
+func (b *Bot) validate() error {
+	if strings.TrimSpace(b.Username) == "" {
+		return fmt.Errorf("%w: no username provided", ErrBadBot)
+	}
+
+	if b.Handler == nil {
+		return fmt.Errorf("%w: no handler provided for %q", ErrBadBot, b.Username)
+	}
+
+	if len(b.Commands) == 0 {
+		return fmt.Errorf("%w: no commands provided for %q", ErrBadBot, b.Username)
+	}
+
+	for _, c := range b.Commands {
+		if !nameRe.MatchString(c) {
+			return fmt.Errorf("%w: command %q of %q must match %s", ErrBadBot, c, b.Username, nameRe)
+		}
+	}
+
+	if b.RateLimit == 0 {
+		b.RateLimit = defaultRateLimit
+	}
+
+	if b.RateLimit < 0 {
+		return fmt.Errorf("%w: rate limit of %q must be positive", ErrBadBot, b.Username)
+	}
+
+	if b.Timeout == 0 {
+		b.Timeout = defaultTimeout
+	}
+
+	if b.Timeout < 0 {
+		return fmt.Errorf("%w: timeout of %q must be positive", ErrBadBot, b.Username)
+	}
+
+	return nil
+}
+
+// Parse extracts command from message text. The second returned value is the addressed bot username,
+// it is blank unless the command has "@username" suffix. ok is false for messages which are not commands.
+func Parse(m storage.Message) (c Command, botName string, ok bool) {
+	text := strings.TrimSpace(m.Text)
+	if !strings.HasPrefix(text, "/") {
+		return Command{}, "", false
+	}
+
+	first, rest := text, ""
+	if i := strings.IndexAny(text, " \t\n"); i >= 0 {
+		first, rest = text[:i], strings.TrimSpace(text[i+1:])
+	}
+
+	match := commandRe.FindStringSubmatch(strings.ToLower(first))
+	if match == nil {
+		return Command{}, "", false
+	}
+
+	return Command{
+		Name:    match[1],
+		Args:    rest,
+		Chat:    m.Chat,
+		Message: m.ID,
+		Author:  m.Author,
+	}, match[2], true
+}
@@ -0,0 +1,80 @@
+package bot
+
+import (
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/webhook"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxCallbackResponseLength limits callback response body
+const maxCallbackResponseLength = 64 << 10
+
+// callback implements Handler by posting commands to an HTTP endpoint
+type callback struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+// Callback returns Handler posting each command as JSON to url.
+// Requests are signed the same way as webhooks, see webhook.SignatureHeader.
+// The endpoint replies with {"text": "..."} or with an empty body to stay silent.
+// Timeout is controlled by the context, so client should not set its own.
+// Nil client is replaced with one refusing to connect to non-public addresses, see egress.Client.
+func Callback(client *http.Client, url, secret string) Handler {
+	if client == nil {
+		client = egress.Client(0)
+	}
+
+	return &callback{client: client, url: url, secret: secret}
+}
+
+func (c *callback) Handle(ctx context.Context, cmd Command) (string, error) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(c.secret, body))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCallbackResponseLength))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected callback response status %d", resp.StatusCode)
+	}
+
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return "", nil
+	}
+
+	var reply struct {
+		Text string `json:"text"`
+	}
+	err = json.Unmarshal(respBody, &reply)
+	if err != nil {
+		return "", fmt.Errorf("malformed callback response: %w", err)
+	}
+
+	return reply.Text, nil
+}
@@ -0,0 +1,371 @@
+package bot
+
+import (
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultMaxConcurrent limits number of commands handled at the same time by all bots
+const defaultMaxConcurrent = 32
+
+// Store is a subset of storage.Store methods used by Dispatcher
+type Store interface {
+	EnsureBot(ctx context.Context, b storage.Bot) (int64, error)
+	CreateBot(ctx context.Context, b storage.Bot) (int64, error)
+	CallbackBots(ctx context.Context) ([]storage.Bot, error)
+	CheckChatMember(ctx context.Context, chat, user int64) error
+	CreateMessage(ctx context.Context, chat, author int64, text string, opts ...storage.MessageOption) (int64, error)
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Dispatcher instance
+type config struct {
+	client        *http.Client
+	maxConcurrent int
+}
+
+// CallbackClient sets http.Client used by callback bots. The default client refuses to connect to non-public
+// addresses, a custom one is trusted to do the same if needed.
+func CallbackClient(client *http.Client) Option {
+	return optionFunc(func(c *config) {
+		c.client = client
+	})
+}
+
+// MaxConcurrent sets the maximum number of commands handled at the same time, extra commands are dropped
+func MaxConcurrent(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxConcurrent = n
+	})
+}
+
+// registered is a bot known to Dispatcher along with its user id and rate limiter
+type registered struct {
+	id      int64
+	bot     Bot
+	limiter *rate.Limiter
+	// callback is set for bots persisted by RegisterCallback, they are reconciled with the store by Load
+	callback bool
+}
+
+// Dispatcher routes commands to registered bots and posts their replies
+type Dispatcher struct {
+	logger *zap.SugaredLogger
+	store  Store
+	client *http.Client
+
+	mu sync.RWMutex
+	// ids maps bot user ids to bots
+	ids map[int64]*registered
+	// commands maps command names to bots in order of registration
+	commands map[string][]*registered
+	closed   bool
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+// NewDispatcher constructs a Dispatcher. See the various Options for available customizations.
+func NewDispatcher(logger *zap.SugaredLogger, store Store, opts ...Option) (*Dispatcher, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+
+	if store == nil {
+		return nil, errors.New("no store provided")
+	}
+
+	cfg := &config{
+		client:        egress.Client(0),
+		maxConcurrent: defaultMaxConcurrent,
+	}
+
+	for _, o := range opts {
+		o.apply(cfg)
+	}
+
+	if cfg.maxConcurrent < 1 {
+		return nil, fmt.Errorf("max concurrent commands must be positive, got %d", cfg.maxConcurrent)
+	}
+
+	return &Dispatcher{
+		logger:   logger,
+		store:    store,
+		client:   cfg.client,
+		ids:      make(map[int64]*registered),
+		commands: make(map[string][]*registered),
+		sem:      make(chan struct{}, cfg.maxConcurrent),
+	}, nil
+}
+
+// Register adds bot served by Go handler creating the bot user if needed. Registering the same username again
+// replaces the bot.
+func (d *Dispatcher) Register(ctx context.Context, b Bot) error {
+	err := b.validate()
+	if err != nil {
+		return err
+	}
+
+	id, err := d.store.EnsureBot(ctx, storage.Bot{
+		Username:  b.Username,
+		Commands:  b.Commands,
+		RateLimit: b.RateLimit,
+		Timeout:   int(b.Timeout / time.Millisecond),
+	})
+	if err != nil {
+		return err
+	}
+
+	d.add(id, b, false)
+
+	return nil
+}
+
+// RegisterCallback adds bot served by HTTP callback persisting its settings, so Load restores it after restart.
+// Unlike Register it never replaces an existing bot, it fails with storage.ErrUserExists if the username is taken.
+func (d *Dispatcher) RegisterCallback(ctx context.Context, b storage.Bot) (int64, error) {
+	if b.CallbackURL == nil {
+		return 0, fmt.Errorf("%w: no callback url provided", ErrBadBot)
+	}
+
+	bot := fromStorage(b, d.client)
+	err := bot.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := d.store.CreateBot(ctx, b)
+	if err != nil {
+		return 0, err
+	}
+
+	d.add(id, bot, true)
+
+	return id, nil
+}
+
+// Load registers all callback bots persisted by RegisterCallback. Calling it again applies changed settings,
+// e.g. rate limits, of already registered bots and drops callback bots which are no longer stored,
+// e.g. deleted along with their users.
+func (d *Dispatcher) Load(ctx context.Context) error {
+	bots, err := d.store.CallbackBots(ctx)
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[int64]bool, len(bots))
+	for _, b := range bots {
+		bot := fromStorage(b, d.client)
+		err = bot.validate()
+		if err != nil {
+			return err
+		}
+		d.add(b.ID, bot, true)
+		stored[b.ID] = true
+	}
+
+	d.mu.Lock()
+	for id, r := range d.ids {
+		if r.callback && !stored[id] {
+			d.logger.Infof("Dropping callback bot (%s) which is no longer stored", r.bot.Username)
+			d.remove(id)
+		}
+	}
+	d.mu.Unlock()
+
+	d.logger.Infof("Loaded %d callback bots", len(bots))
+
+	return nil
+}
+
+func fromStorage(b storage.Bot, client *http.Client) Bot {
+	var h Handler
+	if b.CallbackURL != nil {
+		h = Callback(client, *b.CallbackURL, b.Secret)
+	}
+
+	return Bot{
+		Username:  b.Username,
+		Commands:  b.Commands,
+		Handler:   h,
+		RateLimit: b.RateLimit,
+		Timeout:   time.Duration(b.Timeout) * time.Millisecond,
+	}
+}
+
+func (d *Dispatcher) add(id int64, b Bot, callback bool) {
+	limit := rate.Every(time.Minute / time.Duration(b.RateLimit))
+	r := &registered{
+		id:       id,
+		bot:      b,
+		callback: callback,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// dropping previous registration of the same bot, its limiter is kept, so re-registration does not refill it
+	if prev, ok := d.ids[id]; ok {
+		r.limiter = prev.limiter
+		r.limiter.SetLimit(limit)
+		r.limiter.SetBurst(b.RateLimit)
+		d.remove(id)
+	} else {
+		r.limiter = rate.NewLimiter(limit, b.RateLimit)
+	}
+
+	d.ids[id] = r
+	for _, c := range b.Commands {
+		d.commands[c] = append(d.commands[c], r)
+	}
+}
+
+// remove drops the bot from the registry, d.mu must be held
+func (d *Dispatcher) remove(id int64) {
+	delete(d.ids, id)
+	for name, bots := range d.commands {
+		filtered := bots[:0]
+		for _, existing := range bots {
+			if existing.id != id {
+				filtered = append(filtered, existing)
+			}
+		}
+		if len(filtered) == 0 {
+			delete(d.commands, name)
+			continue
+		}
+		d.commands[name] = filtered
+	}
+}
+
+// Dispatch routes the message to a bot in background if the message is a known command.
+// Messages authored by bots are ignored to prevent loops, commands exceeding MaxConcurrent limit are dropped.
+// Reports whether the message was routed.
+func (d *Dispatcher) Dispatch(m storage.Message) bool {
+	c, botName, ok := Parse(m)
+	if !ok {
+		return false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return false
+	}
+
+	if _, isBot := d.ids[m.Author]; isBot {
+		return false
+	}
+
+	var candidates []*registered
+	for _, r := range d.commands[c.Name] {
+		if botName == "" || strings.EqualFold(strings.TrimSpace(r.bot.Username), botName) {
+			candidates = append(candidates, r)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return false
+	}
+
+	select {
+	case d.sem <- struct{}{}:
+	default:
+		d.logger.Warnf("Too many commands are being handled, command /%s in chat (id: %d) is dropped", c.Name, c.Chat)
+		return false
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.sem }()
+
+		d.handle(c, candidates)
+	}()
+
+	return true
+}
+
+// handle passes the command to the first candidate which is a member of the chat and posts its reply
+func (d *Dispatcher) handle(c Command, candidates []*registered) {
+	var r *registered
+	for _, candidate := range candidates {
+		err := d.store.CheckChatMember(context.Background(), c.Chat, candidate.id)
+		if err == nil {
+			r = candidate
+			break
+		}
+		if !errors.Is(err, storage.ErrUserNotChatMember) {
+			d.logger.Errorf("Cannot check membership of bot (id: %d) in chat (id: %d): %v", candidate.id, c.Chat, err)
+			return
+		}
+	}
+
+	if r == nil {
+		return
+	}
+
+	if !r.limiter.Allow() {
+		d.logger.Warnf("Bot (%s) is rate limited, command /%s in chat (id: %d) is dropped", r.bot.Username, c.Name, c.Chat)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.bot.Timeout)
+	defer cancel()
+
+	reply, err := r.bot.Handler.Handle(ctx, c)
+	if err != nil {
+		d.logger.Errorf("Bot (%s) failed to handle command /%s in chat (id: %d): %v", r.bot.Username, c.Name, c.Chat, err)
+		return
+	}
+
+	reply = truncate(strings.TrimSpace(reply), maxReplyLength)
+	if reply == "" {
+		return
+	}
+
+	_, err = d.store.CreateMessage(ctx, c.Chat, r.id, reply, storage.ReplyTo(c.Message))
+	if err != nil {
+		d.logger.Errorf("Cannot post reply of bot (%s) in chat (id: %d): %v", r.bot.Username, c.Chat, err)
+	}
+}
+
+// Close stops accepting commands and waits for handling of already accepted ones
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// truncate cuts s to at most n bytes without splitting runes
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
@@ -0,0 +1,477 @@
+package bot
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/webhook"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore implements Store keeping bots, memberships and posted messages in memory
+type memoryStore struct {
+	mu       sync.Mutex
+	nextID   int64
+	bots     map[string]storage.Bot
+	members  map[int64]map[int64]bool
+	messages []storage.Message
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextID:  100,
+		bots:    make(map[string]storage.Bot),
+		members: make(map[int64]map[int64]bool),
+	}
+}
+
+func (s *memoryStore) EnsureBot(_ context.Context, b storage.Bot) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.bots[b.Username]; ok {
+		b.ID = existing.ID
+	} else {
+		s.nextID++
+		b.ID = s.nextID
+	}
+	s.bots[b.Username] = b
+
+	return b.ID, nil
+}
+
+func (s *memoryStore) CreateBot(_ context.Context, b storage.Bot) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.bots[b.Username]; ok {
+		return 0, storage.ErrUserExists
+	}
+	s.nextID++
+	b.ID = s.nextID
+	s.bots[b.Username] = b
+
+	return b.ID, nil
+}
+
+func (s *memoryStore) CallbackBots(_ context.Context) ([]storage.Bot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var bots []storage.Bot
+	for _, b := range s.bots {
+		if b.CallbackURL != nil {
+			bots = append(bots, b)
+		}
+	}
+
+	return bots, nil
+}
+
+func (s *memoryStore) CheckChatMember(_ context.Context, chat, user int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.members[chat][user] {
+		return storage.ErrUserNotChatMember
+	}
+
+	return nil
+}
+
+func (s *memoryStore) CreateMessage(_ context.Context, chat, author int64, text string, opts ...storage.MessageOption) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	s.messages = append(s.messages, storage.Message{ID: s.nextID, Chat: chat, Author: author, Text: text})
+
+	return s.nextID, nil
+}
+
+func (s *memoryStore) join(chat, user int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.members[chat] == nil {
+		s.members[chat] = make(map[int64]bool)
+	}
+	s.members[chat][user] = true
+}
+
+func (s *memoryStore) posted() []storage.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]storage.Message, len(s.messages))
+	copy(messages, s.messages)
+
+	return messages
+}
+
+func bootstrapDispatcher(t *testing.T, store Store, opts ...Option) *Dispatcher {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	d, err := NewDispatcher(logger.Sugar(), store, opts...)
+	require.NoError(t, err)
+
+	return d
+}
+
+var echo = HandlerFunc(func(_ context.Context, c Command) (string, error) {
+	return c.Name + ": " + c.Args, nil
+})
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		text    string
+		ok      bool
+		name    string
+		args    string
+		botName string
+	}{
+		{"/deploy api v1.2", true, "deploy", "api v1.2", ""},
+		{"  /ONCALL  ", true, "oncall", "", ""},
+		{"/deploy@deploybot now", true, "deploy", "now", "deploybot"},
+		{"/deploy\nmultiline args", true, "deploy", "multiline args", ""},
+		{"deploy", false, "", "", ""},
+		{"/", false, "", "", ""},
+		{"/path/to/file", false, "", "", ""},
+	}
+
+	for _, c := range cases {
+		cmd, botName, ok := Parse(storage.Message{ID: 1, Chat: 2, Author: 3, Text: c.text})
+		require.Equal(t, c.ok, ok, c.text)
+		if !ok {
+			continue
+		}
+		require.Equal(t, c.name, cmd.Name, c.text)
+		require.Equal(t, c.args, cmd.Args, c.text)
+		require.Equal(t, c.botName, botName, c.text)
+		require.Equal(t, int64(2), cmd.Chat)
+	}
+}
+
+func TestDispatchGoHandler(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	require.NoError(t, d.Register(context.Background(), Bot{Username: "echobot", Commands: []string{"echo"}, Handler: echo}))
+
+	botID := store.bots["echobot"].ID
+	store.join(1, botID)
+
+	require.False(t, d.Dispatch(storage.Message{ID: 10, Chat: 1, Author: 5, Text: "just a message"}))
+	require.False(t, d.Dispatch(storage.Message{ID: 11, Chat: 1, Author: 5, Text: "/unknown"}))
+	require.True(t, d.Dispatch(storage.Message{ID: 12, Chat: 1, Author: 5, Text: "/echo hello"}))
+	// bots never trigger commands
+	require.False(t, d.Dispatch(storage.Message{ID: 13, Chat: 1, Author: botID, Text: "/echo loop"}))
+	d.Close()
+
+	posted := store.posted()
+	require.Len(t, posted, 1)
+	require.Equal(t, botID, posted[0].Author)
+	require.Equal(t, "echo: hello", posted[0].Text)
+}
+
+func TestDispatchBotNotChatMember(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	require.NoError(t, d.Register(context.Background(), Bot{Username: "echobot", Commands: []string{"echo"}, Handler: echo}))
+
+	require.True(t, d.Dispatch(storage.Message{ID: 10, Chat: 1, Author: 5, Text: "/echo hello"}))
+	d.Close()
+
+	require.Empty(t, store.posted())
+}
+
+func TestDispatchRateLimit(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	require.NoError(t, d.Register(context.Background(), Bot{
+		Username:  "echobot",
+		Commands:  []string{"echo"},
+		Handler:   echo,
+		RateLimit: 2,
+	}))
+	store.join(1, store.bots["echobot"].ID)
+
+	for i := int64(0); i < 5; i++ {
+		require.True(t, d.Dispatch(storage.Message{ID: i, Chat: 1, Author: 5, Text: "/echo hello"}))
+	}
+	d.Close()
+
+	require.Len(t, store.posted(), 2)
+}
+
+func TestRegisterAgainKeepsLimiter(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+
+	b := Bot{Username: "echobot", Commands: []string{"echo"}, Handler: echo, RateLimit: 2}
+	require.NoError(t, d.Register(context.Background(), b))
+	id := store.bots["echobot"].ID
+	limiter := d.ids[id].limiter
+	require.True(t, limiter.Allow())
+
+	b.RateLimit = 5
+	require.NoError(t, d.Register(context.Background(), b))
+
+	// the used token is not refilled by re-registration while the limit is updated
+	require.Same(t, limiter, d.ids[id].limiter)
+	require.Equal(t, 5, limiter.Burst())
+	require.False(t, limiter.AllowN(time.Now(), 2))
+}
+
+func TestDispatchTimeout(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	require.NoError(t, d.Register(context.Background(), Bot{
+		Username: "slowbot",
+		Commands: []string{"slow"},
+		Handler: HandlerFunc(func(ctx context.Context, _ Command) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}),
+		Timeout: 10 * time.Millisecond,
+	}))
+	store.join(1, store.bots["slowbot"].ID)
+
+	require.True(t, d.Dispatch(storage.Message{ID: 1, Chat: 1, Author: 5, Text: "/slow"}))
+	d.Close()
+
+	require.Empty(t, store.posted())
+}
+
+func TestDispatchAddressedBot(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	for _, name := range []string{"first", "second"} {
+		name := name
+		require.NoError(t, d.Register(context.Background(), Bot{
+			Username: name,
+			Commands: []string{"status"},
+			Handler: HandlerFunc(func(context.Context, Command) (string, error) {
+				return name + " is fine", nil
+			}),
+		}))
+		store.join(1, store.bots[name].ID)
+	}
+
+	require.True(t, d.Dispatch(storage.Message{ID: 1, Chat: 1, Author: 5, Text: "/status@second"}))
+	d.Close()
+
+	posted := store.posted()
+	require.Len(t, posted, 1)
+	require.Equal(t, "second is fine", posted[0].Text)
+}
+
+func TestDispatchCallback(t *testing.T) {
+	t.Parallel()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !webhook.Verify("0123456789abcdef", body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+
+		var c Command
+		if err := json.Unmarshal(body, &c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"text": "on call: " + strings.ToUpper(c.Args)})
+	}))
+	defer receiver.Close()
+
+	// test receiver listens on loopback which the default client refuses to connect to
+	client := CallbackClient(&http.Client{})
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store, client)
+	id, err := d.RegisterCallback(context.Background(), storage.Bot{
+		Username:    "oncallbot",
+		CallbackURL: &receiver.URL,
+		Secret:      "0123456789abcdef",
+		Commands:    []string{"oncall"},
+		RateLimit:   10,
+		Timeout:     1000,
+	})
+	require.NoError(t, err)
+	store.join(1, id)
+
+	// callback bots are restored by Load
+	restored := bootstrapDispatcher(t, store, client)
+	require.NoError(t, restored.Load(context.Background()))
+
+	require.True(t, restored.Dispatch(storage.Message{ID: 1, Chat: 1, Author: 5, Text: "/oncall backend"}))
+	restored.Close()
+
+	posted := store.posted()
+	require.Len(t, posted, 1)
+	require.Equal(t, "on call: BACKEND", posted[0].Text)
+	require.Equal(t, id, posted[0].Author)
+}
+
+func TestDispatchCallbackRefusesNonPublicAddress(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		_, _ = w.Write([]byte(`{"text":"pong"}`))
+	}))
+	defer receiver.Close()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	id, err := d.RegisterCallback(context.Background(), storage.Bot{
+		Username:    "pingbot",
+		CallbackURL: &receiver.URL,
+		Secret:      "0123456789abcdef",
+		Commands:    []string{"ping"},
+		RateLimit:   10,
+		Timeout:     1000,
+	})
+	require.NoError(t, err)
+	store.join(1, id)
+
+	require.True(t, d.Dispatch(storage.Message{ID: 1, Chat: 1, Author: 5, Text: "/ping"}))
+	d.Close()
+
+	require.Empty(t, store.posted())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Zero(t, calls)
+}
+
+func TestRegisterCallbackExisting(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	require.NoError(t, d.Register(context.Background(), Bot{Username: "echobot", Commands: []string{"echo"}, Handler: echo}))
+
+	url := "https://93.184.216.34/bot"
+	_, err := d.RegisterCallback(context.Background(), storage.Bot{
+		Username:    "echobot",
+		CallbackURL: &url,
+		Secret:      "0123456789abcdef",
+		Commands:    []string{"echo"},
+		RateLimit:   10,
+		Timeout:     1000,
+	})
+	require.True(t, errors.Is(err, storage.ErrUserExists))
+
+	// existing bot keeps being served by its handler
+	require.Nil(t, store.bots["echobot"].CallbackURL)
+	require.Len(t, d.commands["echo"], 1)
+	_, isCallback := d.commands["echo"][0].bot.Handler.(*callback)
+	require.False(t, isCallback)
+}
+
+func TestDispatchDropsOverflow(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store, MaxConcurrent(1))
+	require.NoError(t, d.Register(context.Background(), Bot{
+		Username: "slowbot",
+		Commands: []string{"slow"},
+		Handler: HandlerFunc(func(context.Context, Command) (string, error) {
+			<-release
+			return "done", nil
+		}),
+	}))
+	store.join(1, store.bots["slowbot"].ID)
+
+	require.True(t, d.Dispatch(storage.Message{ID: 1, Chat: 1, Author: 5, Text: "/slow"}))
+	require.False(t, d.Dispatch(storage.Message{ID: 2, Chat: 1, Author: 5, Text: "/slow"}))
+	close(release)
+	d.Close()
+
+	require.Len(t, store.posted(), 1)
+}
+
+func TestRegisterBadBot(t *testing.T) {
+	t.Parallel()
+
+	d := bootstrapDispatcher(t, newMemoryStore())
+
+	err := d.Register(context.Background(), Bot{Username: "bot", Commands: []string{"Bad Command"}, Handler: echo})
+	require.True(t, errors.Is(err, ErrBadBot))
+	err = d.Register(context.Background(), Bot{Username: "bot", Commands: []string{"echo"}})
+	require.True(t, errors.Is(err, ErrBadBot))
+	_, err = d.RegisterCallback(context.Background(), storage.Bot{Username: "bot", Commands: []string{"echo"}})
+	require.True(t, errors.Is(err, ErrBadBot))
+}
+
+func TestTruncate(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "abc", truncate("abc", 5))
+	require.Equal(t, "ab", truncate("abc", 2))
+	// "ж" takes two bytes and must not be split
+	require.Equal(t, "a", truncate("aж", 2))
+}
+
+func TestLoadDropsRemovedCallbackBots(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryStore()
+	d := bootstrapDispatcher(t, store)
+	require.NoError(t, d.Register(context.Background(), Bot{Username: "echobot", Commands: []string{"echo"}, Handler: echo}))
+
+	url := "https://93.184.216.34/bot"
+	id, err := d.RegisterCallback(context.Background(), storage.Bot{
+		Username:    "oncallbot",
+		CallbackURL: &url,
+		Secret:      "0123456789abcdef",
+		Commands:    []string{"oncall", "echo"},
+		RateLimit:   10,
+		Timeout:     1000,
+	})
+	require.NoError(t, err)
+
+	// the bot is deleted along with its user
+	store.mu.Lock()
+	delete(store.bots, "oncallbot")
+	store.mu.Unlock()
+
+	require.NoError(t, d.Load(context.Background()))
+
+	require.NotContains(t, d.ids, id)
+	require.NotContains(t, d.commands, "oncall")
+	// bots served by Go handlers are not stored as callback bots and are kept
+	require.Len(t, d.commands["echo"], 1)
+	require.Equal(t, "echobot", d.commands["echo"][0].bot.Username)
+}
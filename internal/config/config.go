@@ -0,0 +1,430 @@
+// Package config gathers configuration of all application components in a single Config struct.
+//
+// Each parameter is resolved from the following sources, every next one overriding the previous:
+//  1. default value;
+//  2. configuration file in YAML (.yaml, .yml) or TOML (.toml) format set by --config flag or CONFIG_FILE variable;
+//  3. environment variable;
+//  4. command line flag.
+package config
+
+import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/logging"
+	"avito-trainee-assignment/internal/outbox"
+	"avito-trainee-assignment/internal/retention"
+	"avito-trainee-assignment/internal/server"
+	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/thumbnail"
+	"avito-trainee-assignment/internal/tracing"
+	"avito-trainee-assignment/internal/webhook"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"time"
+)
+
+// tlsVersions maps accepted values of server.tls_min_version to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config defines parameters of all application components.
+// Leaf fields are tagged with:
+//
+//	yaml    - key inside the section, it is also used for TOML files and flag names;
+//	env     - environment variable;
+//	default - default value;
+//	usage   - flag description;
+//	secret  - "true" hides the value in Print output;
+//	reload  - "true" marks parameters applied on SIGHUP without restart.
+type Config struct {
+	Log       LogConfig       `yaml:"log"`
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Blob      BlobConfig      `yaml:"blob"`
+	Thumbnail ThumbnailConfig `yaml:"thumbnail"`
+	Webhook   WebhookConfig   `yaml:"webhook"`
+	Outbox    OutboxConfig    `yaml:"outbox"`
+	Retention RetentionConfig `yaml:"retention"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+
+	// File is the path of loaded configuration file, it is blank if no file was used
+	File string `yaml:"-"`
+	// PrintConfig is set by --print-config flag
+	PrintConfig bool `yaml:"-"`
+}
+
+// LogConfig defines parameters of application logger
+type LogConfig struct {
+	Level              string        `yaml:"level" env:"LOG_LEVEL" default:"debug" reload:"true" usage:"minimal level of logged messages: debug, info, warn or error"`
+	ServerLevel        string        `yaml:"server_level" env:"LOG_SERVER_LEVEL" reload:"true" usage:"level of HTTP server messages, blank means log.level"`
+	StorageLevel       string        `yaml:"storage_level" env:"LOG_STORAGE_LEVEL" reload:"true" usage:"level of storage messages, blank means log.level"`
+	PgxLevel           string        `yaml:"pgx_level" env:"LOG_PGX_LEVEL" reload:"true" usage:"level of pgx query messages, blank means log.level"`
+	Format             string        `yaml:"format" env:"LOG_FORMAT" default:"console" usage:"encoding of log entries, \"console\" or \"json\""`
+	Output             string        `yaml:"output" env:"LOG_OUTPUT" default:"stderr" usage:"\"stderr\", \"stdout\" or a path of log file"`
+	MaxSize            int           `yaml:"max_size" env:"LOG_MAX_SIZE" default:"100" usage:"size in megabytes the log file is rotated at"`
+	MaxBackups         int           `yaml:"max_backups" env:"LOG_MAX_BACKUPS" default:"0" usage:"number of kept rotated log files, zero means all"`
+	MaxAge             time.Duration `yaml:"max_age" env:"LOG_MAX_AGE" default:"0s" usage:"maximum age of kept rotated log files rounded down to days, zero means unlimited"`
+	Compress           bool          `yaml:"compress" env:"LOG_COMPRESS" default:"false" usage:"gzip rotated log files"`
+	SamplingInitial    int           `yaml:"sampling_initial" env:"LOG_SAMPLING_INITIAL" default:"0" usage:"number of the same messages logged every second before sampling, zero disables sampling"`
+	SamplingThereafter int           `yaml:"sampling_thereafter" env:"LOG_SAMPLING_THEREAFTER" default:"0" usage:"every n-th of the same messages logged after sampling starts"`
+}
+
+// ServerConfig defines parameters of HTTP server
+type ServerConfig struct {
+	Host                 string        `yaml:"host" env:"HOST" default:"0.0.0.0" usage:"address to listen on"`
+	Port                 uint16        `yaml:"port" env:"PORT" default:"9000" usage:"port to listen on"`
+	ReadTimeout          time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT" default:"5s" usage:"maximum duration for reading the entire request, zero means no timeout"`
+	WriteTimeout         time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT" default:"0s" usage:"maximum duration before timing out writes of the response, zero means no timeout"`
+	IdleTimeout          time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" default:"0s" usage:"maximum duration to wait for the next request on keep-alive connection, zero means read timeout"`
+	RequestTimeout       time.Duration `yaml:"request_timeout" env:"SERVER_REQUEST_TIMEOUT" default:"0s" reload:"true" usage:"maximum duration of handling a request, zero means no timeout"`
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold" env:"SERVER_SLOW_REQUEST_THRESHOLD" default:"1s" usage:"duration of handling a request after which it is logged as slow, zero disables"`
+	MaxUploadSize        int64         `yaml:"max_upload_size" env:"SERVER_MAX_UPLOAD_SIZE" default:"26214400" usage:"maximum size of a single attachment in bytes"`
+	TLSCert              string        `yaml:"tls_cert" env:"SERVER_TLS_CERT" usage:"path of PEM certificate enabling HTTPS and HTTP/2, reloaded on change"`
+	TLSKey               string        `yaml:"tls_key" env:"SERVER_TLS_KEY" usage:"path of PEM private key of the certificate, reloaded on change"`
+	TLSMinVersion        string        `yaml:"tls_min_version" env:"SERVER_TLS_MIN_VERSION" default:"1.2" usage:"minimum TLS version, \"1.2\" or \"1.3\""`
+	TLSClientCA          string        `yaml:"tls_client_ca" env:"SERVER_TLS_CLIENT_CA" usage:"path of PEM CA certificates verifying client certificates, blank disables mutual TLS"`
+	RedirectAddr         string        `yaml:"redirect_addr" env:"SERVER_REDIRECT_ADDR" usage:"address of plaintext listener redirecting to HTTPS, blank disables"`
+	CompressionMinSize   int           `yaml:"compression_min_size" env:"SERVER_COMPRESSION_MIN_SIZE" default:"1024" usage:"response size in bytes from which responses are compressed with brotli or gzip"`
+	MaxRequestSize       int64         `yaml:"max_request_size" env:"SERVER_MAX_REQUEST_SIZE" default:"1048576" usage:"maximum size of decompressed gzip request body in bytes"`
+	AdminAddr            string        `yaml:"admin_addr" env:"SERVER_ADMIN_ADDR" usage:"address of listener serving profiling, log levels, pool stats and build info, blank disables"`
+}
+
+// StorageConfig defines parameters of Postgres connection pool.
+// Blank connection parameters are resolved by pgx with libpq defaults.
+type StorageConfig struct {
+	Host              string        `yaml:"host" env:"PGHOST" usage:"Postgres server host"`
+	Port              uint16        `yaml:"port" env:"PGPORT" default:"5432" usage:"Postgres server port"`
+	Database          string        `yaml:"database" env:"PGDATABASE" usage:"Postgres database name"`
+	User              string        `yaml:"user" env:"PGUSER" usage:"Postgres user"`
+	Password          string        `yaml:"password" env:"PGPASSWORD" secret:"true" usage:"Postgres password"`
+	ConnectionTimeout time.Duration `yaml:"connection_timeout" env:"STORAGE_CONNECTION_TIMEOUT" default:"30s" usage:"timeout of establishing connection pool"`
+	MaxConns          int32         `yaml:"max_conns" env:"STORAGE_MAX_CONNS" default:"0" usage:"maximum size of connection pool, zero means pgx default"`
+	SearchLanguage    string        `yaml:"search_language" env:"STORAGE_SEARCH_LANGUAGE" default:"english" usage:"text search configuration of message search"`
+	PreviewLength     int           `yaml:"preview_length" env:"STORAGE_PREVIEW_LENGTH" default:"100" usage:"length of last message preview in chat lists"`
+}
+
+// BlobConfig defines parameters of attachment blob store
+type BlobConfig struct {
+	Backend     string `yaml:"backend" env:"BLOB_BACKEND" default:"fs" usage:"blob store backend, \"fs\" or \"s3\""`
+	FSRoot      string `yaml:"fs_root" env:"BLOB_FS_ROOT" default:"data/blobs" usage:"root directory of \"fs\" backend"`
+	S3Endpoint  string `yaml:"s3_endpoint" env:"BLOB_S3_ENDPOINT" usage:"endpoint of \"s3\" backend"`
+	S3Region    string `yaml:"s3_region" env:"BLOB_S3_REGION" usage:"region of \"s3\" backend"`
+	S3Bucket    string `yaml:"s3_bucket" env:"BLOB_S3_BUCKET" default:"attachments" usage:"bucket of \"s3\" backend"`
+	S3AccessKey string `yaml:"s3_access_key" env:"BLOB_S3_ACCESS_KEY" secret:"true" usage:"access key of \"s3\" backend"`
+	S3SecretKey string `yaml:"s3_secret_key" env:"BLOB_S3_SECRET_KEY" secret:"true" usage:"secret key of \"s3\" backend"`
+	S3UseSSL    bool   `yaml:"s3_use_ssl" env:"BLOB_S3_USE_SSL" default:"false" usage:"use TLS for \"s3\" backend"`
+}
+
+// ThumbnailConfig defines parameters of thumbnail generation
+type ThumbnailConfig struct {
+	Sizes     []int `yaml:"sizes" env:"THUMBNAIL_SIZES" default:"128,512" usage:"comma separated thumbnail sizes in pixels"`
+	Workers   int   `yaml:"workers" env:"THUMBNAIL_WORKERS" default:"2" usage:"number of thumbnail workers"`
+	QueueSize int   `yaml:"queue_size" env:"THUMBNAIL_QUEUE_SIZE" default:"64" usage:"number of images waiting for a worker"`
+}
+
+// WebhookConfig defines parameters of webhook delivery
+type WebhookConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval" env:"WEBHOOK_POLL_INTERVAL" default:"1s" usage:"interval of polling due deliveries"`
+	MaxAttempts  int           `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" default:"8" usage:"number of delivery attempts before giving up"`
+	Timeout      time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT" default:"10s" usage:"timeout of a single delivery attempt"`
+}
+
+// OutboxConfig defines parameters of outbox relay
+type OutboxConfig struct {
+	File         string        `yaml:"file" env:"OUTBOX_FILE" default:"data/outbox.ndjson" usage:"file events are published to"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"OUTBOX_POLL_INTERVAL" default:"5s" usage:"interval of polling unpublished events"`
+	BatchSize    int           `yaml:"batch_size" env:"OUTBOX_BATCH_SIZE" default:"100" usage:"maximum number of events published at once"`
+}
+
+// RetentionConfig defines parameters of message retention
+type RetentionConfig struct {
+	Interval  time.Duration `yaml:"interval" env:"RETENTION_INTERVAL" default:"10m" reload:"true" usage:"interval of purging expired messages"`
+	BatchSize int           `yaml:"batch_size" env:"RETENTION_BATCH_SIZE" default:"500" reload:"true" usage:"maximum number of messages purged at once"`
+	MaxAge    time.Duration `yaml:"max_age" env:"RETENTION_MAX_AGE" default:"0s" reload:"true" usage:"global maximum message age, zero means unlimited"`
+	MaxCount  int           `yaml:"max_count" env:"RETENTION_MAX_COUNT" default:"0" reload:"true" usage:"global maximum number of messages per chat, zero means unlimited"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER" default:"none" usage:"exporter of spans: \"none\", \"stdout\" or \"file\""`
+	File        string  `yaml:"file" env:"TRACING_FILE" default:"traces.json" usage:"path of the file spans are appended to by \"file\" exporter"`
+	ServiceName string  `yaml:"service_name" env:"TRACING_SERVICE_NAME" default:"avito-trainee-assignment" usage:"service name attached to exported spans"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" default:"1" usage:"fraction of new traces recorded, traces of callers follow their sampling decision"`
+}
+
+// Validate checks values which can not be used by the components and reports all of them at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, key, msg string) {
+		if !ok {
+			problems = append(problems, key+" "+msg)
+		}
+	}
+
+	const levels = "debug, info, warn, error, dpanic, panic or fatal"
+	_, err := c.LogLevel()
+	check(err == nil, "log.level", "must be one of "+levels)
+	for _, component := range []struct{ key, level string }{
+		{"log.server_level", c.Log.ServerLevel},
+		{"log.storage_level", c.Log.StorageLevel},
+		{"log.pgx_level", c.Log.PgxLevel},
+	} {
+		var l zapcore.Level
+		check(component.level == "" || l.UnmarshalText([]byte(component.level)) == nil, component.key, "must be blank or one of "+levels)
+	}
+	check(c.Log.Format == logging.FormatConsole || c.Log.Format == logging.FormatJSON, "log.format", "must be either \"console\" or \"json\"")
+	check(c.Log.Output != "", "log.output", "must not be blank")
+	check(c.Log.MaxSize >= 0, "log.max_size", "must not be negative")
+	check(c.Log.MaxBackups >= 0, "log.max_backups", "must not be negative")
+	check(c.Log.MaxAge >= 0, "log.max_age", "must not be negative")
+	check(c.Log.SamplingInitial >= 0, "log.sampling_initial", "must not be negative")
+	check(c.Log.SamplingInitial == 0 || c.Log.SamplingThereafter > 0, "log.sampling_thereafter", "must be greater than zero when sampling is enabled")
+
+	check(c.Server.Port > 0, "server.port", "must be greater than zero")
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout", "must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout", "must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout", "must not be negative")
+	check(c.Server.RequestTimeout >= 0, "server.request_timeout", "must not be negative")
+	check(c.Server.SlowRequestThreshold >= 0, "server.slow_request_threshold", "must not be negative")
+	check(c.Server.MaxUploadSize > 0, "server.max_upload_size", "must be greater than zero")
+	check(c.Server.CompressionMinSize >= 0, "server.compression_min_size", "must not be negative")
+	check(c.Server.MaxRequestSize > 0, "server.max_request_size", "must be greater than zero")
+	check((c.Server.TLSCert == "") == (c.Server.TLSKey == ""), "server.tls_key", "must be set along with server.tls_cert")
+	_, ok := tlsVersions[c.Server.TLSMinVersion]
+	check(ok, "server.tls_min_version", "must be either \"1.2\" or \"1.3\"")
+	check(c.Server.TLSClientCA == "" || c.Server.TLSCert != "", "server.tls_client_ca", "requires server.tls_cert")
+	check(c.Server.RedirectAddr == "" || c.Server.TLSCert != "", "server.redirect_addr", "requires server.tls_cert")
+
+	check(c.Storage.Port > 0, "storage.port", "must be greater than zero")
+	check(c.Storage.Password == "" || c.Storage.User != "", "storage.password", "requires storage.user")
+	check(c.Storage.ConnectionTimeout > 0, "storage.connection_timeout", "must be greater than zero")
+	check(c.Storage.MaxConns >= 0, "storage.max_conns", "must not be negative")
+	check(c.Storage.SearchLanguage != "", "storage.search_language", "must not be blank")
+	check(c.Storage.PreviewLength > 0, "storage.preview_length", "must be greater than zero")
+
+	switch c.Blob.Backend {
+	case "fs":
+		check(c.Blob.FSRoot != "", "blob.fs_root", "must not be blank")
+	case "s3":
+		check(c.Blob.S3Endpoint != "", "blob.s3_endpoint", "must not be blank")
+		check(c.Blob.S3Bucket != "", "blob.s3_bucket", "must not be blank")
+	default:
+		check(false, "blob.backend", "must be either \"fs\" or \"s3\"")
+	}
+
+	check(len(c.Thumbnail.Sizes) > 0, "thumbnail.sizes", "must not be empty")
+	for _, size := range c.Thumbnail.Sizes {
+		if size < 1 {
+			check(false, "thumbnail.sizes", "must be greater than zero")
+			break
+		}
+	}
+	check(c.Thumbnail.Workers > 0, "thumbnail.workers", "must be greater than zero")
+	check(c.Thumbnail.QueueSize >= 0, "thumbnail.queue_size", "must not be negative")
+
+	check(c.Webhook.PollInterval > 0, "webhook.poll_interval", "must be greater than zero")
+	check(c.Webhook.MaxAttempts > 0, "webhook.max_attempts", "must be greater than zero")
+	check(c.Webhook.Timeout > 0, "webhook.timeout", "must be greater than zero")
+
+	check(c.Outbox.File != "", "outbox.file", "must not be blank")
+	check(c.Outbox.PollInterval > 0, "outbox.poll_interval", "must be greater than zero")
+	check(c.Outbox.BatchSize > 0, "outbox.batch_size", "must be greater than zero")
+
+	check(c.Retention.Interval > 0, "retention.interval", "must be greater than zero")
+	check(c.Retention.BatchSize > 0, "retention.batch_size", "must be greater than zero")
+	check(c.Retention.MaxAge >= 0, "retention.max_age", "must not be negative")
+	check(c.Retention.MaxCount >= 0, "retention.max_count", "must not be negative")
+
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout:
+	case tracing.ExporterFile:
+		check(c.Tracing.File != "", "tracing.file", "must not be blank")
+	default:
+		check(false, "tracing.exporter", "must be one of \"none\", \"stdout\" or \"file\"")
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be between 0 and 1")
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// LogLevel returns parsed log level
+func (c *Config) LogLevel() (zapcore.Level, error) {
+	var l zapcore.Level
+	err := l.UnmarshalText([]byte(c.Log.Level))
+	return l, err
+}
+
+// ComponentLevels returns parsed levels of component loggers, blank levels are skipped
+func (c *Config) ComponentLevels() (map[string]zapcore.Level, error) {
+	levels := make(map[string]zapcore.Level)
+	for component, text := range map[string]string{
+		logging.ComponentServer:  c.Log.ServerLevel,
+		logging.ComponentStorage: c.Log.StorageLevel,
+		logging.ComponentPgx:     c.Log.PgxLevel,
+	} {
+		if text == "" {
+			continue
+		}
+
+		var l zapcore.Level
+		err := l.UnmarshalText([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", component, err)
+		}
+		levels[component] = l
+	}
+
+	return levels, nil
+}
+
+// LoggingOptions returns options configuring logging.Logger, levels must be already validated
+func (c *Config) LoggingOptions() []logging.Option {
+	level, _ := c.LogLevel()
+	opts := []logging.Option{
+		logging.Format(c.Log.Format),
+		logging.Level(level),
+		logging.Output(c.Log.Output),
+		logging.Rotation(c.Log.MaxSize, c.Log.MaxBackups, c.Log.MaxAge, c.Log.Compress),
+		logging.Sampling(c.Log.SamplingInitial, c.Log.SamplingThereafter),
+	}
+
+	components, _ := c.ComponentLevels()
+	for component, l := range components {
+		opts = append(opts, logging.ComponentLevel(component, l))
+	}
+
+	return opts
+}
+
+// ServerOptions returns options configuring http.Server of server.Server.
+// Attachments option is not included since it requires a blob store, see Server.MaxUploadSize.
+func (c *Config) ServerOptions() []server.Option {
+	opts := []server.Option{
+		server.WithEnvConfig(server.EnvConfig{Host: c.Server.Host, Port: c.Server.Port}),
+		server.ReadTimeout(c.Server.ReadTimeout),
+		server.WriteTimeout(c.Server.WriteTimeout),
+		server.IdleTimeout(c.Server.IdleTimeout),
+		server.RequestTimeout(c.Server.RequestTimeout),
+		server.SlowRequestThreshold(c.Server.SlowRequestThreshold),
+		server.CompressionMinSize(c.Server.CompressionMinSize),
+		server.MaxRequestSize(c.Server.MaxRequestSize),
+	}
+
+	if c.Server.AdminAddr != "" {
+		opts = append(opts, server.Admin(c.Server.AdminAddr))
+	}
+
+	if c.Server.TLSCert != "" {
+		opts = append(opts,
+			server.TLS(c.Server.TLSCert, c.Server.TLSKey),
+			server.TLSMinVersion(tlsVersions[c.Server.TLSMinVersion]),
+			server.ClientCA(c.Server.TLSClientCA),
+			server.RedirectHTTP(c.Server.RedirectAddr),
+		)
+	}
+
+	return opts
+}
+
+// StorageOptions returns options configuring storage.Store, blank connection parameters are left to pgx
+func (c *Config) StorageOptions() []storage.Option {
+	opts := []storage.Option{
+		storage.ConnectionTimeout(c.Storage.ConnectionTimeout),
+		storage.SearchLanguage(c.Storage.SearchLanguage),
+		storage.PreviewLength(c.Storage.PreviewLength),
+	}
+
+	if c.Storage.Host != "" {
+		opts = append(opts, storage.Endpoint(c.Storage.Host, c.Storage.Port))
+	}
+
+	if c.Storage.Database != "" {
+		opts = append(opts, storage.Database(c.Storage.Database))
+	}
+
+	if c.Storage.User != "" {
+		opts = append(opts, storage.Credentials(c.Storage.User, c.Storage.Password))
+	}
+
+	if c.Storage.MaxConns > 0 {
+		opts = append(opts, storage.MaxConns(c.Storage.MaxConns))
+	}
+
+	return opts
+}
+
+// BlobEnvConfig returns parameters for blob.FromEnvConfig
+func (c *Config) BlobEnvConfig() blob.EnvConfig {
+	return blob.EnvConfig{
+		Backend:     c.Blob.Backend,
+		FSRoot:      c.Blob.FSRoot,
+		S3Endpoint:  c.Blob.S3Endpoint,
+		S3Region:    c.Blob.S3Region,
+		S3Bucket:    c.Blob.S3Bucket,
+		S3AccessKey: c.Blob.S3AccessKey,
+		S3SecretKey: c.Blob.S3SecretKey,
+		S3UseSSL:    c.Blob.S3UseSSL,
+	}
+}
+
+// ThumbnailOptions returns options configuring thumbnail.Pool
+func (c *Config) ThumbnailOptions() []thumbnail.Option {
+	return []thumbnail.Option{
+		thumbnail.WithEnvConfig(thumbnail.EnvConfig{
+			Sizes:     c.Thumbnail.Sizes,
+			Workers:   c.Thumbnail.Workers,
+			QueueSize: c.Thumbnail.QueueSize,
+		}),
+	}
+}
+
+// WebhookOptions returns options configuring webhook.Dispatcher
+func (c *Config) WebhookOptions() []webhook.Option {
+	return []webhook.Option{
+		webhook.WithEnvConfig(webhook.EnvConfig{
+			PollInterval: c.Webhook.PollInterval,
+			MaxAttempts:  c.Webhook.MaxAttempts,
+			Timeout:      c.Webhook.Timeout,
+		}),
+	}
+}
+
+// OutboxOptions returns options configuring outbox.Relay, the file is opened by the caller
+func (c *Config) OutboxOptions() []outbox.Option {
+	return []outbox.Option{
+		outbox.WithEnvConfig(outbox.EnvConfig{
+			File:         c.Outbox.File,
+			PollInterval: c.Outbox.PollInterval,
+			BatchSize:    c.Outbox.BatchSize,
+		}),
+	}
+}
+
+// RetentionOptions returns options configuring retention.Janitor
+func (c *Config) RetentionOptions() []retention.Option {
+	return []retention.Option{
+		retention.WithEnvConfig(retention.EnvConfig{
+			Interval:  c.Retention.Interval,
+			BatchSize: c.Retention.BatchSize,
+			MaxAge:    c.Retention.MaxAge,
+			MaxCount:  c.Retention.MaxCount,
+		}),
+	}
+}
+
+// TracingOptions returns options configuring tracing.Provider
+func (c *Config) TracingOptions() []tracing.Option {
+	return []tracing.Option{
+		tracing.Exporter(c.Tracing.Exporter),
+		tracing.File(c.Tracing.File),
+		tracing.ServiceName(c.Tracing.ServiceName),
+		tracing.SampleRatio(c.Tracing.SampleRatio),
+	}
+}
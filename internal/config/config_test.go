@@ -0,0 +1,253 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// env returns lookupEnv function reading provided variables
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+// writeFile writes content into a temporary file with provided name and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := load(nil, env(nil), ioutil.Discard)
+	require.NoError(t, err)
+
+	require.Equal(t, "0.0.0.0", cfg.Server.Host)
+	require.Equal(t, uint16(9000), cfg.Server.Port)
+	require.Equal(t, 5*time.Second, cfg.Server.ReadTimeout)
+	require.Equal(t, int64(25<<20), cfg.Server.MaxUploadSize)
+	require.Equal(t, 30*time.Second, cfg.Storage.ConnectionTimeout)
+	require.Equal(t, "english", cfg.Storage.SearchLanguage)
+	require.Equal(t, []int{128, 512}, cfg.Thumbnail.Sizes)
+	require.Equal(t, 10*time.Minute, cfg.Retention.Interval)
+	require.Equal(t, "none", cfg.Tracing.Exporter)
+	require.Equal(t, 1.0, cfg.Tracing.SampleRatio)
+	require.False(t, cfg.PrintConfig)
+	require.Empty(t, cfg.File)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+server:
+  port: 8000
+  read_timeout: 7s
+  write_timeout: 9s
+storage:
+  search_language: russian
+thumbnail:
+  sizes: [64]
+`)
+
+	vars := map[string]string{
+		"CONFIG_FILE":         path,
+		"PORT":                "8500",
+		"SERVER_READ_TIMEOUT": "8s",
+	}
+	args := []string{"--server.read-timeout", "10s", "--print-config"}
+
+	cfg, err := load(args, env(vars), ioutil.Discard)
+	require.NoError(t, err)
+
+	require.Equal(t, path, cfg.File)
+	// file overrides default
+	require.Equal(t, 9*time.Second, cfg.Server.WriteTimeout)
+	require.Equal(t, "russian", cfg.Storage.SearchLanguage)
+	require.Equal(t, []int{64}, cfg.Thumbnail.Sizes)
+	// env overrides file
+	require.Equal(t, uint16(8500), cfg.Server.Port)
+	// flag overrides env
+	require.Equal(t, 10*time.Second, cfg.Server.ReadTimeout)
+	// keys missing in every source keep defaults
+	require.Equal(t, "0.0.0.0", cfg.Server.Host)
+	require.True(t, cfg.PrintConfig)
+}
+
+func TestLoadConfigFlagOverridesEnv(t *testing.T) {
+	fromEnv := writeFile(t, "env.yaml", "server:\n  port: 1\n")
+	fromFlag := writeFile(t, "flag.yaml", "server:\n  port: 2\n")
+
+	cfg, err := load([]string{"--config", fromFlag}, env(map[string]string{"CONFIG_FILE": fromEnv}), ioutil.Discard)
+	require.NoError(t, err)
+	require.Equal(t, uint16(2), cfg.Server.Port)
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+[server]
+host = "127.0.0.1"
+idle_timeout = "1m"
+
+[blob]
+s3_use_ssl = true
+
+[retention]
+max_count = 1000
+
+[tracing]
+sample_ratio = 0.25
+`)
+
+	cfg, err := load([]string{"--config", path}, env(nil), ioutil.Discard)
+	require.NoError(t, err)
+
+	require.Equal(t, "127.0.0.1", cfg.Server.Host)
+	require.Equal(t, time.Minute, cfg.Server.IdleTimeout)
+	require.True(t, cfg.Blob.S3UseSSL)
+	require.Equal(t, 1000, cfg.Retention.MaxCount)
+	require.Equal(t, 0.25, cfg.Tracing.SampleRatio)
+}
+
+func TestLoadErrors(t *testing.T) {
+	unknown := writeFile(t, "unknown.yaml", "server:\n  prot: 8000\n")
+	extension := writeFile(t, "config.json", "{}")
+
+	tests := []struct {
+		name string
+		args []string
+		vars map[string]string
+	}{
+		{name: "unknown key", args: []string{"--config", unknown}},
+		{name: "unsupported extension", args: []string{"--config", extension}},
+		{name: "missing file", args: []string{"--config", filepath.Join(filepath.Dir(unknown), "missing.yaml")}},
+		{name: "bad env value", vars: map[string]string{"PORT": "port"}},
+		{name: "bad flag value", args: []string{"--thumbnail.sizes", "128,big"}},
+		{name: "unknown flag", args: []string{"--server.prot", "8000"}},
+		{name: "positional argument", args: []string{"serve"}},
+		{name: "invalid value", args: []string{"--webhook.max-attempts", "0"}},
+		{name: "invalid log level", vars: map[string]string{"LOG_LEVEL": "verbose"}},
+		{name: "TLS key without certificate", args: []string{"--server.tls-key", "key.pem"}},
+		{name: "unknown TLS version", vars: map[string]string{"SERVER_TLS_MIN_VERSION": "1.0"}},
+		{name: "redirect without TLS", args: []string{"--server.redirect-addr", ":80"}},
+		{name: "bad float value", vars: map[string]string{"TRACING_SAMPLE_RATIO": "half"}},
+		{name: "invalid sample ratio", args: []string{"--tracing.sample-ratio", "1.5"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := load(test.args, env(test.vars), ioutil.Discard)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	var out bytes.Buffer
+	_, err := load([]string{"--help"}, env(nil), &out)
+	require.Equal(t, flag.ErrHelp, err)
+	require.Contains(t, out.String(), "-server.read-timeout")
+	require.Contains(t, out.String(), "SERVER_READ_TIMEOUT")
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := load(nil, env(nil), ioutil.Discard)
+	require.NoError(t, err)
+
+	cfg.Blob.Backend = "s3"
+	cfg.Storage.Password = "secret"
+	cfg.Thumbnail.Sizes = []int{128, -1}
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "blob.s3_endpoint")
+	require.Contains(t, err.Error(), "storage.password")
+	require.Contains(t, err.Error(), "thumbnail.sizes")
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	vars := map[string]string{
+		"PGUSER":             "kris",
+		"PGPASSWORD":         "pg-password",
+		"BLOB_S3_SECRET_KEY": "s3-secret",
+	}
+
+	cfg, err := load(nil, env(vars), ioutil.Discard)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, cfg.Print(&out))
+
+	require.NotContains(t, out.String(), "pg-password")
+	require.NotContains(t, out.String(), "s3-secret")
+	require.Contains(t, out.String(), "password: "+redacted)
+	require.Contains(t, out.String(), "user: kris")
+	require.Contains(t, out.String(), "read_timeout: 5s")
+	// blank secrets stay blank, so it is visible that they are not set
+	require.Contains(t, out.String(), `s3_access_key: ""`)
+
+	// the printed configuration keeps the secrets
+	require.Equal(t, "pg-password", cfg.Storage.Password)
+
+	// printed configuration is a valid configuration file
+	path := writeFile(t, "printed.yaml", out.String())
+	_, err = load([]string{"--config", path}, env(nil), ioutil.Discard)
+	require.NoError(t, err)
+}
+
+func TestOptions(t *testing.T) {
+	cfg, err := load([]string{"--storage.host", "db", "--storage.max-conns", "8"}, env(nil), ioutil.Discard)
+	require.NoError(t, err)
+
+	require.Len(t, cfg.ServerOptions(), 8)
+	cfg.Server.TLSCert = "cert.pem"
+	cfg.Server.TLSKey = "key.pem"
+	require.Len(t, cfg.ServerOptions(), 12)
+	cfg.Server.AdminAddr = "127.0.0.1:9001"
+	require.Len(t, cfg.ServerOptions(), 13)
+	require.Len(t, cfg.StorageOptions(), 5)
+	require.Equal(t, "fs", cfg.BlobEnvConfig().Backend)
+}
+
+func TestRestartRequired(t *testing.T) {
+	current, err := load(nil, env(nil), ioutil.Discard)
+	require.NoError(t, err)
+
+	vars := map[string]string{
+		"LOG_LEVEL":           "warn",
+		"RETENTION_MAX_COUNT": "100",
+		"PORT":                "9001",
+		"THUMBNAIL_SIZES":     "64",
+	}
+	next, err := load([]string{"--server.request-timeout", "30s"}, env(vars), ioutil.Discard)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"server.port", "thumbnail.sizes"}, current.RestartRequired(next))
+	require.Empty(t, current.RestartRequired(current))
+
+	applied := current.Reloaded(next)
+	require.Equal(t, "warn", applied.Log.Level)
+	require.Equal(t, 100, applied.Retention.MaxCount)
+	require.Equal(t, 30*time.Second, applied.Server.RequestTimeout)
+	require.Equal(t, current.Server.Port, applied.Server.Port)
+	require.Equal(t, current.Thumbnail.Sizes, applied.Thumbnail.Sizes)
+	require.Equal(t, "debug", current.Log.Level)
+	// changes requiring restart are reported until the restart
+	require.Equal(t, []string{"server.port", "thumbnail.sizes"}, applied.RestartRequired(next))
+
+	level, err := next.LogLevel()
+	require.NoError(t, err)
+	require.Equal(t, zapcore.WarnLevel, level)
+}
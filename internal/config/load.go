@@ -0,0 +1,340 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileEnv is the environment variable holding configuration file path, --config flag takes precedence over it
+const fileEnv = "CONFIG_FILE"
+
+// redacted replaces non-blank secrets in PrintConfig output
+const redacted = "<redacted>"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is a leaf parameter of Config
+type field struct {
+	// key is a dotted path of the field, e.g. "server.read_timeout"
+	key    string
+	env    string
+	def    string
+	usage  string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+// flagName returns command line flag name of the field, e.g. "server.read-timeout"
+func (f field) flagName() string {
+	return strings.ReplaceAll(f.key, "_", "-")
+}
+
+// set parses s according to the field type and stores the result
+func (f field) set(s string) error {
+	v := f.value
+
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Int:
+		ints := make([]int, 0)
+		for _, part := range strings.Split(s, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return err
+			}
+			ints = append(ints, n)
+		}
+		v.Set(reflect.ValueOf(ints))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// fields returns leaf parameters of cfg, values are addressable, so they can be set
+func fields(cfg *Config) []field {
+	var result []field
+
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i)
+		prefix := section.Tag.Get("yaml")
+		if prefix == "-" {
+			continue
+		}
+
+		sv := root.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			sf := sv.Type().Field(j)
+			result = append(result, field{
+				key:    prefix + "." + sf.Tag.Get("yaml"),
+				env:    sf.Tag.Get("env"),
+				def:    sf.Tag.Get("default"),
+				usage:  sf.Tag.Get("usage"),
+				secret: sf.Tag.Get("secret") == "true",
+				reload: sf.Tag.Get("reload") == "true",
+				value:  sv.Field(j),
+			})
+		}
+	}
+
+	return result
+}
+
+// flagValue keeps a flag argument until all sources with lower precedence are applied
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *flagValue) Set(s string) error {
+	v.value = s
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool { return v.isBool }
+
+// Load resolves configuration from defaults, configuration file, environment variables and command line arguments
+// (without the program name) and validates it. flag.ErrHelp is returned if -h or --help flag was provided.
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv, os.Stderr)
+}
+
+// load is Load with replaceable environment and output of flag usage
+func load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, error) {
+	cfg := &Config{}
+	params := fields(cfg)
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintf(output, "Usage of server:\n"+
+			"Parameters are taken from defaults, then from --config file, then from environment variables\n"+
+			"and finally from flags, every next source overrides the previous one.\n\n")
+		fs.PrintDefaults()
+	}
+
+	file := fs.String("config", "", "path of YAML (.yaml, .yml) or TOML (.toml) configuration file, env "+fileEnv)
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print resolved configuration with redacted secrets and exit")
+
+	values := make(map[string]*flagValue, len(params))
+	for _, p := range params {
+		v := &flagValue{value: p.def, isBool: p.value.Kind() == reflect.Bool}
+		values[p.flagName()] = v
+
+		usage := p.usage
+		if p.env != "" {
+			usage += ", env " + p.env
+		}
+		fs.Var(v, p.flagName(), usage)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	for _, p := range params {
+		if p.def == "" {
+			continue
+		}
+		err = p.set(p.def)
+		if err != nil {
+			return nil, fmt.Errorf("default of %s: %w", p.key, err)
+		}
+	}
+
+	cfg.File = *file
+	if cfg.File == "" {
+		cfg.File, _ = lookupEnv(fileEnv)
+	}
+
+	if cfg.File != "" {
+		err = decodeFile(cfg.File, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range params {
+		if p.env == "" {
+			continue
+		}
+
+		s, ok := lookupEnv(p.env)
+		if !ok {
+			continue
+		}
+
+		err = p.set(s)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s: %w", p.env, err)
+		}
+	}
+
+	visited := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+
+	for _, p := range params {
+		name := p.flagName()
+		if !visited[name] {
+			continue
+		}
+
+		err = p.set(values[name].value)
+		if err != nil {
+			return nil, fmt.Errorf("flag --%s: %w", name, err)
+		}
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// decodeFile decodes configuration file into cfg choosing the format by file extension.
+// Keys missing in the file keep their values, unknown keys are reported as errors.
+func decodeFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		// TOML is converted to YAML to share the decoding of durations and the check of unknown keys
+		var m map[string]interface{}
+		_, err = toml.Decode(string(data), &m)
+		if err != nil {
+			return fmt.Errorf("decoding config file %s: %w", path, err)
+		}
+
+		data, err = yaml.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("decoding config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s must have .yaml, .yml or .toml extension", path)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("decoding config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Print writes configuration to w in YAML format replacing non-blank secrets with a placeholder
+func (c *Config) Print(w io.Writer) error {
+	cp := *c
+	for _, p := range fields(&cp) {
+		if p.secret && p.value.String() != "" {
+			p.value.SetString(redacted)
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(&cp)
+	if err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// Reloaded returns configuration in effect after next one is reloaded: parameters applied on reload are taken
+// from next, the rest keep values of c until restart
+func (c *Config) Reloaded(next *Config) *Config {
+	applied := *c
+	nextFields := fields(next)
+	for i, p := range fields(&applied) {
+		if p.reload {
+			p.value.Set(nextFields[i].value)
+		}
+	}
+
+	return &applied
+}
+
+// RestartRequired returns keys of parameters which differ in next configuration and are not applied on reload
+func (c *Config) RestartRequired(next *Config) []string {
+	current := fields(c)
+
+	var keys []string
+	for i, p := range fields(next) {
+		if !p.reload && !reflect.DeepEqual(p.value.Interface(), current[i].value.Interface()) {
+			keys = append(keys, p.key)
+		}
+	}
+
+	return keys
+}
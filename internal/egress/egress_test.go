@@ -0,0 +1,79 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsPublic(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.public, IsPublic(net.ParseIP(c.ip)), c.ip)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	require.NoError(t, CheckURL(ctx, "https://93.184.216.34/hook"))
+
+	for _, u := range []string{"ftp://93.184.216.34", "/relative", "https://", "http://:80/"} {
+		require.True(t, errors.Is(CheckURL(ctx, u), ErrBadURL), u)
+	}
+
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://localhost/hook",
+	} {
+		require.True(t, errors.Is(CheckURL(ctx, u), ErrNotPublic), u)
+	}
+}
+
+func TestClientRefusesNonPublicAddress(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	resp, err := Client(time.Second).Get(receiver.URL)
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	require.True(t, errors.Is(err, ErrNotPublic), err)
+	require.False(t, called)
+}
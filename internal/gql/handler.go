@@ -0,0 +1,53 @@
+// Package gql serves users, chats and messages over GraphQL with nested resolution batched by dataloaders.
+package gql
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// maxDepth limits nesting of incoming queries, e.g. chat → messages → author → chats → members → user
+const maxDepth = 8
+
+// panicLogger implements graphql-go log.Logger interface on top of zap
+type panicLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l panicLogger) LogPanic(_ context.Context, value interface{}) {
+	l.logger.Errorf("graphql: panic occurred: %v", value)
+}
+
+// NewHandler constructs http.Handler executing GraphQL queries against provided store.
+// Each request gets its own set of dataloaders so cached entities never leak between requests.
+func NewHandler(logger *zap.SugaredLogger, store *storage.Store) (http.Handler, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+
+	if store == nil {
+		return nil, errors.New("no store provided")
+	}
+
+	s, err := graphql.ParseSchema(
+		schema,
+		&rootResolver{},
+		graphql.MaxDepth(maxDepth),
+		graphql.Logger(panicLogger{logger: logger}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &relay.Handler{Schema: s}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := newContextWithLoaders(r.Context(), newLoaders(store))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}), nil
+}
@@ -0,0 +1,122 @@
+package gql
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	mytesting "avito-trainee-assignment/internal/testing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func bootstrapHandler(t *testing.T) (http.Handler, *storage.Store) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	store, err := storage.NewStore(context.Background(), logger.Sugar())
+	require.NoError(t, err)
+	h, err := NewHandler(logger.Sugar(), store)
+	require.NoError(t, err)
+
+	return h, store
+}
+
+func TestSchemaMatchesResolvers(t *testing.T) {
+	t.Parallel()
+
+	_, err := graphql.ParseSchema(schema, &rootResolver{})
+	require.NoError(t, err)
+}
+
+func TestNewHandlerNoStore(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	_, err = NewHandler(logger.Sugar(), nil)
+	require.Error(t, err)
+}
+
+func TestChatMembersAndMessages(t *testing.T) {
+	t.Parallel()
+
+	h, store := bootstrapHandler(t)
+
+	userOneID, err := store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	// number of messages
+	n := 3
+	messageIDs := make([]string, n)
+	for i := 0; i < n; i++ {
+		id, err := store.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+		require.NoError(t, err)
+		messageIDs[i] = strconv.FormatInt(id, 10)
+	}
+
+	query := `query($id: ID!) {
+		chat(id: $id) {
+			members { user { id } }
+			messages(limit: 2) { id author { id } }
+		}
+	}`
+
+	encodedPayload, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": map[string]interface{}{"id": strconv.FormatInt(chatID, 10)},
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "/graphql", bytes.NewBuffer(encodedPayload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Data struct {
+			Chat struct {
+				Members []struct {
+					User struct {
+						ID string `json:"id"`
+					} `json:"user"`
+				} `json:"members"`
+				Messages []struct {
+					ID     string `json:"id"`
+					Author struct {
+						ID string `json:"id"`
+					} `json:"author"`
+				} `json:"messages"`
+			} `json:"chat"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	require.Empty(t, response.Errors)
+
+	members := make([]string, 0, len(response.Data.Chat.Members))
+	for _, m := range response.Data.Chat.Members {
+		members = append(members, m.User.ID)
+	}
+	require.ElementsMatch(t, []string{strconv.FormatInt(userOneID, 10), strconv.FormatInt(userTwoID, 10)}, members)
+
+	// only two latest messages are expected
+	actual := make([]string, 0, len(response.Data.Chat.Messages))
+	for _, m := range response.Data.Chat.Messages {
+		actual = append(actual, m.ID)
+		require.Equal(t, strconv.FormatInt(userOneID, 10), m.Author.ID)
+	}
+	require.Equal(t, messageIDs[1:], actual)
+}
@@ -0,0 +1,208 @@
+package gql
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/graph-gophers/dataloader"
+	"strconv"
+	"strings"
+)
+
+type key string
+
+var loadersKey key
+
+var errNotFound = errors.New("not found")
+
+// loaders holds per-request dataloaders batching store lookups made by nested resolvers
+type loaders struct {
+	users     *dataloader.Loader
+	chats     *dataloader.Loader
+	members   *dataloader.Loader
+	userChats *dataloader.Loader
+	messages  *dataloader.Loader
+}
+
+func newLoaders(store *storage.Store) *loaders {
+	return &loaders{
+		users:     dataloader.NewBatchedLoader(usersBatch(store)),
+		chats:     dataloader.NewBatchedLoader(chatsBatch(store)),
+		members:   dataloader.NewBatchedLoader(idsBatch(store.MemberIDsByChatIDs)),
+		userChats: dataloader.NewBatchedLoader(idsBatch(store.ChatIDsByUserIDs)),
+		messages:  dataloader.NewBatchedLoader(messagesBatch(store)),
+	}
+}
+
+func newContextWithLoaders(ctx context.Context, l *loaders) context.Context {
+	return context.WithValue(ctx, loadersKey, l)
+}
+
+func loadersFromContext(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey).(*loaders)
+}
+
+func idKey(id int64) dataloader.Key {
+	return dataloader.StringKey(strconv.FormatInt(id, 10))
+}
+
+func messagesKey(chat int64, limit int32) dataloader.Key {
+	return dataloader.StringKey(strconv.FormatInt(chat, 10) + ":" + strconv.FormatInt(int64(limit), 10))
+}
+
+// parseIDKeys converts dataloader keys created with idKey back to int64 values
+func parseIDKeys(keys dataloader.Keys) ([]int64, error) {
+	ids := make([]int64, len(keys))
+	for i, k := range keys {
+		id, err := strconv.ParseInt(k.String(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+// failed returns a batch result with the same error for each key
+func failed(keys dataloader.Keys, err error) []*dataloader.Result {
+	results := make([]*dataloader.Result, len(keys))
+	for i := range results {
+		results[i] = &dataloader.Result{Error: err}
+	}
+
+	return results
+}
+
+func usersBatch(store *storage.Store) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		ids, err := parseIDKeys(keys)
+		if err != nil {
+			return failed(keys, err)
+		}
+
+		users, err := store.UsersByIDs(ctx, ids)
+		if err != nil {
+			return failed(keys, err)
+		}
+
+		byID := make(map[int64]storage.User, len(users))
+		for _, u := range users {
+			byID[u.ID] = u
+		}
+
+		results := make([]*dataloader.Result, len(ids))
+		for i, id := range ids {
+			u, ok := byID[id]
+			if !ok {
+				results[i] = &dataloader.Result{Error: fmt.Errorf("user %d: %w", id, errNotFound)}
+				continue
+			}
+			results[i] = &dataloader.Result{Data: u}
+		}
+
+		return results
+	}
+}
+
+func chatsBatch(store *storage.Store) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		ids, err := parseIDKeys(keys)
+		if err != nil {
+			return failed(keys, err)
+		}
+
+		chats, err := store.ChatsByIDs(ctx, ids)
+		if err != nil {
+			return failed(keys, err)
+		}
+
+		byID := make(map[int64]storage.Chat, len(chats))
+		for _, c := range chats {
+			byID[c.ID] = c
+		}
+
+		results := make([]*dataloader.Result, len(ids))
+		for i, id := range ids {
+			c, ok := byID[id]
+			if !ok {
+				results[i] = &dataloader.Result{Error: fmt.Errorf("chat %d: %w", id, errNotFound)}
+				continue
+			}
+			results[i] = &dataloader.Result{Data: c}
+		}
+
+		return results
+	}
+}
+
+// idsBatch adapts store methods returning grouped ids to dataloader.BatchFunc
+func idsBatch(fetch func(context.Context, []int64) (map[int64][]int64, error)) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		ids, err := parseIDKeys(keys)
+		if err != nil {
+			return failed(keys, err)
+		}
+
+		grouped, err := fetch(ctx, ids)
+		if err != nil {
+			return failed(keys, err)
+		}
+
+		results := make([]*dataloader.Result, len(ids))
+		for i, id := range ids {
+			results[i] = &dataloader.Result{Data: grouped[id]}
+		}
+
+		return results
+	}
+}
+
+// messagesBatch groups requested chats by limit and issues one store call per distinct limit
+func messagesBatch(store *storage.Store) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		type request struct {
+			chat  int64
+			limit int
+		}
+
+		requests := make([]request, len(keys))
+		chatsByLimit := make(map[int][]int64)
+		for i, k := range keys {
+			parts := strings.SplitN(k.String(), ":", 2)
+			if len(parts) != 2 {
+				return failed(keys, fmt.Errorf("malformed messages key %q", k.String()))
+			}
+
+			chat, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				return failed(keys, err)
+			}
+
+			limit, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return failed(keys, err)
+			}
+
+			requests[i] = request{chat: chat, limit: limit}
+			chatsByLimit[limit] = append(chatsByLimit[limit], chat)
+		}
+
+		messagesByLimit := make(map[int]map[int64][]storage.Message, len(chatsByLimit))
+		for limit, chats := range chatsByLimit {
+			messages, err := store.LatestMessagesByChatIDs(ctx, chats, limit)
+			if err != nil {
+				return failed(keys, err)
+			}
+			messagesByLimit[limit] = messages
+		}
+
+		results := make([]*dataloader.Result, len(requests))
+		for i, r := range requests {
+			results[i] = &dataloader.Result{Data: messagesByLimit[r.limit][r.chat]}
+		}
+
+		return results
+	}
+}
@@ -0,0 +1,225 @@
+package gql
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"github.com/graph-gophers/dataloader"
+	"github.com/graph-gophers/graphql-go"
+	"strconv"
+)
+
+// maxMessagesLimit caps "limit" argument of Chat.messages field
+const maxMessagesLimit = 100
+
+var errBadLimit = errors.New("limit must be in range [1, " + strconv.Itoa(maxMessagesLimit) + "]")
+
+func parseID(id graphql.ID) (int64, error) {
+	return strconv.ParseInt(string(id), 10, 64)
+}
+
+func formatID(id int64) graphql.ID {
+	return graphql.ID(strconv.FormatInt(id, 10))
+}
+
+type rootResolver struct{}
+
+func (r *rootResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadUser(ctx, id)
+}
+
+func (r *rootResolver) Chat(ctx context.Context, args struct{ ID graphql.ID }) (*chatResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadChat(ctx, id)
+}
+
+func loadUser(ctx context.Context, id int64) (*userResolver, error) {
+	data, err := loadersFromContext(ctx).users.Load(ctx, idKey(id))()
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &userResolver{user: data.(storage.User)}, nil
+}
+
+func loadChat(ctx context.Context, id int64) (*chatResolver, error) {
+	data, err := loadersFromContext(ctx).chats.Load(ctx, idKey(id))()
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &chatResolver{chat: data.(storage.Chat)}, nil
+}
+
+type userResolver struct {
+	user storage.User
+}
+
+func (r *userResolver) ID() graphql.ID {
+	return formatID(r.user.ID)
+}
+
+func (r *userResolver) Username() string {
+	return r.user.Username
+}
+
+func (r *userResolver) Type() string {
+	return r.user.Type
+}
+
+func (r *userResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.user.CreatedAt}
+}
+
+func (r *userResolver) Chats(ctx context.Context) ([]*chatResolver, error) {
+	data, err := loadersFromContext(ctx).userChats.Load(ctx, idKey(r.user.ID))()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, _ := data.([]int64)
+	keys := make(dataloader.Keys, len(ids))
+	for i, id := range ids {
+		keys[i] = idKey(id)
+	}
+
+	// LoadMany puts all keys into the same batch instead of waiting for each chat one by one
+	retrieved, errs := loadersFromContext(ctx).chats.LoadMany(ctx, keys)()
+	chats := make([]*chatResolver, 0, len(retrieved))
+	for i, data := range retrieved {
+		if len(errs) > i && errs[i] != nil {
+			if errors.Is(errs[i], errNotFound) {
+				continue
+			}
+			return nil, errs[i]
+		}
+		chats = append(chats, &chatResolver{chat: data.(storage.Chat)})
+	}
+
+	return chats, nil
+}
+
+type chatResolver struct {
+	chat storage.Chat
+}
+
+func (r *chatResolver) ID() graphql.ID {
+	return formatID(r.chat.ID)
+}
+
+func (r *chatResolver) Name() string {
+	return r.chat.Name
+}
+
+func (r *chatResolver) Type() string {
+	return r.chat.Type
+}
+
+func (r *chatResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.chat.CreatedAt}
+}
+
+func (r *chatResolver) Members(ctx context.Context) ([]*memberResolver, error) {
+	data, err := loadersFromContext(ctx).members.Load(ctx, idKey(r.chat.ID))()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, _ := data.([]int64)
+	members := make([]*memberResolver, len(ids))
+	for i, id := range ids {
+		members[i] = &memberResolver{userID: id}
+	}
+
+	return members, nil
+}
+
+func (r *chatResolver) Messages(ctx context.Context, args struct{ Limit int32 }) ([]*messageResolver, error) {
+	if args.Limit < 1 || args.Limit > maxMessagesLimit {
+		return nil, errBadLimit
+	}
+
+	data, err := loadersFromContext(ctx).messages.Load(ctx, messagesKey(r.chat.ID, args.Limit))()
+	if err != nil {
+		return nil, err
+	}
+
+	retrieved, _ := data.([]storage.Message)
+	messages := make([]*messageResolver, len(retrieved))
+	for i, m := range retrieved {
+		messages[i] = &messageResolver{message: m}
+	}
+
+	return messages, nil
+}
+
+type memberResolver struct {
+	userID int64
+}
+
+func (r *memberResolver) User(ctx context.Context) (*userResolver, error) {
+	u, err := loadUser(ctx, r.userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errNotFound
+	}
+
+	return u, nil
+}
+
+type messageResolver struct {
+	message storage.Message
+}
+
+func (r *messageResolver) ID() graphql.ID {
+	return formatID(r.message.ID)
+}
+
+func (r *messageResolver) Chat(ctx context.Context) (*chatResolver, error) {
+	c, err := loadChat(ctx, r.message.Chat)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errNotFound
+	}
+
+	return c, nil
+}
+
+func (r *messageResolver) Author(ctx context.Context) (*userResolver, error) {
+	u, err := loadUser(ctx, r.message.Author)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errNotFound
+	}
+
+	return u, nil
+}
+
+func (r *messageResolver) Text() string {
+	return r.message.Text
+}
+
+func (r *messageResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.message.CreatedAt}
+}
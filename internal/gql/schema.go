@@ -0,0 +1,44 @@
+package gql
+
+// schema describes types and queries served on "/graphql" endpoint
+const schema = `
+	schema {
+		query: Query
+	}
+
+	scalar Time
+
+	type Query {
+		user(id: ID!): User
+		chat(id: ID!): Chat
+	}
+
+	type User {
+		id: ID!
+		username: String!
+		type: String!
+		createdAt: Time!
+		chats: [Chat!]!
+	}
+
+	type Chat {
+		id: ID!
+		name: String!
+		type: String!
+		createdAt: Time!
+		members: [Member!]!
+		messages(limit: Int = 20): [Message!]!
+	}
+
+	type Member {
+		user: User!
+	}
+
+	type Message {
+		id: ID!
+		chat: Chat!
+		author: User!
+		text: String!
+		createdAt: Time!
+	}
+`
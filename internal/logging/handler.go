@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"encoding/json"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+)
+
+// levels is a body of LevelHandler responses
+type levels struct {
+	Level      zapcore.Level            `json:"level"`
+	Components map[string]zapcore.Level `json:"components"`
+}
+
+// levelsRequest is a body of LevelHandler PUT requests, nil level means that the default level is kept,
+// since zero zapcore.Level is info and would silently replace it
+type levelsRequest struct {
+	Level      *zapcore.Level           `json:"level"`
+	Components map[string]zapcore.Level `json:"components"`
+}
+
+// Levels returns the default level and levels of components overriding it
+func (l *Logger) Levels() (zapcore.Level, map[string]zapcore.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	components := make(map[string]zapcore.Level, len(l.overrides))
+	for name, cl := range l.overrides {
+		components[name] = cl
+	}
+
+	return l.level.Level(), components
+}
+
+// LevelHandler returns handler changing levels at runtime.
+// GET request returns current levels as JSON: {"level":"info","components":{"pgx":"warn"}}.
+// PUT request with the same body replaces them as SetLevels does, components missing in the body
+// follow the default level. Omitted "level" keeps the current default level.
+func (l *Logger) LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req levelsRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, "Malformed levels: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			level := l.level.Level()
+			if req.Level != nil {
+				level = *req.Level
+			}
+			l.SetLevels(level, req.Components)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		var resp levels
+		resp.Level, resp.Components = l.Levels()
+		payload, _ := json.Marshal(resp)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(payload)
+	})
+}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLevelHandler(t *testing.T) {
+	t.Parallel()
+
+	l, path := bootstrapLogger(t, Level(zapcore.InfoLevel), ComponentLevel(ComponentPgx, zapcore.WarnLevel))
+	handler := l.LevelHandler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/log/level", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"level":"info","components":{"pgx":"warn"}}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/log/level", strings.NewReader(`{"level":"error","components":{"server":"debug"}}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"level":"error","components":{"server":"debug"}}`, rr.Body.String())
+
+	// omitted level keeps the default one instead of resetting it to info
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/log/level", strings.NewReader(`{"components":{"server":"debug"}}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"level":"error","components":{"server":"debug"}}`, rr.Body.String())
+
+	l.Component(ComponentServer).Debug("server debug")
+	l.Component(ComponentPgx).Warn("pgx warn")
+
+	for _, body := range []string{`{"level":"verbose"}`, `levels`} {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/log/level", strings.NewReader(body)))
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/log/level", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	require.Equal(t, []entry{
+		{Level: "debug", Logger: ComponentServer, Msg: "server debug"},
+	}, readEntries(t, l, path))
+}
@@ -0,0 +1,275 @@
+// Package logging builds zap loggers of application components sharing a single output.
+// Every component logger has its own level which follows the default level unless it is set explicitly.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log formats accepted by Format option
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+// Special outputs accepted by Output option, any other value is a file path
+const (
+	OutputStderr = "stderr"
+	OutputStdout = "stdout"
+)
+
+// Component names used by the application
+const (
+	ComponentServer  = "server"
+	ComponentStorage = "storage"
+	ComponentPgx     = "pgx"
+)
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Logger instance
+type config struct {
+	format     string
+	level      zapcore.Level
+	components map[string]zapcore.Level
+
+	samplingInitial    int
+	samplingThereafter int
+
+	output     string
+	maxSize    int
+	maxBackups int
+	maxAge     int
+	compress   bool
+}
+
+// Format sets encoding of log entries, FormatConsole (default) or FormatJSON
+func Format(f string) Option {
+	return optionFunc(func(c *config) {
+		c.format = f
+	})
+}
+
+// Level sets the default level of all component loggers, DebugLevel is used by default
+func Level(l zapcore.Level) Option {
+	return optionFunc(func(c *config) {
+		c.level = l
+	})
+}
+
+// ComponentLevel sets level of the component logger overriding the default level
+func ComponentLevel(component string, l zapcore.Level) Option {
+	return optionFunc(func(c *config) {
+		c.components[component] = l
+	})
+}
+
+// Sampling limits logging of repeated entries: the first initial entries with the same level and message
+// are logged every second, after that only every thereafter-th one is logged. Sampling is disabled by default.
+func Sampling(initial, thereafter int) Option {
+	return optionFunc(func(c *config) {
+		c.samplingInitial = initial
+		c.samplingThereafter = thereafter
+	})
+}
+
+// Output sets where log entries are written: OutputStderr (default), OutputStdout or a file path
+func Output(output string) Option {
+	return optionFunc(func(c *config) {
+		c.output = output
+	})
+}
+
+// Rotation sets rotation of the output file: the file is rotated when it grows over maxSize megabytes,
+// at most maxBackups rotated files not older than maxAge (rounded down to days) are kept,
+// zero values keep all rotated files.
+// It has no effect unless Output is a file.
+func Rotation(maxSize, maxBackups int, maxAge time.Duration, compress bool) Option {
+	return optionFunc(func(c *config) {
+		c.maxSize = maxSize
+		c.maxBackups = maxBackups
+		c.maxAge = int(maxAge / (24 * time.Hour))
+		c.compress = compress
+	})
+}
+
+// Logger builds component loggers and changes their levels at runtime
+type Logger struct {
+	core   zapcore.Core
+	opts   []zap.Option
+	closer io.Closer
+
+	mu         sync.Mutex
+	level      zap.AtomicLevel
+	overrides  map[string]zapcore.Level
+	components map[string]zap.AtomicLevel
+}
+
+// New constructs a Logger. See the various Options for available customizations.
+func New(opts ...Option) (*Logger, error) {
+	cfg := &config{
+		format:     FormatConsole,
+		level:      zapcore.DebugLevel,
+		components: make(map[string]zapcore.Level),
+		output:     OutputStderr,
+	}
+
+	for _, o := range opts {
+		o.apply(cfg)
+	}
+
+	var encoder zapcore.Encoder
+	zapOpts := []zap.Option{zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)}
+	switch cfg.format {
+	case FormatConsole:
+		encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+		zapOpts = append(zapOpts, zap.Development())
+	case FormatJSON:
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.format)
+	}
+
+	if cfg.samplingInitial < 0 || cfg.samplingThereafter < 0 {
+		return nil, errors.New("sampling parameters must not be negative")
+	}
+
+	if cfg.samplingInitial > 0 && cfg.samplingThereafter < 1 {
+		return nil, errors.New("sampling thereafter must be positive when sampling is enabled")
+	}
+
+	var sink zapcore.WriteSyncer
+	var closer io.Closer
+	switch cfg.output {
+	case "":
+		return nil, errors.New("no output provided")
+	case OutputStderr:
+		sink = zapcore.Lock(os.Stderr)
+	case OutputStdout:
+		sink = zapcore.Lock(os.Stdout)
+	default:
+		if cfg.maxSize < 0 || cfg.maxBackups < 0 || cfg.maxAge < 0 {
+			return nil, errors.New("rotation parameters must not be negative")
+		}
+
+		rotation := &lumberjack.Logger{
+			Filename:   cfg.output,
+			MaxSize:    cfg.maxSize,
+			MaxBackups: cfg.maxBackups,
+			MaxAge:     cfg.maxAge,
+			Compress:   cfg.compress,
+		}
+		// lumberjack opens the file lazily, so an unwritable path is detected here rather than on the first entry
+		_, err := rotation.Write(nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open log file: %w", err)
+		}
+		sink = zapcore.AddSync(rotation)
+		closer = rotation
+	}
+
+	// the shared core accepts every level, levels are checked by component cores
+	core := zapcore.NewCore(encoder, sink, zapcore.DebugLevel)
+	if cfg.samplingInitial > 0 {
+		core = zapcore.NewSampler(core, time.Second, cfg.samplingInitial, cfg.samplingThereafter)
+	}
+
+	return &Logger{
+		core:       core,
+		opts:       zapOpts,
+		closer:     closer,
+		level:      zap.NewAtomicLevelAt(cfg.level),
+		overrides:  cfg.components,
+		components: make(map[string]zap.AtomicLevel),
+	}, nil
+}
+
+// Root returns logger of the application itself following the default level
+func (l *Logger) Root() *zap.Logger {
+	return zap.New(&levelCore{Core: l.core, level: l.level}, l.opts...)
+}
+
+// Component returns named logger with its own level. Loggers of the same component share the level.
+func (l *Logger) Component(name string) *zap.Logger {
+	l.mu.Lock()
+	level, ok := l.components[name]
+	if !ok {
+		level = zap.NewAtomicLevelAt(l.levelOf(name))
+		l.components[name] = level
+	}
+	l.mu.Unlock()
+
+	return zap.New(&levelCore{Core: l.core, level: level}, l.opts...).Named(name)
+}
+
+// SetLevels changes the default level and replaces all component levels.
+// Components missing in provided map follow the default level.
+func (l *Logger) SetLevels(level zapcore.Level, components map[string]zapcore.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.level.SetLevel(level)
+	l.overrides = make(map[string]zapcore.Level, len(components))
+	for name, cl := range components {
+		l.overrides[name] = cl
+	}
+
+	for name, al := range l.components {
+		al.SetLevel(l.levelOf(name))
+	}
+}
+
+// levelOf returns the current level of the component, l.mu must be held
+func (l *Logger) levelOf(component string) zapcore.Level {
+	if cl, ok := l.overrides[component]; ok {
+		return cl
+	}
+	return l.level.Level()
+}
+
+// Close flushes buffered entries and closes the output file if there is one
+func (l *Logger) Close() error {
+	// syncing standard streams fails on some platforms, e.g. when they are terminals, so the error is ignored
+	_ = l.core.Sync()
+
+	if l.closer != nil {
+		return l.closer.Close()
+	}
+
+	return nil
+}
+
+// levelCore filters entries of the shared core by its own level
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(e.Level) {
+		return ce
+	}
+	return c.Core.Check(e, ce)
+}
@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// entry is a subset of JSON log entry fields
+type entry struct {
+	Level  string `json:"level"`
+	Logger string `json:"logger"`
+	Msg    string `json:"msg"`
+}
+
+func bootstrapLogger(t *testing.T, opts ...Option) (*Logger, string) {
+	dir, err := ioutil.TempDir("", "logging")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "app.log")
+	l, err := New(append([]Option{Format(FormatJSON), Output(path)}, opts...)...)
+	require.NoError(t, err)
+
+	return l, path
+}
+
+// readEntries closes the logger and returns entries written to the file
+func readEntries(t *testing.T, l *Logger, path string) []entry {
+	require.NoError(t, l.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, scanner.Err())
+
+	return entries
+}
+
+func TestComponentLevels(t *testing.T) {
+	t.Parallel()
+
+	l, path := bootstrapLogger(t, Level(zapcore.InfoLevel), ComponentLevel(ComponentPgx, zapcore.WarnLevel))
+
+	root := l.Root()
+	server := l.Component(ComponentServer)
+	pgx := l.Component(ComponentPgx)
+
+	root.Debug("root debug")
+	root.Info("root info")
+	server.Debug("server debug")
+	server.Info("server info")
+	pgx.Info("pgx info")
+	pgx.Warn("pgx warn")
+
+	require.Equal(t, []entry{
+		{Level: "info", Msg: "root info"},
+		{Level: "info", Logger: ComponentServer, Msg: "server info"},
+		{Level: "warn", Logger: ComponentPgx, Msg: "pgx warn"},
+	}, readEntries(t, l, path))
+}
+
+func TestSetLevels(t *testing.T) {
+	t.Parallel()
+
+	l, path := bootstrapLogger(t, Level(zapcore.InfoLevel), ComponentLevel(ComponentPgx, zapcore.WarnLevel))
+
+	server := l.Component(ComponentServer)
+	pgx := l.Component(ComponentPgx)
+
+	// pgx follows the default level again since it is missing in the new overrides
+	l.SetLevels(zapcore.ErrorLevel, map[string]zapcore.Level{ComponentServer: zapcore.DebugLevel})
+
+	server.Debug("server debug")
+	pgx.Warn("pgx warn")
+	pgx.Error("pgx error")
+	// loggers created after the change get the current level
+	l.Component(ComponentStorage).Warn("storage warn")
+
+	require.Equal(t, []entry{
+		{Level: "debug", Logger: ComponentServer, Msg: "server debug"},
+		{Level: "error", Logger: ComponentPgx, Msg: "pgx error"},
+	}, readEntries(t, l, path))
+}
+
+func TestSampling(t *testing.T) {
+	t.Parallel()
+
+	l, path := bootstrapLogger(t, Sampling(2, 3))
+
+	logger := l.Root()
+	for i := 0; i < 8; i++ {
+		logger.Info("repeated")
+	}
+
+	// the first 2 entries and then every 3rd one: 2, 5 and 8 (1-based)
+	require.Len(t, readEntries(t, l, path), 4)
+}
+
+func TestNewBadOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, opts := range [][]Option{
+		{Format("xml")},
+		{Output("")},
+		{Sampling(-1, 0)},
+		{Sampling(10, 0)},
+		{Output(filepath.Join(os.DevNull, "app.log"))},
+		{Output("app.log"), Rotation(-1, 0, 0, false)},
+	} {
+		_, err := New(opts...)
+		require.Error(t, err)
+	}
+}
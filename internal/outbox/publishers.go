@@ -0,0 +1,91 @@
+package outbox
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Memory implements Publisher keeping published events in memory, it is mostly useful in tests
+type Memory struct {
+	mu     sync.Mutex
+	events []storage.OutboxEvent
+}
+
+// NewMemory constructs empty Memory publisher
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Publish implements Publisher interface
+func (m *Memory) Publish(_ context.Context, e storage.OutboxEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, e)
+
+	return nil
+}
+
+// Events returns copy of all published events in order of publishing
+func (m *Memory) Events() []storage.OutboxEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := make([]storage.OutboxEvent, len(m.events))
+	copy(events, m.events)
+
+	return events
+}
+
+// NDJSONFile implements Publisher appending each event as a JSON line to a file.
+// Every line is synced to disk before Publish returns, so dispatched events survive crashes.
+type NDJSONFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewNDJSONFile opens or creates file at provided path for appending
+func NewNDJSONFile(path string) (*NDJSONFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NDJSONFile{file: f}, nil
+}
+
+// Publish implements Publisher interface
+func (n *NDJSONFile) Publish(_ context.Context, e storage.OutboxEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, err = n.file.Write(line)
+	if err != nil {
+		return err
+	}
+
+	return n.file.Sync()
+}
+
+// Close closes underlying file
+func (n *NDJSONFile) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.file.Close()
+}
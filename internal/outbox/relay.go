@@ -0,0 +1,251 @@
+// Package outbox relays domain events stored in the transactional outbox to a Publisher.
+// Events are marked as dispatched only after successful publishing, so each event is published at least once.
+package outbox
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultBatchSize    = 100
+	// retryDelay is a pause after failed dispatching or listening
+	retryDelay = time.Second
+)
+
+// Publisher delivers events to their consumers. Publish may be called more than once for the same event.
+type Publisher interface {
+	Publish(ctx context.Context, e storage.OutboxEvent) error
+}
+
+// Source provides outbox events, it is implemented by storage.Store
+type Source interface {
+	DispatchOutbox(ctx context.Context, limit int, publish func(storage.OutboxEvent) error) (int, error)
+}
+
+// Waiter blocks until new events may be available
+type Waiter interface {
+	Wait(ctx context.Context) error
+	Close()
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Relay instance
+type config struct {
+	pollInterval time.Duration
+	batchSize    int
+	listen       func(ctx context.Context) (Waiter, error)
+}
+
+// EnvConfig defines fields used for parsing from environment variables
+type EnvConfig struct {
+	File         string        `env:"OUTBOX_FILE" envDefault:"data/outbox.ndjson"`
+	PollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" envDefault:"5s"`
+	BatchSize    int           `env:"OUTBOX_BATCH_SIZE" envDefault:"100"`
+}
+
+// WithEnvConfig enables processing exported EnvConfig struct to acts as a source of config parameters for Relay
+func WithEnvConfig(cfg EnvConfig) Option {
+	return optionFunc(func(c *config) {
+		c.pollInterval = cfg.PollInterval
+		c.batchSize = cfg.BatchSize
+	})
+}
+
+// PollInterval sets how often outbox is checked for new events.
+// With Listen option it bounds the delay of events whose notifications were missed.
+func PollInterval(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.pollInterval = d
+	})
+}
+
+// BatchSize sets the maximum number of events dispatched in one transaction
+func BatchSize(n int) Option {
+	return optionFunc(func(c *config) {
+		c.batchSize = n
+	})
+}
+
+// Listen enables waking up on notifications about new events instead of waiting for the next poll
+func Listen(listen func(ctx context.Context) (Waiter, error)) Option {
+	return optionFunc(func(c *config) {
+		c.listen = listen
+	})
+}
+
+// Relay moves events from Source to Publisher in a background goroutine
+type Relay struct {
+	logger    *zap.SugaredLogger
+	source    Source
+	publisher Publisher
+	cfg       config
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewRelay constructs a Relay. See the various Options for available customizations.
+// Events are not relayed until Start is called.
+func NewRelay(logger *zap.SugaredLogger, source Source, publisher Publisher, opts ...Option) (*Relay, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+
+	if source == nil {
+		return nil, errors.New("no source provided")
+	}
+
+	if publisher == nil {
+		return nil, errors.New("no publisher provided")
+	}
+
+	cfg := config{
+		pollInterval: defaultPollInterval,
+		batchSize:    defaultBatchSize,
+	}
+
+	for _, o := range opts {
+		o.apply(&cfg)
+	}
+
+	if cfg.pollInterval <= 0 {
+		return nil, fmt.Errorf("poll interval must be positive, got %v", cfg.pollInterval)
+	}
+
+	if cfg.batchSize < 1 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", cfg.batchSize)
+	}
+
+	return &Relay{
+		logger:    logger,
+		source:    source,
+		publisher: publisher,
+		cfg:       cfg,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Start runs relaying loop in a separate goroutine until Close is called
+func (r *Relay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	go func() {
+		defer close(r.done)
+		r.run(ctx)
+	}()
+}
+
+// Close stops relaying loop and waits for the current batch to finish
+func (r *Relay) Close() {
+	r.once.Do(func() {
+		if r.cancel == nil {
+			return
+		}
+		r.cancel()
+		<-r.done
+	})
+}
+
+func (r *Relay) run(ctx context.Context) {
+	var waiter Waiter
+	defer func() {
+		if waiter != nil {
+			waiter.Close()
+		}
+	}()
+
+	for {
+		// subscribing before dispatching, so events committed during dispatching wake up the next wait
+		if r.cfg.listen != nil && waiter == nil {
+			var err error
+			waiter, err = r.cfg.listen(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				r.logger.Errorf("Cannot listen for outbox events: %v", err)
+				waiter = nil
+			}
+		}
+
+		err := r.dispatchAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.logger.Errorf("Cannot relay outbox events: %v", err)
+			if !sleep(ctx, retryDelay) {
+				return
+			}
+			continue
+		}
+
+		if waiter == nil {
+			if !sleep(ctx, r.cfg.pollInterval) {
+				return
+			}
+			continue
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, r.cfg.pollInterval)
+		err = waiter.Wait(waitCtx)
+		// waiters may report the end of poll interval as a network timeout rather than ctx error
+		expired := waitCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !expired {
+			r.logger.Errorf("Cannot wait for outbox events: %v", err)
+			waiter.Close()
+			waiter = nil
+		}
+	}
+}
+
+// dispatchAll publishes batches of events until outbox has no more of them
+func (r *Relay) dispatchAll(ctx context.Context) error {
+	for ctx.Err() == nil {
+		n, err := r.source.DispatchOutbox(ctx, r.cfg.batchSize, func(e storage.OutboxEvent) error {
+			return r.publisher.Publish(ctx, e)
+		})
+		if n > 0 {
+			r.logger.Debugf("Relayed %d outbox events", n)
+		}
+		if err != nil {
+			return err
+		}
+
+		if n < r.cfg.batchSize {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// sleep waits for d and reports whether ctx is still alive
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
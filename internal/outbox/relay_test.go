@@ -0,0 +1,247 @@
+package outbox
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memorySource implements Source keeping events in memory
+type memorySource struct {
+	mu         sync.Mutex
+	events     []storage.OutboxEvent
+	dispatched map[int64]bool
+	notify     chan struct{}
+}
+
+func newMemorySource() *memorySource {
+	return &memorySource{dispatched: make(map[int64]bool), notify: make(chan struct{}, 1)}
+}
+
+func (s *memorySource) add(e storage.OutboxEvent) {
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memorySource) DispatchOutbox(_ context.Context, limit int, publish func(storage.OutboxEvent) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, e := range s.events {
+		if n == limit {
+			break
+		}
+		if s.dispatched[e.ID] {
+			continue
+		}
+		if err := publish(e); err != nil {
+			return n, err
+		}
+		s.dispatched[e.ID] = true
+		n++
+	}
+
+	return n, nil
+}
+
+// channelWaiter implements Waiter on top of memorySource notifications
+type channelWaiter struct {
+	notify chan struct{}
+}
+
+func (w channelWaiter) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.notify:
+		return nil
+	}
+}
+
+func (w channelWaiter) Close() {}
+
+// timeoutError mimics the error of pgconn reading interrupted by ctx deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "read tcp 127.0.0.1:5432: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+// timeoutWaiter reports expired ctx as network timeout like storage.OutboxListener connection does
+type timeoutWaiter struct {
+	channelWaiter
+}
+
+func (w timeoutWaiter) Wait(ctx context.Context) error {
+	err := w.channelWaiter.Wait(ctx)
+	if err != nil {
+		return timeoutError{}
+	}
+
+	return nil
+}
+
+// flakyPublisher fails the first publishing of every event
+type flakyPublisher struct {
+	Memory
+	failed map[int64]bool
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, e storage.OutboxEvent) error {
+	p.mu.Lock()
+	if !p.failed[e.ID] {
+		p.failed[e.ID] = true
+		p.mu.Unlock()
+		return errors.New("broker is unavailable")
+	}
+	p.mu.Unlock()
+
+	return p.Memory.Publish(ctx, e)
+}
+
+func bootstrapRelay(t *testing.T, source Source, publisher Publisher, opts ...Option) *Relay {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	r, err := NewRelay(logger.Sugar(), source, publisher, opts...)
+	require.NoError(t, err)
+
+	r.Start()
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func TestRelayListen(t *testing.T) {
+	t.Parallel()
+
+	source := newMemorySource()
+	publisher := NewMemory()
+	// long poll interval ensures events are relayed because of notifications
+	bootstrapRelay(t, source, publisher, PollInterval(time.Hour), BatchSize(2),
+		Listen(func(ctx context.Context) (Waiter, error) {
+			return channelWaiter{notify: source.notify}, nil
+		}),
+	)
+
+	for i := int64(1); i <= 5; i++ {
+		source.add(storage.OutboxEvent{ID: i, Type: storage.EventMessageCreated})
+	}
+
+	require.Eventually(t, func() bool {
+		return len(publisher.Events()) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i, e := range publisher.Events() {
+		require.Equal(t, int64(i+1), e.ID)
+	}
+}
+
+func TestRelayListenTimeout(t *testing.T) {
+	t.Parallel()
+
+	source := newMemorySource()
+	publisher := NewMemory()
+	var listens int32
+	bootstrapRelay(t, source, publisher, PollInterval(10*time.Millisecond),
+		Listen(func(ctx context.Context) (Waiter, error) {
+			atomic.AddInt32(&listens, 1)
+			return timeoutWaiter{channelWaiter{notify: source.notify}}, nil
+		}),
+	)
+
+	// idle poll intervals ending with network timeouts must not tear down the subscription
+	time.Sleep(100 * time.Millisecond)
+	source.add(storage.OutboxEvent{ID: 1, Type: storage.EventMessageCreated})
+
+	require.Eventually(t, func() bool {
+		return len(publisher.Events()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&listens))
+}
+
+func TestRelayRetriesFailedPublishing(t *testing.T) {
+	t.Parallel()
+
+	source := newMemorySource()
+	source.add(storage.OutboxEvent{ID: 1, Type: storage.EventChatCreated})
+	publisher := &flakyPublisher{failed: make(map[int64]bool)}
+	bootstrapRelay(t, source, publisher, PollInterval(10*time.Millisecond))
+
+	require.Eventually(t, func() bool {
+		return len(publisher.Events()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNDJSONFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "outbox")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nested", "events.ndjson")
+	publisher, err := NewNDJSONFile(path)
+	require.NoError(t, err)
+
+	payload := json.RawMessage(`{"id":1}`)
+	require.NoError(t, publisher.Publish(context.Background(), storage.OutboxEvent{ID: 1, Payload: payload}))
+	require.NoError(t, publisher.Publish(context.Background(), storage.OutboxEvent{ID: 2, Payload: payload}))
+	require.NoError(t, publisher.Close())
+
+	// reopening appends instead of truncating
+	publisher, err = NewNDJSONFile(path)
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish(context.Background(), storage.OutboxEvent{ID: 3, Payload: payload}))
+	require.NoError(t, publisher.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var ids []int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e storage.OutboxEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		require.JSONEq(t, `{"id":1}`, string(e.Payload))
+		ids = append(ids, e.ID)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, []int64{1, 2, 3}, ids)
+}
+
+func TestNewRelayBadOptions(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	_, err = NewRelay(logger.Sugar(), newMemorySource(), nil)
+	require.Error(t, err)
+	_, err = NewRelay(logger.Sugar(), newMemorySource(), NewMemory(), BatchSize(0))
+	require.Error(t, err)
+	_, err = NewRelay(logger.Sugar(), newMemorySource(), NewMemory(), PollInterval(0))
+	require.Error(t, err)
+}
@@ -0,0 +1,317 @@
+// Package retention purges messages violating global and per-chat retention policies in a background goroutine.
+package retention
+
+import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval  = 10 * time.Minute
+	defaultBatchSize = 500
+)
+
+// Store provides expired messages, it is implemented by storage.Store
+type Store interface {
+	RetentionTargets(ctx context.Context, global storage.RetentionPolicy) ([]storage.RetentionTarget, error)
+	PurgeMessages(ctx context.Context, chat int64, p storage.RetentionPolicy, limit int) (storage.Purge, error)
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Janitor instance
+type config struct {
+	interval  time.Duration
+	batchSize int
+	global    storage.RetentionPolicy
+	blobs     blob.BlobStore
+}
+
+// EnvConfig defines fields used for parsing from environment variables
+type EnvConfig struct {
+	Interval  time.Duration `env:"RETENTION_INTERVAL" envDefault:"10m"`
+	BatchSize int           `env:"RETENTION_BATCH_SIZE" envDefault:"500"`
+	MaxAge    time.Duration `env:"RETENTION_MAX_AGE" envDefault:"0s"`
+	MaxCount  int           `env:"RETENTION_MAX_COUNT" envDefault:"0"`
+}
+
+// WithEnvConfig enables processing exported EnvConfig struct to acts as a source of config parameters for Janitor
+func WithEnvConfig(cfg EnvConfig) Option {
+	return optionFunc(func(c *config) {
+		c.interval = cfg.Interval
+		c.batchSize = cfg.BatchSize
+		c.global = storage.RetentionPolicy{MaxAge: cfg.MaxAge, MaxCount: cfg.MaxCount}
+	})
+}
+
+// Interval sets how often expired messages are purged
+func Interval(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.interval = d
+	})
+}
+
+// BatchSize sets the maximum number of messages deleted in one transaction.
+// Smaller batches hold row locks for a shorter time at the cost of more round trips.
+func BatchSize(n int) Option {
+	return optionFunc(func(c *config) {
+		c.batchSize = n
+	})
+}
+
+// Global sets retention policy applied to chats without their own settings. By default messages are kept forever.
+func Global(p storage.RetentionPolicy) Option {
+	return optionFunc(func(c *config) {
+		c.global = p
+	})
+}
+
+// Blobs enables deleting blobs of purged attachments from provided store
+func Blobs(blobs blob.BlobStore) Option {
+	return optionFunc(func(c *config) {
+		c.blobs = blobs
+	})
+}
+
+// Janitor periodically purges expired messages in a background goroutine
+type Janitor struct {
+	logger *zap.SugaredLogger
+	store  Store
+
+	mu  sync.Mutex
+	cfg config
+	// reconfigured notifies purging loop about changed interval
+	reconfigured chan struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewJanitor constructs a Janitor. See the various Options for available customizations.
+// Messages are not purged until Start is called.
+func NewJanitor(logger *zap.SugaredLogger, store Store, opts ...Option) (*Janitor, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+
+	if store == nil {
+		return nil, errors.New("no store provided")
+	}
+
+	cfg := config{
+		interval:  defaultInterval,
+		batchSize: defaultBatchSize,
+	}
+
+	for _, o := range opts {
+		o.apply(&cfg)
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Janitor{
+		logger:       logger,
+		store:        store,
+		cfg:          cfg,
+		reconfigured: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+func (c config) validate() error {
+	if c.interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", c.interval)
+	}
+
+	if c.batchSize < 1 {
+		return fmt.Errorf("batch size must be positive, got %d", c.batchSize)
+	}
+
+	if c.global.MaxAge < 0 || c.global.MaxCount < 0 {
+		return fmt.Errorf("global retention limits must not be negative, got %+v", c.global)
+	}
+
+	return nil
+}
+
+// Reconfigure applies options on top of the current configuration of running Janitor.
+// Invalid configuration is rejected keeping the current one. The batch being purged is not affected,
+// new interval starts counting from the moment of reconfiguration.
+func (j *Janitor) Reconfigure(opts ...Option) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cfg := j.cfg
+	for _, o := range opts {
+		o.apply(&cfg)
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	if cfg.interval != j.cfg.interval {
+		select {
+		case j.reconfigured <- struct{}{}:
+		default:
+		}
+	}
+	j.cfg = cfg
+
+	return nil
+}
+
+// config returns a copy of the current configuration
+func (j *Janitor) config() config {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.cfg
+}
+
+// Start runs purging loop in a separate goroutine until Close is called.
+// The first purge starts immediately.
+func (j *Janitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	go func() {
+		defer close(j.done)
+		j.run(ctx)
+	}()
+}
+
+// Close stops purging loop and waits for the current batch to finish
+func (j *Janitor) Close() {
+	j.once.Do(func() {
+		if j.cancel == nil {
+			return
+		}
+		j.cancel()
+		<-j.done
+	})
+}
+
+func (j *Janitor) run(ctx context.Context) {
+	ticker := time.NewTicker(j.config().interval)
+	defer func() { ticker.Stop() }()
+
+	for {
+		err := j.PurgeAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			j.logger.Errorf("Cannot purge expired messages: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-j.reconfigured:
+			ticker.Stop()
+			ticker = time.NewTicker(j.config().interval)
+		}
+	}
+}
+
+// PurgeAll purges expired messages of all chats batch by batch.
+// A chat which can not be purged does not stop purging of the others, the returned error wraps the first failure.
+func (j *Janitor) PurgeAll(ctx context.Context) error {
+	cfg := j.config()
+
+	targets, err := j.store.RetentionTargets(ctx, cfg.global)
+	if err != nil {
+		return err
+	}
+
+	var first error
+	failed := 0
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = j.purgeChat(ctx, cfg, t)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			j.logger.Errorw("Cannot purge expired messages of chat", "chat", t.Chat, "error", err)
+			failed++
+			if first == nil {
+				first = fmt.Errorf("purging chat (id: %d): %w", t.Chat, err)
+			}
+		}
+	}
+
+	if first != nil {
+		return fmt.Errorf("%d of %d chats are not purged, the first failure: %w", failed, len(targets), first)
+	}
+
+	return nil
+}
+
+// purgeChat deletes batches of expired messages of the chat until there are none left
+func (j *Janitor) purgeChat(ctx context.Context, cfg config, t storage.RetentionTarget) error {
+	var messages, attachments int64
+	defer func() {
+		if messages > 0 {
+			j.logger.Infow("Purged expired messages",
+				"chat", t.Chat,
+				"messages", messages,
+				"attachments", attachments,
+				"max_age", t.Policy.MaxAge,
+				"max_count", t.Policy.MaxCount,
+			)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		purge, err := j.store.PurgeMessages(ctx, t.Chat, t.Policy, cfg.batchSize)
+		if err != nil {
+			return err
+		}
+
+		messages += purge.Messages
+		attachments += purge.Attachments
+		j.deleteBlobs(cfg.blobs, purge.BlobKeys)
+
+		if purge.Messages < int64(cfg.batchSize) {
+			return nil
+		}
+	}
+
+	return ctx.Err()
+}
+
+// deleteBlobs removes blobs of purged attachments, failures leave orphaned blobs and are only logged
+func (j *Janitor) deleteBlobs(blobs blob.BlobStore, keys []string) {
+	if blobs == nil {
+		return
+	}
+
+	for _, key := range keys {
+		// purged rows are already committed, so blobs are deleted even if the janitor is closing
+		err := blobs.Delete(context.Background(), key)
+		if err != nil {
+			j.logger.Errorf("Cannot delete blob %q of purged attachment: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package retention
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore implements Store keeping messages of each chat in memory in order of creation
+type memoryStore struct {
+	mu        sync.Mutex
+	chats     map[int64][]time.Time
+	overrides map[int64]storage.RetentionPolicy
+	batches   []int64
+}
+
+func (s *memoryStore) RetentionTargets(_ context.Context, global storage.RetentionPolicy) ([]storage.RetentionTarget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var targets []storage.RetentionTarget
+	for chat := range s.chats {
+		p, ok := s.overrides[chat]
+		if !ok {
+			p = global
+		}
+		if p.MaxAge > 0 || p.MaxCount > 0 {
+			targets = append(targets, storage.RetentionTarget{Chat: chat, Policy: p})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Chat < targets[j].Chat })
+
+	return targets, nil
+}
+
+func (s *memoryStore) PurgeMessages(_ context.Context, chat int64, p storage.RetentionPolicy, limit int) (storage.Purge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := s.chats[chat]
+	var n int
+	for n < len(messages) && n < limit {
+		expired := p.MaxAge > 0 && time.Since(messages[n]) > p.MaxAge
+		excess := p.MaxCount > 0 && len(messages)-n > p.MaxCount
+		if !expired && !excess {
+			break
+		}
+		n++
+	}
+	s.chats[chat] = messages[n:]
+	s.batches = append(s.batches, int64(n))
+
+	return storage.Purge{Messages: int64(n)}, nil
+}
+
+func (s *memoryStore) left(chat int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.chats[chat])
+}
+
+// messagesAged returns creation times of n messages, the first old messages are older than age
+func messagesAged(n, old int, age time.Duration) []time.Time {
+	times := make([]time.Time, n)
+	for i := range times {
+		times[i] = time.Now()
+		if i < old {
+			times[i] = times[i].Add(-2 * age)
+		}
+	}
+
+	return times
+}
+
+func bootstrapJanitor(t *testing.T, store Store, opts ...Option) *Janitor {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	j, err := NewJanitor(logger.Sugar(), store, opts...)
+	require.NoError(t, err)
+
+	return j
+}
+
+func TestPurgeAll(t *testing.T) {
+	t.Parallel()
+
+	store := &memoryStore{
+		chats: map[int64][]time.Time{
+			1: messagesAged(10, 7, time.Hour),
+			2: messagesAged(10, 0, time.Hour),
+			3: messagesAged(10, 10, time.Hour),
+		},
+		overrides: map[int64]storage.RetentionPolicy{
+			// chat 2 keeps only the latest 4 messages
+			2: {MaxCount: 4},
+			// chat 3 keeps messages forever
+			3: {},
+		},
+	}
+
+	j := bootstrapJanitor(t, store, Global(storage.RetentionPolicy{MaxAge: time.Hour}), BatchSize(2))
+	require.NoError(t, j.PurgeAll(context.Background()))
+
+	require.Equal(t, 3, store.left(1))
+	require.Equal(t, 4, store.left(2))
+	require.Equal(t, 10, store.left(3))
+
+	for _, n := range store.batches {
+		require.LessOrEqual(t, n, int64(2))
+	}
+}
+
+func TestJanitorStartClose(t *testing.T) {
+	t.Parallel()
+
+	store := &memoryStore{chats: map[int64][]time.Time{1: messagesAged(5, 0, time.Hour)}}
+
+	j := bootstrapJanitor(t, store, Global(storage.RetentionPolicy{MaxCount: 1}), Interval(time.Hour))
+	j.Start()
+
+	require.Eventually(t, func() bool { return store.left(1) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	j.Close()
+	// closing twice is safe
+	j.Close()
+}
+
+// failingStore fails purging of a single chat
+type failingStore struct {
+	memoryStore
+	chat int64
+}
+
+func (s *failingStore) PurgeMessages(ctx context.Context, chat int64, p storage.RetentionPolicy, limit int) (storage.Purge, error) {
+	if chat == s.chat {
+		return storage.Purge{}, errors.New("connection refused")
+	}
+
+	return s.memoryStore.PurgeMessages(ctx, chat, p, limit)
+}
+
+func TestPurgeAllError(t *testing.T) {
+	t.Parallel()
+
+	store := &failingStore{
+		memoryStore: memoryStore{chats: map[int64][]time.Time{
+			1: messagesAged(1, 1, time.Hour),
+			2: messagesAged(1, 1, time.Hour),
+			3: messagesAged(1, 1, time.Hour),
+		}},
+		chat: 1,
+	}
+
+	j := bootstrapJanitor(t, store, Global(storage.RetentionPolicy{MaxAge: time.Hour}))
+	err := j.PurgeAll(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 of 3 chats")
+	require.Contains(t, err.Error(), "chat (id: 1)")
+
+	// chats after the failing one are still purged
+	require.Equal(t, 1, store.left(1))
+	require.Equal(t, 0, store.left(2))
+	require.Equal(t, 0, store.left(3))
+}
+
+func TestNewJanitorBadOptions(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	for _, opt := range []Option{Interval(0), BatchSize(0), Global(storage.RetentionPolicy{MaxCount: -1})} {
+		_, err := NewJanitor(logger.Sugar(), &memoryStore{}, opt)
+		require.Error(t, err)
+	}
+}
+
+func TestJanitorReconfigure(t *testing.T) {
+	t.Parallel()
+
+	store := &memoryStore{chats: map[int64][]time.Time{1: messagesAged(5, 0, time.Hour)}}
+
+	j := bootstrapJanitor(t, store, Interval(time.Hour))
+	j.Start()
+	defer j.Close()
+
+	// invalid configuration is rejected keeping the current one
+	require.Error(t, j.Reconfigure(Global(storage.RetentionPolicy{MaxCount: 2}), BatchSize(0)))
+	require.NoError(t, j.PurgeAll(context.Background()))
+	require.Equal(t, 5, store.left(1))
+
+	// new interval restarts the loop timer, so the new policy is applied without waiting for an hour
+	require.NoError(t, j.Reconfigure(Global(storage.RetentionPolicy{MaxCount: 2}), Interval(10*time.Millisecond)))
+	require.Eventually(t, func() bool { return store.left(1) == 2 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+)
+
+// poolStatsProvider is implemented by storage.Store
+type poolStatsProvider interface {
+	PoolStats() storage.PoolStats
+}
+
+// adminHandlers returns default handlers of admin listener: profiling, build info, connection pool stats
+// and the number of recovered panics
+func adminHandlers(store poolStatsProvider, panics *panicCounter) map[string]http.Handler {
+	return map[string]http.Handler{
+		"/debug/pprof/":        http.HandlerFunc(pprof.Index),
+		"/debug/pprof/cmdline": http.HandlerFunc(pprof.Cmdline),
+		"/debug/pprof/profile": http.HandlerFunc(pprof.Profile),
+		"/debug/pprof/symbol":  http.HandlerFunc(pprof.Symbol),
+		"/debug/pprof/trace":   http.HandlerFunc(pprof.Trace),
+		"/build":               http.HandlerFunc(buildInfo),
+		"/pool":                poolStats(store),
+		"/panics":              panicStats(panics),
+	}
+}
+
+// build is a body of "/build" admin endpoint response
+type build struct {
+	GoVersion    string            `json:"go_version"`
+	Path         string            `json:"path,omitempty"`
+	Version      string            `json:"version,omitempty"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+// buildInfo handles HTTP requests on "/build" admin endpoint describing the running binary
+func buildInfo(w http.ResponseWriter, _ *http.Request) {
+	resp := build{GoVersion: runtime.Version()}
+
+	// build info is missing in binaries built without module support
+	if info, ok := debug.ReadBuildInfo(); ok {
+		resp.Path = info.Path
+		resp.Version = info.Main.Version
+		resp.Dependencies = make(map[string]string, len(info.Deps))
+		for _, dep := range info.Deps {
+			resp.Dependencies[dep.Path] = dep.Version
+		}
+	}
+
+	payload, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(payload)
+}
+
+// poolStats returns handler of "/pool" admin endpoint reporting database connection pool statistics
+func poolStats(store poolStatsProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		payload, _ := json.Marshal(store.PoolStats())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(payload)
+	})
+}
+
+// panicStats returns handler of "/panics" admin endpoint reporting the number of handler panics recovered
+// since the start
+func panicStats(panics *panicCounter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		payload, _ := json.Marshal(struct {
+			Panics uint64 `json:"panics"`
+		}{panics.load()})
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(payload)
+	})
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type fakePool struct {
+	stats storage.PoolStats
+}
+
+func (p fakePool) PoolStats() storage.PoolStats {
+	return p.stats
+}
+
+func TestAdminHandlers(t *testing.T) {
+	t.Parallel()
+
+	panics := &panicCounter{}
+	panics.inc()
+	handlers := adminHandlers(fakePool{stats: storage.PoolStats{AcquireCount: 3, TotalConns: 2, MaxConns: 4}}, panics)
+
+	get := func(pattern string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handlers[pattern].ServeHTTP(rr, httptest.NewRequest("GET", pattern, nil))
+		return rr
+	}
+
+	rr := get("/pool")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var stats storage.PoolStats
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	require.Equal(t, int64(3), stats.AcquireCount)
+	require.Equal(t, int32(2), stats.TotalConns)
+	require.Equal(t, int32(4), stats.MaxConns)
+
+	rr = get("/build")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var info build
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	require.Equal(t, runtime.Version(), info.GoVersion)
+
+	rr = get("/panics")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"panics":1}`, rr.Body.String())
+
+	rr = get("/debug/pprof/")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "goroutine")
+}
+
+// bootstrapAdminServer returns handlers of public and admin listeners of a server constructed with default options
+func bootstrapAdminServer(t *testing.T) (public, admin http.Handler) {
+	h := bootstrapHandler(t)
+
+	srv, err := NewServer(h.logger, h.store, Admin("127.0.0.1:0"))
+	require.NoError(t, err)
+
+	for _, aux := range srv.auxiliary {
+		if aux.name == "admin" {
+			admin = aux.Handler
+		}
+	}
+	require.NotNil(t, admin)
+
+	return srv.httpServer.Handler, admin
+}
+
+func TestAdminOnlyEndpoints(t *testing.T) {
+	t.Parallel()
+
+	public, admin := bootstrapAdminServer(t)
+
+	for _, pattern := range []string{
+		"/users/export",
+		"/users/delete",
+		"/chats/retention",
+		"/admin/webhooks/add",
+		"/admin/webhooks/failed",
+		"/admin/webhooks/replay",
+		"/admin/audit",
+		"/admin/audit/verify",
+	} {
+		post := func(h http.Handler) int {
+			req := httptest.NewRequest("POST", pattern, bytes.NewBufferString(`{}`))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		require.Equal(t, http.StatusNotFound, post(public), pattern)
+		require.NotEqual(t, http.StatusNotFound, post(admin), pattern)
+	}
+}
+
+func TestStartAddressInUse(t *testing.T) {
+	t.Parallel()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	adminAddr := free.Addr().String()
+	require.NoError(t, free.Close())
+
+	s := &Server{
+		logger:     zap.NewNop().Sugar(),
+		httpServer: &http.Server{Addr: busy.Addr().String()},
+		auxiliary:  []auxServer{{name: "admin", Server: &http.Server{Addr: adminAddr, Handler: http.NotFoundHandler()}}},
+	}
+	require.Error(t, s.Start())
+
+	// the admin listener must not be left serving when the main address can not be bound
+	time.Sleep(50 * time.Millisecond)
+	_, err = net.Dial("tcp", adminAddr)
+	require.Error(t, err)
+}
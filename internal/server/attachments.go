@@ -0,0 +1,261 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/thumbnail"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// maxUploadMemory is the maximum number of bytes of multipart form kept in memory, the rest is stored on disk
+	maxUploadMemory = 8 << 20
+	// multipartOverhead is added to the maximum upload size to leave room for form fields and part headers
+	multipartOverhead = 64 << 10
+	// maxFilenameLength matches length of "filename" column
+	maxFilenameLength = 255
+)
+
+type attachmentHandler struct {
+	logger  *zap.SugaredLogger
+	store   *storage.Store
+	blobs   blob.BlobStore
+	maxSize int64
+	// thumbnails is nil when thumbnail generation is disabled
+	thumbnails *thumbnail.Pool
+}
+
+// upload handles multipart HTTP requests on "/attachments/upload" endpoint.
+// Expected form fields are "chat", "uploader" and "file".
+func (h *attachmentHandler) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" {
+		http.Error(w, "Content-Type header must be multipart/form-data", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxSize+multipartOverhead)
+	err = r.ParseMultipartForm(maxUploadMemory)
+	if err != nil {
+		http.Error(w, "Malformed multipart form or file is too large", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// retrieving chat id
+	chatID, err := strconv.ParseInt(r.FormValue("chat"), 10, 64)
+	if err != nil || chatID < 1 {
+		http.Error(w, "Field \"chat\" must be a valid chat id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving uploader id
+	uploaderID, err := strconv.ParseInt(r.FormValue("uploader"), 10, 64)
+	if err != nil || uploaderID < 1 {
+		http.Error(w, "Field \"uploader\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving file
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing Field \"file\"", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > h.maxSize {
+		http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(header.Filename) == 0 || len(header.Filename) > maxFilenameLength {
+		http.Error(w, "File name must have length in range [1, "+strconv.Itoa(maxFilenameLength)+"]", http.StatusBadRequest)
+		return
+	}
+
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// checking membership before storing the blob to avoid orphaned objects
+	err = h.store.CheckChatMember(r.Context(), chatID, uploaderID)
+	if err != nil {
+		switch err {
+		case storage.ErrChatNotExist:
+			http.Error(w, "Chat with provided id does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrUserNotExist:
+			http.Error(w, "Uploader with provided id does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrUserNotChatMember:
+			http.Error(w, "Uploader is not chat member", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	key := "chats/" + strconv.FormatInt(chatID, 10) + "/" + xid.New().String()
+	hash := sha256.New()
+	err = h.blobs.Put(r.Context(), key, io.TeeReader(file, hash), header.Size, contentType)
+	if err != nil {
+		h.logger.Errorf("storing blob %q: %v", key, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := h.store.CreateAttachment(r.Context(), storage.Attachment{
+		Chat:        chatID,
+		Uploader:    uploaderID,
+		Filename:    header.Filename,
+		ContentType: contentType,
+		Size:        header.Size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		BlobKey:     key,
+	})
+	if err != nil {
+		if deleteErr := h.blobs.Delete(r.Context(), key); deleteErr != nil {
+			h.logger.Errorf("deleting orphaned blob %q: %v", key, deleteErr)
+		}
+
+		if errors.Is(err, storage.ErrUserNotChatMember) {
+			http.Error(w, "Uploader is not chat member", http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if h.thumbnails != nil && thumbnail.Supported(contentType) {
+		err = h.thumbnails.Enqueue(thumbnail.Job{Attachment: id, BlobKey: key})
+		if err != nil {
+			h.logger.Warnf("Cannot enqueue thumbnail generation for attachment (id: %d): %v", id, err)
+			if recordErr := h.store.SetThumbnailError(r.Context(), id, err.Error()); recordErr != nil {
+				h.logger.Error(recordErr)
+			}
+		}
+	}
+
+	// returning id
+	payload := []byte(`{"id":` + strconv.FormatInt(id, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
+
+// download handles HTTP requests on "/attachments/get" endpoint.
+// Attachment and requesting user are passed as "id" and "user" query parameters,
+// optional "thumbnail" parameter selects a thumbnail by its size.
+func (h *attachmentHandler) download(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// retrieving attachment id
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "Parameter \"id\" must be a valid attachment id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving user id
+	userID, err := strconv.ParseInt(query.Get("user"), 10, 64)
+	if err != nil || userID < 1 {
+		http.Error(w, "Parameter \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	a, err := h.store.AttachmentByID(r.Context(), id, userID)
+	if err != nil {
+		switch err {
+		case storage.ErrAttachmentNotExist:
+			http.Error(w, "Attachment with provided id does not exist", http.StatusNotFound)
+			return
+		case storage.ErrUserNotChatMember:
+			http.Error(w, "User is not chat member", http.StatusForbidden)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// serving thumbnail of requested size instead of the original
+	key, contentType, size := a.BlobKey, a.ContentType, a.Size
+	if query.Get("thumbnail") != "" {
+		thumbnailSize, err := strconv.Atoi(query.Get("thumbnail"))
+		if err != nil || thumbnailSize < 1 {
+			http.Error(w, "Parameter \"thumbnail\" must be a thumbnail size grater than zero", http.StatusBadRequest)
+			return
+		}
+
+		found := false
+		for _, t := range a.Thumbnails {
+			if t.Size == thumbnailSize {
+				key, contentType, size, found = t.BlobKey, t.ContentType, -1, true
+				break
+			}
+		}
+
+		if !found {
+			http.Error(w, "Thumbnail of provided size does not exist", http.StatusNotFound)
+			return
+		}
+	}
+
+	rc, err := h.blobs.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotExist) {
+			h.logger.Errorf("blob %q of attachment (id: %d) is missing", key, a.ID)
+			http.Error(w, "Attachment content is missing", http.StatusNotFound)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	// size and checksum are known only for originals
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("ETag", `"`+a.Checksum+`"`)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		h.logger.Errorf("streaming attachment (id: %d): %v", a.ID, err)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/blob"
+	mytesting "avito-trainee-assignment/internal/testing"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func bootstrapAttachmentHandler(t *testing.T, maxSize int64) *attachmentHandler {
+	h := bootstrapHandler(t)
+
+	root, err := ioutil.TempDir("", "blobs")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+
+	blobs, err := blob.NewFilesystem(root)
+	require.NoError(t, err)
+
+	return &attachmentHandler{
+		logger:  h.logger,
+		store:   h.store,
+		blobs:   blobs,
+		maxSize: maxSize,
+	}
+}
+
+func newUploadRequest(t *testing.T, chat, uploader int64, filename string, content []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("chat", strconv.FormatInt(chat, 10)))
+	require.NoError(t, mw.WriteField("uploader", strconv.FormatInt(uploader, 10)))
+	fw, err := mw.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = fw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req, err := http.NewRequest("POST", "/attachments/upload", &body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return req
+}
+
+func TestUploadDownloadAttachment(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapAttachmentHandler(t, 1<<20)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	content := []byte("attachment content")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.upload).ServeHTTP(rr, newUploadRequest(t, chatID, userOneID, "notes.txt", content))
+
+	require.Equal(t, http.StatusCreated, rr.Code)
+	v, err := fastjson.ParseBytes(rr.Body.Bytes())
+	require.NoError(t, err)
+	attachmentID, err := v.Get("id").Int64()
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "/attachments/get?id="+strconv.FormatInt(attachmentID, 10)+
+		"&user="+strconv.FormatInt(userTwoID, 10), nil)
+	require.NoError(t, err)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(h.download).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, content, rr.Body.Bytes())
+	require.Equal(t, `attachment; filename=notes.txt`, rr.Header().Get("Content-Disposition"))
+	require.Equal(t, strconv.Itoa(len(content)), rr.Header().Get("Content-Length"))
+}
+
+func TestUploadAttachment_TooLarge(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapAttachmentHandler(t, 8)
+
+	userID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.upload).ServeHTTP(rr, newUploadRequest(t, chatID, userID, "big.bin", make([]byte, 9)))
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestUploadAttachment_NotMultipart(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapAttachmentHandler(t, 1<<20)
+
+	req, err := http.NewRequest("POST", "/attachments/upload", bytes.NewBufferString(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.upload).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+func TestDownloadAttachment_NotChatMember(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapAttachmentHandler(t, 1<<20)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	outsiderID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.upload).ServeHTTP(rr, newUploadRequest(t, chatID, userOneID, "notes.txt", []byte("secret")))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	v, err := fastjson.ParseBytes(rr.Body.Bytes())
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "/attachments/get?id="+strconv.FormatInt(v.GetInt64("id"), 10)+
+		"&user="+strconv.FormatInt(outsiderID, 10), nil)
+	require.NoError(t, err)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(h.download).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/storage/zapadapter"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// actorHeader carries id of the user performing the request. The service does not authenticate users,
+	// so the id is recorded as an unverified claim, it is trustworthy only behind an authenticating proxy.
+	actorHeader = "X-Actor-ID"
+	// maxAuditResponseHead is the number of response body bytes kept to find out the id of a created entity
+	maxAuditResponseHead = 64
+	// defaultAuditLimit is used when "limit" field is omitted in "/admin/audit" request
+	defaultAuditLimit = 100
+	// maxAuditLimit is the maximum allowed "limit" field value in "/admin/audit" request
+	maxAuditLimit = 1000
+)
+
+// auditSpec describes how requests to an endpoint are recorded in the audit log
+type auditSpec struct {
+	action string
+	// kind is the kind of the target entity, e.g. "chat"
+	kind string
+	// field is the request body field holding target id. Blank field means that the target is created
+	// by the request and its id is taken from "id" field of the response.
+	field string
+	// recordedByStore means that successful requests are recorded by the store in the same transaction
+	// as the change itself, so only rejected and failed ones are recorded by the middleware
+	recordedByStore bool
+}
+
+// auditedEndpoints lists administrative and security relevant endpoints
+var auditedEndpoints = map[string]auditSpec{
+	"/users/add":             {action: "user.created", kind: "user"},
+	"/users/delete":          {action: storage.AuditUserDeleted, kind: "user", field: "user", recordedByStore: true},
+	"/users/export":          {action: storage.AuditUserExported, kind: "user", field: "user", recordedByStore: true},
+	"/chats/add":             {action: "chat.created", kind: "chat"},
+	"/chats/direct":          {action: "chat.direct_opened", kind: "chat"},
+	"/chats/retention":       {action: "chat.retention_changed", kind: "chat", field: "chat"},
+	"/webhooks/add":          {action: "webhook.created", kind: "webhook"},
+	"/admin/webhooks/add":    {action: "webhook.created", kind: "webhook"},
+	"/admin/webhooks/replay": {action: "webhook.delivery_replayed", kind: "delivery", field: "id"},
+	"/bots/add":              {action: "bot.created", kind: "user"},
+	"/attachments/upload":    {action: "attachment.uploaded", kind: "attachment"},
+}
+
+// unauditedEndpoints lists endpoints changing data which are deliberately not audited along with the reason.
+// Every audit event is appended to a single hash chain under a lock, so auditing them would serialize
+// the busiest writes of the service.
+var unauditedEndpoints = map[string]string{
+	"/messages/add":     "messages are the record themselves, they keep author and creation time",
+	"/messages/react":   "reactions are high-volume content of messages and keep their authors",
+	"/messages/unreact": "reactions are high-volume content of messages and keep their authors",
+	"/chats/read":       "read receipts are high-volume personal state of the reader",
+	"/mentions/read":    "read mentions are high-volume personal state of the reader",
+}
+
+// auditStore records audit events, it is implemented by storage.Store
+type auditStore interface {
+	RecordAuditEvent(ctx context.Context, e storage.AuditEvent) (int64, error)
+}
+
+// auditResponseWriter captures response status and the beginning of response body
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	head   []byte
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if room := maxAuditResponseHead - len(w.head); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		w.head = append(w.head, b[:room]...)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// audit is a middleware recording each request in the audit log after it is handled.
+// Actor and request id are recorded as claims of the client. Failures to record are logged and do not affect
+// the response which is already sent.
+func audit(next http.Handler, spec auditSpec, store auditStore, logger *zap.SugaredLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// request body is buffered only if it holds the target id
+		var body []byte
+		if spec.field != "" {
+			var err error
+			body, err = ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "Can not read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		var claimedActor *int64
+		actor, err := strconv.ParseInt(r.Header.Get(actorHeader), 10, 64)
+		if err == nil && actor > 0 {
+			claimedActor = &actor
+			// the store records the claim in events it appends itself
+			r = r.WithContext(storage.NewContextWithClaimedActor(r.Context(), actor))
+		}
+
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		e := storage.AuditEvent{
+			ClaimedActor: claimedActor,
+			Action:       spec.action,
+			Target:       spec.kind,
+			Outcome:      auditOutcome(aw.status),
+		}
+
+		if spec.recordedByStore && e.Outcome == storage.AuditOutcomeSuccess {
+			return
+		}
+
+		// the target id is unknown when the request is rejected before the target is created or validated
+		source := body
+		if spec.field == "" {
+			source = aw.head
+		}
+		if id, ok := auditTargetID(source, spec.field); ok {
+			e.Target += ":" + strconv.FormatInt(id, 10)
+		}
+
+		// the request context may be already cancelled, the event is recorded anyway
+		ctx := context.Background()
+		if id, ok := zapadapter.IDFromContext(r.Context()); ok {
+			e.ClaimedRequestID = &id
+			ctx = zapadapter.NewContextWithID(ctx, id)
+		}
+
+		_, err = store.RecordAuditEvent(ctx, e)
+		if err != nil {
+			logger.Errorf("Cannot record audit event %s on %s: %v", e.Action, e.Target, err)
+		}
+	})
+}
+
+// auditOutcome maps response status to audit event outcome
+func auditOutcome(status int) string {
+	switch {
+	case status >= 500:
+		return storage.AuditOutcomeError
+	case status >= 400:
+		return storage.AuditOutcomeRejected
+	default:
+		return storage.AuditOutcomeSuccess
+	}
+}
+
+// auditTargetID retrieves positive integer id from provided field of JSON object, blank field means "id"
+func auditTargetID(data []byte, field string) (int64, bool) {
+	if field == "" {
+		field = "id"
+	}
+
+	v, err := fastjson.ParseBytes(data)
+	if err != nil {
+		return 0, false
+	}
+
+	id, err := v.Get(field).Int64()
+	if err != nil || id < 1 {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// auditEvents handles HTTP requests on "/admin/audit" endpoint listing audit events.
+// Events are filtered by optional "claimed_actor", "target" and time range ("from" inclusive, "to" exclusive) fields,
+// pages are requested with "after" field set to the id of the last event from the previous page.
+func (h *handler) auditEvents(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.auditPool.Get()
+	defer h.parsers.auditPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	filter := storage.AuditFilter{Limit: defaultAuditLimit}
+
+	// retrieving optional claimed actor
+	if v.Exists("claimed_actor") {
+		actor, err := v.Get("claimed_actor").Int64()
+		if err != nil || actor < 1 {
+			http.Error(w, "Field \"claimed_actor\" must be a valid user id grater than zero", http.StatusBadRequest)
+			return
+		}
+		filter.ClaimedActor = &actor
+	}
+
+	// retrieving optional target
+	if v.Exists("target") {
+		targetValue := v.Get("target")
+		if targetValue.Type() != fastjson.TypeString {
+			http.Error(w, "Field \"target\" must be a string", http.StatusBadRequest)
+			return
+		}
+		filter.Target = string(targetValue.GetStringBytes())
+	}
+
+	// retrieving optional time range
+	for _, field := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if !v.Exists(field.name) {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, string(v.Get(field.name).GetStringBytes()))
+		if err != nil {
+			http.Error(w, "Field \""+field.name+"\" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		*field.dst = &t
+	}
+
+	// retrieving optional cursor
+	if v.Exists("after") {
+		var err error
+		filter.After, err = v.Get("after").Int64()
+		if err != nil || filter.After < 0 {
+			http.Error(w, "Field \"after\" must be a non-negative 64-bit integer value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// retrieving optional limit
+	if v.Exists("limit") {
+		var err error
+		filter.Limit, err = v.Get("limit").Int()
+		if err != nil {
+			http.Error(w, "Field \"limit\" must be an integer value", http.StatusBadRequest)
+			return
+		}
+
+		if filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			http.Error(w, "Field \"limit\" must be in range [1, "+strconv.Itoa(maxAuditLimit)+"]", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := h.store.AuditEvents(r.Context(), filter)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	payload, err := json.Marshal(events)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
+
+// verifyAuditChain handles HTTP requests on "/admin/audit/verify" endpoint checking the audit hash chain.
+// It responds with 409 status code describing the first broken event if the chain does not match.
+func (h *handler) verifyAuditChain(w http.ResponseWriter, r *http.Request) {
+	n, err := h.store.VerifyAuditChain(r.Context())
+	if err != nil {
+		if errors.Is(err, storage.ErrAuditChainBroken) {
+			h.logger.Warn(err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	payload := []byte(`{"verified":` + strconv.FormatInt(n, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
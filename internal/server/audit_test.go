@@ -0,0 +1,149 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/storage/zapadapter"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// memoryAuditStore implements auditStore keeping recorded events in memory
+type memoryAuditStore struct {
+	mu     sync.Mutex
+	events []storage.AuditEvent
+}
+
+func (s *memoryAuditStore) RecordAuditEvent(_ context.Context, e storage.AuditEvent) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, e)
+
+	return int64(len(s.events)), nil
+}
+
+// serveAuditedEvents passes request to audited handler and returns events recorded by the middleware
+func serveAuditedEvents(t *testing.T, spec auditSpec, next http.HandlerFunc, body string, actor string) []storage.AuditEvent {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	store := &memoryAuditStore{}
+	h := audit(next, spec, store, logger.Sugar())
+
+	req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set(actorHeader, actor)
+	req = req.WithContext(zapadapter.NewContextWithID(req.Context(), "request"))
+
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	return store.events
+}
+
+func serveAudited(t *testing.T, spec auditSpec, next http.HandlerFunc, body string, actor string) storage.AuditEvent {
+	events := serveAuditedEvents(t, spec, next, body, actor)
+	require.Len(t, events, 1)
+
+	return events[0]
+}
+
+func TestAuditCreatedTarget(t *testing.T) {
+	t.Parallel()
+
+	e := serveAudited(t, auditSpec{action: "chat.created", kind: "chat"}, func(w http.ResponseWriter, r *http.Request) {
+		// the body is still readable by the handler
+		body, _ := ioutil.ReadAll(r.Body)
+		require.Equal(t, `{"name":"chat"}`, string(body))
+
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":42}`))
+	}, `{"name":"chat"}`, "7")
+
+	require.Equal(t, "chat.created", e.Action)
+	require.Equal(t, "chat:42", e.Target)
+	require.Equal(t, storage.AuditOutcomeSuccess, e.Outcome)
+	require.Equal(t, int64(7), *e.ClaimedActor)
+	require.Equal(t, "request", *e.ClaimedRequestID)
+}
+
+func TestAuditRejected(t *testing.T) {
+	t.Parallel()
+
+	e := serveAudited(t, auditSpec{action: "user.deleted", kind: "user", field: "user"}, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "User does not exist", http.StatusBadRequest)
+	}, `{"user":5}`, "")
+
+	require.Equal(t, "user:5", e.Target)
+	require.Equal(t, storage.AuditOutcomeRejected, e.Outcome)
+	require.Nil(t, e.ClaimedActor)
+}
+
+func TestAuditError(t *testing.T) {
+	t.Parallel()
+
+	e := serveAudited(t, auditSpec{action: "webhook.created", kind: "webhook"}, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}, `{}`, "not a number")
+
+	require.Equal(t, "webhook", e.Target)
+	require.Equal(t, storage.AuditOutcomeError, e.Outcome)
+	require.Nil(t, e.ClaimedActor)
+}
+
+func TestAuditRecordedByStore(t *testing.T) {
+	t.Parallel()
+
+	spec := auditSpec{action: storage.AuditUserDeleted, kind: "user", field: "user", recordedByStore: true}
+
+	// successful requests are recorded by the store in the transaction of the change
+	events := serveAuditedEvents(t, spec, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, `{"user":5}`, "7")
+	require.Empty(t, events)
+
+	e := serveAudited(t, spec, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "User does not exist", http.StatusBadRequest)
+	}, `{"user":5}`, "7")
+	require.Equal(t, storage.AuditOutcomeRejected, e.Outcome)
+	require.Equal(t, int64(7), *e.ClaimedActor)
+}
+
+func TestAuditCoversMutatingEndpoints(t *testing.T) {
+	t.Parallel()
+
+	mutating := []string{
+		"/users/add", "/users/export", "/users/delete",
+		"/chats/add", "/chats/direct", "/chats/read", "/chats/retention",
+		"/messages/add", "/messages/react", "/messages/unreact", "/mentions/read",
+		"/webhooks/add", "/admin/webhooks/add", "/admin/webhooks/replay", "/bots/add", "/attachments/upload",
+	}
+
+	// every endpoint changing data is either audited or excluded with a reason
+	for _, pattern := range mutating {
+		_, audited := auditedEndpoints[pattern]
+		_, excluded := unauditedEndpoints[pattern]
+		require.True(t, audited != excluded, pattern)
+	}
+}
+
+func TestAuditEventsBadTimeRange(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	req, err := http.NewRequest("POST", "/admin/audit", bytes.NewBuffer([]byte(`{"from":"yesterday"}`)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.auditEvents).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/bot"
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/storage"
+	"errors"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultBotRateLimit is used when "rate_limit" field is omitted in "/bots/add" request
+	defaultBotRateLimit = 30
+	// defaultBotTimeout is used when "timeout_ms" field is omitted in "/bots/add" request
+	defaultBotTimeout = 5000
+	// maxBotTimeout is the maximum allowed "timeout_ms" field value in "/bots/add" request
+	maxBotTimeout = 60000
+)
+
+// createBot handles HTTP requests on "/bots/add" endpoint registering bot served by HTTP callback.
+// Taken usernames are rejected, so existing bots can not be taken over. The callback url must resolve
+// to public addresses only.
+func (h *handler) createBot(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.botPool.Get()
+	defer h.parsers.botPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving username
+	if !v.Exists("username") {
+		http.Error(w, "Missing Field \"username\"", http.StatusBadRequest)
+		return
+	}
+
+	usernameValue := v.Get("username")
+	if usernameValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"username\" must be a string", http.StatusBadRequest)
+		return
+	}
+
+	username := string(usernameValue.GetStringBytes())
+	if len(username) == 0 {
+		http.Error(w, "Field \"username\" must have non-zero length", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving callback url
+	if !v.Exists("callback_url") {
+		http.Error(w, "Missing Field \"callback_url\"", http.StatusBadRequest)
+		return
+	}
+
+	callbackValue := v.Get("callback_url")
+	if callbackValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"callback_url\" must be a string", http.StatusBadRequest)
+		return
+	}
+
+	callbackURL := string(callbackValue.GetStringBytes())
+	err := egress.CheckURL(r.Context(), callbackURL)
+	if err != nil {
+		if errors.Is(err, egress.ErrBadURL) {
+			http.Error(w, "Field \"callback_url\" must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+		// resolved addresses and resolver errors are logged only, so clients can not probe internal DNS
+		h.logger.Warnf("Rejecting bot callback url %q: %v", callbackURL, err)
+		http.Error(w, "Field \"callback_url\" must point to a public address", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving secret
+	if !v.Exists("secret") {
+		http.Error(w, "Missing Field \"secret\"", http.StatusBadRequest)
+		return
+	}
+
+	secretValue := v.Get("secret")
+	if secretValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"secret\" must be a string", http.StatusBadRequest)
+		return
+	}
+
+	secret := string(secretValue.GetStringBytes())
+	if len(secret) < minSecretLength {
+		http.Error(w, "Field \"secret\" must have length of at least "+strconv.Itoa(minSecretLength), http.StatusBadRequest)
+		return
+	}
+
+	// retrieving commands array
+	if !v.Exists("commands") {
+		http.Error(w, "Missing Field \"commands\"", http.StatusBadRequest)
+		return
+	}
+
+	commandValues, err := v.Get("commands").Array()
+	if err != nil || len(commandValues) == 0 {
+		http.Error(w, "Field \"commands\" must be a non-empty array", http.StatusBadRequest)
+		return
+	}
+
+	commands := make([]string, 0, len(commandValues))
+	for _, c := range commandValues {
+		if c.Type() != fastjson.TypeString {
+			http.Error(w, "Each item in \"commands\" array must be a string", http.StatusBadRequest)
+			return
+		}
+		commands = append(commands, strings.TrimPrefix(string(c.GetStringBytes()), "/"))
+	}
+
+	// retrieving optional rate limit
+	rateLimit := defaultBotRateLimit
+	if v.Exists("rate_limit") {
+		rateLimit, err = v.Get("rate_limit").Int()
+		if err != nil || rateLimit < 1 {
+			http.Error(w, "Field \"rate_limit\" must be a positive integer value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// retrieving optional timeout
+	timeout := defaultBotTimeout
+	if v.Exists("timeout_ms") {
+		timeout, err = v.Get("timeout_ms").Int()
+		if err != nil || timeout < 1 || timeout > maxBotTimeout {
+			http.Error(w, "Field \"timeout_ms\" must be in range [1, "+strconv.Itoa(maxBotTimeout)+"]", http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := h.bots.RegisterCallback(r.Context(), storage.Bot{
+		Username:    username,
+		CallbackURL: &callbackURL,
+		Secret:      secret,
+		Commands:    commands,
+		RateLimit:   rateLimit,
+		Timeout:     timeout,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrUserExists) {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, bot.ErrBadBot) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// returning id
+	payload := []byte(`{"id":` + strconv.FormatInt(id, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
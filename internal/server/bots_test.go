@@ -0,0 +1,100 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/bot"
+	"avito-trainee-assignment/internal/egress"
+	mytesting "avito-trainee-assignment/internal/testing"
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func bootstrapBotHandler(t *testing.T) *handler {
+	h := bootstrapHandler(t)
+
+	d, err := bot.NewDispatcher(h.logger, h.store)
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+	h.bots = d
+
+	return h
+}
+
+func TestCreateBot(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapBotHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"username":"` + mytesting.RandString() +
+		`","callback_url":"https://93.184.216.34/bot","secret":"0123456789abcdef","commands":["/deploy","oncall"]}`))
+	req, err := http.NewRequest("POST", "/bots/add", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.createBot).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusCreated, rr.Code)
+}
+
+func TestCreateBotBadCommands(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapBotHandler(t)
+
+	for _, commands := range []string{`[]`, `"deploy"`, `[1]`, `["bad command"]`} {
+		payload := bytes.NewBuffer([]byte(`{"username":"` + mytesting.RandString() +
+			`","callback_url":"https://93.184.216.34/bot","secret":"0123456789abcdef","commands":` + commands + `}`))
+		req, err := http.NewRequest("POST", "/bots/add", payload)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.createBot).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code, commands)
+	}
+}
+
+func TestCreateBotExistingUsername(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapBotHandler(t)
+
+	username := mytesting.RandString()
+	payload := []byte(`{"username":"` + username +
+		`","callback_url":"https://93.184.216.34/bot","secret":"0123456789abcdef","commands":["deploy"]}`)
+	for _, code := range []int{http.StatusCreated, http.StatusConflict} {
+		req, err := http.NewRequest("POST", "/bots/add", bytes.NewBuffer(payload))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.createBot).ServeHTTP(rr, req)
+
+		require.Equal(t, code, rr.Code)
+	}
+}
+
+func TestCreateBotNonPublicCallback(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapBotHandler(t)
+
+	for _, u := range []string{"http://127.0.0.1:8080/bot", "http://169.254.169.254/", "http://192.168.0.1/bot"} {
+		payload := bytes.NewBuffer([]byte(`{"username":"` + mytesting.RandString() +
+			`","callback_url":"` + u + `","secret":"0123456789abcdef","commands":["deploy"]}`))
+		req, err := http.NewRequest("POST", "/bots/add", payload)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.createBot).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code, u)
+		// resolved addresses are not disclosed to clients
+		require.NotContains(t, rr.Body.String(), egress.ErrNotPublic.Error(), u)
+	}
+}
@@ -0,0 +1,460 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultCompressMinSize is a response size in bytes from which responses are compressed
+	// unless CompressionMinSize option is provided
+	defaultCompressMinSize = 1024
+	// defaultMaxRequestSize is the maximum size in bytes of decompressed request bodies
+	// unless MaxRequestSize option is provided
+	defaultMaxRequestSize = 1 << 20
+	// brotliLevel trades compression ratio for speed as responses are compressed on the fly
+	brotliLevel = 5
+)
+
+// Content codings negotiated by compression middleware
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	brotliWriters = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}}
+	gzipReaders sync.Pool
+)
+
+// errRequestTooLarge is returned by reads of decompressed request bodies exceeding the maximum size
+var errRequestTooLarge = errors.New("request body is too large")
+
+// compressor is implemented by gzip.Writer and brotli.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// getCompressor takes a compressor of the encoding from its pool and directs it to w
+func getCompressor(encoding string, w io.Writer) compressor {
+	var c compressor
+	if encoding == encodingBrotli {
+		c = brotliWriters.Get().(*brotli.Writer)
+	} else {
+		c = gzipWriters.Get().(*gzip.Writer)
+	}
+	c.Reset(w)
+	return c
+}
+
+// putCompressor returns closed compressor to its pool
+func putCompressor(encoding string, c compressor) {
+	// dropping the reference to the response writer, so it can be collected
+	c.Reset(nil)
+	if encoding == encodingBrotli {
+		brotliWriters.Put(c)
+	} else {
+		gzipWriters.Put(c)
+	}
+}
+
+// negotiateEncoding returns a content coding acceptable according to Accept-Encoding header value
+// or a blank string if the response must not be compressed.
+// The coding with the highest quality wins, brotli is preferred when qualities are equal.
+func negotiateEncoding(header string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, q := parseCoding(part)
+		if coding == "x-gzip" {
+			coding = encodingGzip
+		}
+		qualities[coding] = q
+	}
+
+	// codings which are not listed explicitly get the quality of "*"
+	quality := func(coding string) float64 {
+		if q, ok := qualities[coding]; ok {
+			return q
+		}
+		return qualities["*"]
+	}
+
+	br, gz := quality(encodingBrotli), quality(encodingGzip)
+	switch {
+	case br > 0 && br >= gz:
+		return encodingBrotli
+	case gz > 0:
+		return encodingGzip
+	}
+
+	return ""
+}
+
+// parseCoding parses a single element of Accept-Encoding header, e.g. "gzip;q=0.8"
+func parseCoding(s string) (string, float64) {
+	params := strings.Split(s, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+
+	q := 1.0
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "q=") {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(p[2:], 64)
+		if err != nil {
+			return coding, 0
+		}
+		q = v
+	}
+
+	return coding, q
+}
+
+// compressible reports whether responses of the media type benefit from compression,
+// images and archives are already compressed
+func compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case mt == "application/json", mt == "application/problem+json", mt == "application/x-ndjson",
+		mt == "application/javascript", mt == "application/xml":
+		return true
+	}
+
+	return false
+}
+
+// compressWriter buffers the beginning of the response until minSize bytes are written
+// to decide whether it is worth compressing
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	// c is nil unless the response is compressed
+	c compressor
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+
+		return len(b), w.start()
+	}
+
+	if w.c != nil {
+		return w.c.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends buffered data to the client, so streamed responses are not delayed by compression
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if !w.started {
+		if err := w.start(); err != nil {
+			return
+		}
+	}
+
+	if w.c != nil {
+		if err := w.c.Flush(); err != nil {
+			return
+		}
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the underlying writer as long as nothing was written or buffered,
+// since the buffered response would be lost otherwise
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.started || w.status != 0 {
+		return nil, nil, errors.New("response is already started, connection can not be hijacked")
+	}
+
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		// further writes are passed to the underlying writer, which rejects them
+		w.started = true
+	}
+
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying writer, it is used by http.ResponseController
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// start decides whether the response is compressed, then writes the header and the buffered data
+func (w *compressWriter) start() error {
+	w.started = true
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if len(w.buf) >= w.minSize && w.status != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		w.c = getCompressor(w.encoding, w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if w.c != nil {
+		_, err = w.c.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+// close writes responses smaller than minSize uncompressed and finishes compressed ones
+func (w *compressWriter) close() error {
+	if !w.started {
+		// nothing was written, so http.Server sends 200 status itself
+		if w.status == 0 {
+			return nil
+		}
+
+		err := w.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.c == nil {
+		return nil
+	}
+
+	err := w.c.Close()
+	w.release()
+
+	return err
+}
+
+// release returns the compressor to its pool, it is called on panic as well when the response is left unfinished
+func (w *compressWriter) release() {
+	if w.c == nil {
+		return
+	}
+
+	putCompressor(w.encoding, w.c)
+	w.c = nil
+}
+
+// limitedBody reads a decompressed request body up to n bytes, further reads fail with errRequestTooLarge
+type limitedBody struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errRequestTooLarge
+	}
+
+	// reading one byte more than allowed tells bodies of exactly n bytes from larger ones
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+
+	n, err := b.r.Read(p)
+	if int64(n) <= b.n {
+		b.n -= int64(n)
+		return n, err
+	}
+
+	n = int(b.n)
+	b.n = 0
+	b.exceeded = true
+
+	return n, errRequestTooLarge
+}
+
+// Close does nothing, the original request body is closed by http.Server
+func (b *limitedBody) Close() error {
+	return nil
+}
+
+// limitedBodyWriter replaces the response with 413 status once the request body exceeded its limit,
+// so handlers reporting read errors with 400 status need not know about the limit
+type limitedBodyWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+
+	wroteHeader bool
+	// tooLarge is set when the response is replaced, the rest of the handler response is discarded
+	tooLarge bool
+}
+
+func (w *limitedBodyWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if w.body.exceeded {
+		w.tooLarge = true
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Encoding")
+		http.Error(w.ResponseWriter, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitedBodyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.tooLarge {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *limitedBodyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, it is used by http.ResponseController
+func (w *limitedBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compression is a middleware compressing responses with brotli or gzip according to Accept-Encoding header
+// and decompressing gzip request bodies. Responses smaller than minSize bytes, responses of already
+// compressed media types and responses with Content-Encoding set by the handler are sent as is.
+// Decompressed request bodies larger than maxBodySize bytes are rejected with 413 status,
+// request bodies with other content codings are rejected with 415 status.
+// It must be applied after applyEnforcePostJson, so decompressed bodies are validated.
+func compression(next http.Handler, minSize int, maxBodySize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body *limitedBody
+		switch coding := strings.ToLower(r.Header.Get("Content-Encoding")); coding {
+		case "", "identity":
+		case encodingGzip, "x-gzip":
+			var zr *gzip.Reader
+			var err error
+			if pooled, ok := gzipReaders.Get().(*gzip.Reader); ok {
+				zr = pooled
+				err = zr.Reset(r.Body)
+			} else {
+				zr, err = gzip.NewReader(r.Body)
+			}
+			if err != nil {
+				if zr != nil {
+					gzipReaders.Put(zr)
+				}
+				http.Error(w, "Malformed gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer func() {
+				_ = zr.Close()
+				gzipReaders.Put(zr)
+			}()
+
+			body = &limitedBody{r: zr, n: maxBodySize}
+			r.Body = body
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		default:
+			w.Header().Set("Accept-Encoding", encodingGzip)
+			http.Error(w, "Content-Encoding header must be gzip", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// serve passes the response writer to next handler, replacing responses to too large request bodies
+		serve := func(w http.ResponseWriter) {
+			if body != nil {
+				w = &limitedBodyWriter{ResponseWriter: w, body: body}
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			serve(w)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		// a panic leaves the buffered response unsent, so recovery middleware is able to replace it,
+		// the compressor is still returned to its pool
+		defer cw.release()
+		serve(cw)
+
+		_ = cw.close()
+	})
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"":                       "",
+		"identity":               "",
+		"gzip":                   encodingGzip,
+		"x-gzip":                 encodingGzip,
+		"gzip, deflate, br":      encodingBrotli,
+		"br;q=0.5, gzip":         encodingGzip,
+		"br;q=0, *":              encodingGzip,
+		"*":                      encodingBrotli,
+		"gzip;q=0, br;q=0":       "",
+		"gzip;q=bad, deflate":    "",
+		"GZIP ; q=0.8, br;q=0.7": encodingGzip,
+	}
+
+	for header, encoding := range tests {
+		require.Equal(t, encoding, negotiateEncoding(header), header)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	large := `[` + strings.Repeat(`{"id":1,"text":"hello"},`, 100) + `{"id":2}]`
+	handler := compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/small" {
+			_, _ = w.Write([]byte(`{"id":1}`))
+			return
+		}
+		// the response is written in parts smaller than the threshold
+		for i := 0; i < len(large); i += 100 {
+			end := i + 100
+			if end > len(large) {
+				end = len(large)
+			}
+			_, _ = w.Write([]byte(large[i:end]))
+		}
+	}), 1024, defaultMaxRequestSize)
+
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("/large", "gzip")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, encodingGzip, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	zr, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, large, string(body))
+
+	rr = serve("/large", "gzip, br")
+	require.Equal(t, encodingBrotli, rr.Header().Get("Content-Encoding"))
+	body, err = ioutil.ReadAll(brotli.NewReader(rr.Body))
+	require.NoError(t, err)
+	require.Equal(t, large, string(body))
+
+	// pooled compressors are reset between responses
+	rr = serve("/large", "br")
+	body, err = ioutil.ReadAll(brotli.NewReader(rr.Body))
+	require.NoError(t, err)
+	require.Equal(t, large, string(body))
+
+	rr = serve("/small", "gzip, br")
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, `{"id":1}`, rr.Body.String())
+
+	rr = serve("/large", "")
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, large, rr.Body.String())
+}
+
+func TestCompression_SkipsCompressedMedia(t *testing.T) {
+	t.Parallel()
+
+	image := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 1024)
+	handler := compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "4096")
+		_, _ = w.Write(image)
+	}), 0, defaultMaxRequestSize)
+
+	req := httptest.NewRequest("GET", "/attachments/get", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "4096", rr.Header().Get("Content-Length"))
+	require.Equal(t, image, rr.Body.Bytes())
+}
+
+func TestCompression_Hijack(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/started" {
+			_, _ = w.Write([]byte("buffered"))
+			_, _, err := w.(http.Hijacker).Hijack()
+			require.Error(t, err)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: close\r\n\r\n")
+		_ = rw.Flush()
+	}), 1024, defaultMaxRequestSize))
+	defer srv.Close()
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("/upgrade")
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// the buffered response is sent instead of losing it to a hijacked connection
+	resp = get("/started")
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "buffered", string(body))
+
+	// the underlying writer is reachable for http.ResponseController
+	cw := &compressWriter{ResponseWriter: httptest.NewRecorder(), encoding: encodingGzip}
+	require.IsType(t, &httptest.ResponseRecorder{}, cw.Unwrap())
+}
+
+func TestCompression_GzipRequestBody(t *testing.T) {
+	t.Parallel()
+
+	handler := compression(enforcePostJson(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})), 1024, defaultMaxRequestSize)
+
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+	_, err := zw.Write([]byte(`{"username":"kris"}`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	req := httptest.NewRequest("POST", "/users/add", &payload)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, `{"username":"kris"}`, rr.Body.String())
+
+	tests := []struct {
+		encoding string
+		body     string
+		code     int
+	}{
+		{encoding: "gzip", body: `{"username":"kris"}`, code: http.StatusBadRequest},
+		{encoding: "br", body: `{"username":"kris"}`, code: http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/users/add", strings.NewReader(test.body))
+		req.Header.Set("Content-Encoding", test.encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		require.Equal(t, test.code, rr.Code)
+	}
+}
+
+func TestCompression_GzipRequestBodyTooLarge(t *testing.T) {
+	t.Parallel()
+
+	handler := compression(enforcePostJson(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})), 1024, 1024)
+
+	// a few kilobytes of gzip expanding to 16 MiB of JSON string
+	var bomb bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&bomb, gzip.BestCompression)
+	require.NoError(t, err)
+	_, err = zw.Write([]byte(`{"text":"`))
+	require.NoError(t, err)
+	_, err = zw.Write(bytes.Repeat([]byte("a"), 16<<20))
+	require.NoError(t, err)
+	_, err = zw.Write([]byte(`"}`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.Less(t, bomb.Len(), 64<<10)
+
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		req := httptest.NewRequest("POST", "/messages/add", bytes.NewReader(bomb.Bytes()))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, acceptEncoding)
+		require.Contains(t, rr.Body.String(), "Request body is too large")
+	}
+
+	// a body of exactly the maximum size is accepted
+	exact := `{"text":"` + strings.Repeat("a", 1024-len(`{"text":""}`)) + `"}`
+	var payload bytes.Buffer
+	zw = gzip.NewWriter(&payload)
+	_, err = zw.Write([]byte(exact))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	req := httptest.NewRequest("POST", "/messages/add", &payload)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+}
@@ -1,12 +1,22 @@
 package server
 
 import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/bot"
+	"avito-trainee-assignment/internal/retention"
+	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/thumbnail"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+// instrumentationName identifies spans recorded by the package
+const instrumentationName = "avito-trainee-assignment/internal/server"
+
 type Option interface {
 	apply(*config)
 }
@@ -20,6 +30,26 @@ type config struct {
 	httpServer    *http.Server
 	handlers      map[string]http.Handler
 	afterShutdown []func()
+	blobs         blob.BlobStore
+	maxUploadSize int64
+	thumbnails    *thumbnail.Pool
+	bots          *bot.Dispatcher
+	janitor       *retention.Janitor
+	timeout       *requestTimeout
+	reload        func() error
+	slowRequest   time.Duration
+	tracer        trace.TracerProvider
+	panics        *panicCounter
+	repanic       bool
+	certFile      string
+	keyFile       string
+	tlsMinVersion uint16
+	clientCAFile  string
+	redirectAddr  string
+	adminAddr     string
+	adminHandlers map[string]http.Handler
+	compressMin   int
+	maxRequest    int64
 }
 
 // EnvConfig defines fields used for parsing from environment variables
@@ -42,6 +72,166 @@ func ReadTimeout(d time.Duration) Option {
 	})
 }
 
+// WriteTimeout sets write timeout for http.Server
+func WriteTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.httpServer.WriteTimeout = d
+	})
+}
+
+// IdleTimeout sets keep-alive idle timeout for http.Server
+func IdleTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.httpServer.IdleTimeout = d
+	})
+}
+
+// TLS makes http.Server serve HTTPS and HTTP/2 with certificate and key loaded from provided PEM files.
+// The files are reloaded when they change, so certificates can be renewed without a restart.
+func TLS(certFile, keyFile string) Option {
+	return optionFunc(func(c *config) {
+		c.certFile = certFile
+		c.keyFile = keyFile
+	})
+}
+
+// TLSMinVersion sets the minimum TLS version accepted by http.Server, e.g. tls.VersionTLS13.
+// TLS 1.2 is used by default. It has no effect without TLS option.
+func TLSMinVersion(v uint16) Option {
+	return optionFunc(func(c *config) {
+		c.tlsMinVersion = v
+	})
+}
+
+// ClientCA enables mutual TLS: clients must present certificates signed by one of CA certificates
+// from provided PEM file. It has no effect without TLS option.
+func ClientCA(path string) Option {
+	return optionFunc(func(c *config) {
+		c.clientCAFile = path
+	})
+}
+
+// RedirectHTTP starts plaintext listener on provided address redirecting all requests to HTTPS.
+// It has no effect without TLS option.
+func RedirectHTTP(addr string) Option {
+	return optionFunc(func(c *config) {
+		c.redirectAddr = addr
+	})
+}
+
+// Admin starts plaintext listener on provided address serving operational endpoints:
+// "/debug/pprof/" profiles, "/build" info of the binary, "/pool" database connection pool statistics,
+// "/panics" number of recovered handler panics, "/chats/retention" settings, "/admin/webhooks/*" dead-lettered
+// deliveries, "/admin/audit*" audit log and handlers registered with AdminHandler.
+// The address should not be exposed publicly, administrative endpoints are not served without it.
+func Admin(addr string) Option {
+	return optionFunc(func(c *config) {
+		c.adminAddr = addr
+	})
+}
+
+// AdminHandler registers a handler for the given pattern on admin listener, it has no effect without Admin option
+func AdminHandler(pattern string, h http.Handler) Option {
+	return optionFunc(func(c *config) {
+		c.adminHandlers[pattern] = h
+	})
+}
+
+// CompressionMinSize sets a response size in bytes from which responses are compressed, 1024 is used by default.
+// Smaller responses are sent as is since compression saves little on them.
+func CompressionMinSize(n int) Option {
+	return optionFunc(func(c *config) {
+		c.compressMin = n
+	})
+}
+
+// MaxRequestSize sets the maximum size in bytes of decompressed gzip request bodies, 1 MiB is used by default.
+// Larger bodies are rejected with 413 status, so small compressed payloads can not exhaust memory.
+// Attachment uploads are allowed to reach the size set by Attachments option.
+func MaxRequestSize(n int64) Option {
+	return optionFunc(func(c *config) {
+		c.maxRequest = n
+	})
+}
+
+// RequestTimeout sets the maximum duration of handling a request, zero disables the timeout.
+// Unlike TimeoutHandler it only cancels the request context, so responses are not buffered,
+// and it can be changed at runtime with Server.SetRequestTimeout.
+func RequestTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.timeout.store(d)
+	})
+}
+
+// SlowRequestThreshold sets duration of handling a request after which its access log entry has Warn level,
+// zero disables escalation
+func SlowRequestThreshold(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.slowRequest = d
+	})
+}
+
+// TracerProvider sets provider of the tracer recording server spans instead of the global one
+func TracerProvider(tp trace.TracerProvider) Option {
+	return optionFunc(func(c *config) {
+		c.tracer = tp
+	})
+}
+
+// Repanic makes the server propagate handler panics after logging them instead of responding with 500 status.
+// It is meant for tests, so bugs are not hidden behind error responses.
+func Repanic() Option {
+	return optionFunc(func(c *config) {
+		c.repanic = true
+	})
+}
+
+// OnReload registers a function called on SIGHUP to reload configuration.
+// Returned error is logged and means that the previous configuration is kept.
+// Without registered function SIGHUP is not handled by Server.
+func OnReload(f func() error) Option {
+	return optionFunc(func(c *config) {
+		c.reload = f
+	})
+}
+
+// Attachments enables "/attachments/upload" and "/attachments/get" endpoints storing files in provided blob store.
+// Uploads larger than maxSize bytes are rejected.
+func Attachments(blobs blob.BlobStore, maxSize int64) Option {
+	return optionFunc(func(c *config) {
+		c.blobs = blobs
+		c.maxUploadSize = maxSize
+	})
+}
+
+// Thumbnails enables background thumbnail generation for uploaded images with provided pool.
+// The pool is closed after http.Server shutdown, so already accepted images are still processed.
+func Thumbnails(p *thumbnail.Pool) Option {
+	return optionFunc(func(c *config) {
+		c.thumbnails = p
+		c.afterShutdown = append(c.afterShutdown, p.Close)
+	})
+}
+
+// Bots enables routing of slash commands from new messages to bots registered in provided dispatcher
+// along with "/bots/add" endpoint registering callback bots.
+// The dispatcher is closed after http.Server shutdown, so already accepted commands are still handled.
+func Bots(d *bot.Dispatcher) Option {
+	return optionFunc(func(c *config) {
+		c.bots = d
+		c.afterShutdown = append(c.afterShutdown, d.Close)
+	})
+}
+
+// Retention enables purging of expired messages with provided janitor.
+// The janitor is owned by Server.Start: it is started once http.Server listener is bound and closed
+// when serving stops, before functions registered with RegisterAfterShutdown are called.
+func Retention(j *retention.Janitor) Option {
+	return optionFunc(func(c *config) {
+		c.janitor = j
+	})
+}
+
 // RegisterAfterShutdown registers a function to call after http.Server shutdown
 // f will not be called in separated goroutine
 func RegisterAfterShutdown(f func()) Option {
@@ -71,11 +261,79 @@ func applyEnforcePostJson() Option {
 	})
 }
 
-// applyLog wraps each http.Handler in handlers map with log middleware
+// applyAudit wraps handlers of endpoints listed in auditedEndpoints with audit middleware, including those
+// served by admin listener. It must be applied after registerAttachmentHandlers, so uploads are audited as well,
+// and before applyLog, so request ids are already in request contexts.
+func applyAudit(logger *zap.SugaredLogger, store auditStore) Option {
+	return optionFunc(func(c *config) {
+		for pattern, spec := range auditedEndpoints {
+			if h, ok := c.handlers[pattern]; ok {
+				c.handlers[pattern] = audit(h, spec, store, logger)
+			}
+			if h, ok := c.adminHandlers[pattern]; ok {
+				c.adminHandlers[pattern] = audit(h, spec, store, logger)
+			}
+		}
+	})
+}
+
+// applyCompression wraps each http.Handler in handlers map with compression middleware.
+// It must be applied after applyEnforcePostJson, so gzip request bodies are decompressed before validation,
+// and after registerAttachmentHandlers, so attachments are compressed as well when it is worth it.
+func applyCompression() Option {
+	return optionFunc(func(c *config) {
+		for pattern, h := range c.handlers {
+			maxSize := c.maxRequest
+			if pattern == "/attachments/upload" && c.maxUploadSize+multipartOverhead > maxSize {
+				maxSize = c.maxUploadSize + multipartOverhead
+			}
+			c.handlers[pattern] = compression(h, c.compressMin, maxSize)
+		}
+	})
+}
+
+// applyRequestTimeout wraps each http.Handler in handlers map with timeout middleware
+func applyRequestTimeout() Option {
+	return optionFunc(func(c *config) {
+		for pattern, h := range c.handlers {
+			c.handlers[pattern] = timeout(h, c.timeout)
+		}
+	})
+}
+
+// applyRecovery wraps each http.Handler in handlers map with recovery middleware.
+// It must be applied before applyLog, so request ids are already in request contexts
+// and responses to recovered panics are logged.
+func applyRecovery(logger *zap.Logger) Option {
+	return optionFunc(func(c *config) {
+		for pattern, h := range c.handlers {
+			c.handlers[pattern] = recovery(h, logger, c.panics, c.repanic)
+		}
+	})
+}
+
+// applyLog wraps each http.Handler in handlers map with log middleware escalating requests slower than
+// SlowRequestThreshold
 func applyLog(logger *zap.Logger) Option {
 	return optionFunc(func(c *config) {
 		for pattern, h := range c.handlers {
-			c.handlers[pattern] = log(h, logger)
+			c.handlers[pattern] = log(h, logger, c.slowRequest)
+		}
+	})
+}
+
+// applyTracing wraps each http.Handler in handlers map with tracing middleware.
+// It must be applied after applyLog.
+func applyTracing() Option {
+	return optionFunc(func(c *config) {
+		tp := c.tracer
+		if tp == nil {
+			tp = otel.GetTracerProvider()
+		}
+		tracer := tp.Tracer(instrumentationName)
+
+		for pattern, h := range c.handlers {
+			c.handlers[pattern] = tracing(h, tracer, pattern)
 		}
 	})
 }
@@ -88,3 +346,37 @@ func TimeoutHandler(d time.Duration, msg string) Option {
 		}
 	})
 }
+
+// registerAttachmentHandlers adds attachment handlers to handlers map if blob store was provided by Attachments option.
+// It must be applied after applyEnforcePostJson since uploads are multipart and downloads are GET requests,
+// as well as after TimeoutHandler as http.TimeoutHandler buffers whole response in memory.
+func registerAttachmentHandlers(logger *zap.SugaredLogger, store *storage.Store) Option {
+	return optionFunc(func(c *config) {
+		if c.blobs == nil {
+			return
+		}
+
+		h := &attachmentHandler{
+			logger:     logger,
+			store:      store,
+			blobs:      c.blobs,
+			maxSize:    c.maxUploadSize,
+			thumbnails: c.thumbnails,
+		}
+		c.handlers["/attachments/upload"] = http.HandlerFunc(h.upload)
+		c.handlers["/attachments/get"] = http.HandlerFunc(h.download)
+	})
+}
+
+// applyBots passes bot dispatcher provided by Bots option to default handlers and registers "/bots/add" endpoint.
+// It must be applied before applyEnforcePostJson.
+func applyBots(h *handler) Option {
+	return optionFunc(func(c *config) {
+		if c.bots == nil {
+			return
+		}
+
+		h.bots = c.bots
+		c.handlers["/bots/add"] = http.HandlerFunc(h.createBot)
+	})
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"avito-trainee-assignment/internal/bot"
 	"avito-trainee-assignment/internal/storage"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/valyala/fastjson"
@@ -14,17 +16,40 @@ import (
 
 // TODO limit reading from body
 
+const (
+	// defaultSearchLimit is used when "limit" field is omitted in "/messages/search" request
+	defaultSearchLimit = 20
+	// maxSearchLimit is the maximum allowed "limit" field value in "/messages/search" request
+	maxSearchLimit = 100
+	// maxEmojiLength is the maximum length in bytes of "emoji" field in reaction requests
+	maxEmojiLength = 32
+)
+
 type parsers struct {
 	createChatPool       fastjson.ParserPool
 	createMessagePool    fastjson.ParserPool
 	chatsByUserIDPool    fastjson.ParserPool
 	messagesByChatIDPool fastjson.ParserPool
+	searchMessagesPool   fastjson.ParserPool
+	markChatReadPool     fastjson.ParserPool
+	createDirectChatPool fastjson.ParserPool
+	threadPool           fastjson.ParserPool
+	reactionPool         fastjson.ParserPool
+	webhookPool          fastjson.ParserPool
+	deliveriesPool       fastjson.ParserPool
+	botPool              fastjson.ParserPool
+	mentionsPool         fastjson.ParserPool
+	retentionPool        fastjson.ParserPool
+	privacyPool          fastjson.ParserPool
+	auditPool            fastjson.ParserPool
 }
 
 type handler struct {
 	logger  *zap.SugaredLogger
 	store   *storage.Store
 	parsers parsers
+	// bots is nil when bots are disabled
+	bots *bot.Dispatcher
 }
 
 // createUser handles HTTP requests on "/users/add" endpoint
@@ -147,6 +172,67 @@ func (h *handler) createChat(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// createDirectChat handles HTTP requests on "/chats/direct" endpoint
+// it responds with 201 status code if chat was created and with 200 if it already existed
+func (h *handler) createDirectChat(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.createDirectChatPool.Get()
+	defer h.parsers.createDirectChatPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	users := make([]int64, 0, 2)
+	for _, field := range []string{"user_a", "user_b"} {
+		if !v.Exists(field) {
+			http.Error(w, "Missing Field \""+field+"\"", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := v.Get(field).Int64()
+		if err != nil {
+			http.Error(w, "Field \""+field+"\" must be a 64-bit integer value", http.StatusBadRequest)
+			return
+		}
+
+		if userID < 1 {
+			http.Error(w, "Field \""+field+"\" must be a valid user id grater than zero", http.StatusBadRequest)
+			return
+		}
+		users = append(users, userID)
+	}
+
+	h.parsers.createDirectChatPool.Put(parser)
+
+	id, created, err := h.store.CreateDirectChat(r.Context(), users[0], users[1])
+	if err != nil {
+		switch err {
+		case storage.ErrChatBadUsers:
+			http.Error(w, "Bad user pair", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	// returning id
+	payload := []byte(`{"id":` + strconv.FormatInt(id, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
 // createMessage handles HTTP requests on "/messages/add" endpoint
 func (h *handler) createMessage(w http.ResponseWriter, r *http.Request) {
 	body, _ := ioutil.ReadAll(r.Body)
@@ -203,16 +289,55 @@ func (h *handler) createMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var opts []storage.MessageOption
+
+	// retrieving optional attachment ids
+	var attachmentIDs []int64
+	if v.Exists("attachments") {
+		attachmentValues, err := v.Get("attachments").Array()
+		if err != nil {
+			http.Error(w, "Field \"attachments\" must be an array", http.StatusBadRequest)
+			return
+		}
+
+		attachmentIDs = make([]int64, 0, len(attachmentValues))
+		for _, v := range attachmentValues {
+			attachmentID, err := v.Int64()
+			if err != nil || attachmentID < 1 {
+				http.Error(w, "Each item in \"attachments\" array must be a valid attachment id grater than zero", http.StatusBadRequest)
+				return
+			}
+			attachmentIDs = append(attachmentIDs, attachmentID)
+		}
+		opts = append(opts, storage.WithAttachments(attachmentIDs...))
+	}
+
+	// text may be blank only when the message carries attachments
 	text := strings.Trim(string(textValue.MarshalTo(nil)), `"`)
-	if len(text) == 0 {
+	if len(text) == 0 && len(attachmentIDs) == 0 {
 		http.Error(w, "Field \"text\" must have non-zero length", http.StatusBadRequest)
 		return
 	}
 
+	// retrieving optional replied message id
+	if v.Exists("reply_to_message_id") {
+		replyTo, err := v.Get("reply_to_message_id").Int64()
+		if err != nil {
+			http.Error(w, "Field \"reply_to_message_id\" must be a 64-bit integer value", http.StatusBadRequest)
+			return
+		}
+
+		if replyTo < 1 {
+			http.Error(w, "Field \"reply_to_message_id\" must be a valid message id grater than zero", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, storage.ReplyTo(replyTo))
+	}
+
 	h.parsers.createMessagePool.Put(parser)
 
 	// creating message
-	id, err := h.store.CreateMessage(r.Context(), chatID, authorID, text)
+	id, err := h.store.CreateMessage(r.Context(), chatID, authorID, text, opts...)
 	if err != nil {
 		switch err {
 		case storage.ErrChatNotExist:
@@ -224,6 +349,15 @@ func (h *handler) createMessage(w http.ResponseWriter, r *http.Request) {
 		case storage.ErrUserNotChatMember:
 			http.Error(w, "Author is not chat member", http.StatusBadRequest)
 			return
+		case storage.ErrMessageNotExist:
+			http.Error(w, "Replied message does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrMessageNotInChat:
+			http.Error(w, "Replied message belongs to another chat", http.StatusBadRequest)
+			return
+		case storage.ErrBadAttachments:
+			http.Error(w, "Bad attachments list", http.StatusBadRequest)
+			return
 		default:
 			h.logger.Error(err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -231,6 +365,11 @@ func (h *handler) createMessage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// commands are handled in background, bot replies appear in the chat later
+	if h.bots != nil {
+		h.bots.Dispatch(storage.Message{ID: id, Chat: chatID, Author: authorID, Text: text})
+	}
+
 	// returning id
 	payload := []byte(`{"id":` + strconv.FormatInt(id, 10) + `}`)
 
@@ -327,9 +466,24 @@ func (h *handler) messagesByChatID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// retrieving optional id of the user reactions are aggregated for
+	var userID int64
+	if v.Exists("user") {
+		userID, err = v.Get("user").Int64()
+		if err != nil {
+			http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+			return
+		}
+
+		if userID < 1 {
+			http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+			return
+		}
+	}
+
 	h.parsers.messagesByChatIDPool.Put(parser)
 
-	messages, err := h.store.MessagesByChatID(r.Context(), chatID)
+	messages, err := h.store.MessagesByChatID(r.Context(), chatID, userID)
 	if err != nil {
 		switch err {
 		case storage.ErrChatNotExist:
@@ -360,3 +514,369 @@ func (h *handler) messagesByChatID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
+
+// searchMessages handles HTTP requests on "/messages/search" endpoint
+func (h *handler) searchMessages(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.searchMessagesPool.Get()
+	defer h.parsers.searchMessagesPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving query
+	if !v.Exists("query") {
+		http.Error(w, "Missing Field \"query\"", http.StatusBadRequest)
+		return
+	}
+
+	queryValue := v.Get("query")
+	if queryValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"query\" must be a string", http.StatusBadRequest)
+		return
+	}
+
+	query := strings.TrimSpace(string(queryValue.GetStringBytes()))
+	if len(query) == 0 {
+		http.Error(w, "Field \"query\" must have non-zero length", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving optional limit
+	limit := defaultSearchLimit
+	if v.Exists("limit") {
+		limit, err = v.Get("limit").Int()
+		if err != nil {
+			http.Error(w, "Field \"limit\" must be an integer value", http.StatusBadRequest)
+			return
+		}
+
+		if limit < 1 || limit > maxSearchLimit {
+			http.Error(w, "Field \"limit\" must be in range [1, "+strconv.Itoa(maxSearchLimit)+"]", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// retrieving optional cursor
+	var cursor string
+	if v.Exists("cursor") {
+		cursorValue := v.Get("cursor")
+		if cursorValue.Type() != fastjson.TypeString {
+			http.Error(w, "Field \"cursor\" must be a string", http.StatusBadRequest)
+			return
+		}
+		cursor = string(cursorValue.GetStringBytes())
+	}
+
+	h.parsers.searchMessagesPool.Put(parser)
+
+	results, next, err := h.store.SearchMessages(r.Context(), userID, query, limit, cursor)
+	if err != nil {
+		switch err {
+		case storage.ErrUserNotExist:
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrBadCursor:
+			http.Error(w, "Bad cursor", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	page := struct {
+		Results    []storage.SearchResult `json:"results"`
+		NextCursor string                 `json:"next_cursor,omitempty"`
+	}{
+		Results:    results,
+		NextCursor: next,
+	}
+
+	payload, err := json.Marshal(page)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// markChatRead handles HTTP requests on "/chats/read" endpoint
+func (h *handler) markChatRead(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.markChatReadPool.Get()
+	defer h.parsers.markChatReadPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving chat id
+	if !v.Exists("chat") {
+		http.Error(w, "Missing Field \"chat\"", http.StatusBadRequest)
+		return
+	}
+
+	chatID, err := v.Get("chat").Int64()
+	if err != nil {
+		http.Error(w, "Field \"chat\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if chatID < 1 {
+		http.Error(w, "Field \"chat\" must be a valid chat id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving message id
+	if !v.Exists("message") {
+		http.Error(w, "Missing Field \"message\"", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := v.Get("message").Int64()
+	if err != nil {
+		http.Error(w, "Field \"message\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if messageID < 1 {
+		http.Error(w, "Field \"message\" must be a valid message id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	h.parsers.markChatReadPool.Put(parser)
+
+	lastRead, err := h.store.MarkChatRead(r.Context(), chatID, userID, messageID)
+	if err != nil {
+		switch err {
+		case storage.ErrChatNotExist:
+			http.Error(w, "Chat does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrUserNotExist:
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrMessageNotInChat:
+			http.Error(w, "Message does not belong to chat", http.StatusBadRequest)
+			return
+		case storage.ErrUserNotChatMember:
+			http.Error(w, "User is not chat member", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	payload := []byte(`{"last_read_message_id":` + strconv.FormatInt(lastRead, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// thread handles HTTP requests on "/messages/thread" endpoint
+func (h *handler) thread(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.threadPool.Get()
+	defer h.parsers.threadPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	if !v.Exists("message") {
+		http.Error(w, "Missing Field \"message\"", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := v.Get("message").Int64()
+	if err != nil {
+		http.Error(w, "Field \"message\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if messageID < 1 {
+		http.Error(w, "Field \"message\" must be a valid message id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	h.parsers.threadPool.Put(parser)
+
+	root, replies, err := h.store.Thread(r.Context(), messageID)
+	if err != nil {
+		switch err {
+		case storage.ErrMessageNotExist:
+			http.Error(w, "Message does not exist", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	thread := struct {
+		Root    storage.Message   `json:"root"`
+		Replies []storage.Message `json:"replies"`
+	}{
+		Root:    root,
+		Replies: replies,
+	}
+
+	payload, err := json.Marshal(thread)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// react handles HTTP requests on "/messages/react" endpoint
+func (h *handler) react(w http.ResponseWriter, r *http.Request) {
+	h.handleReaction(w, r, h.store.React)
+}
+
+// unreact handles HTTP requests on "/messages/unreact" endpoint
+func (h *handler) unreact(w http.ResponseWriter, r *http.Request) {
+	h.handleReaction(w, r, h.store.Unreact)
+}
+
+// handleReaction parses reaction request shared by "/messages/react" and "/messages/unreact" endpoints
+// and calls provided store method
+func (h *handler) handleReaction(w http.ResponseWriter, r *http.Request, apply func(context.Context, int64, int64, string) error) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.reactionPool.Get()
+	defer h.parsers.reactionPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving message id
+	if !v.Exists("message") {
+		http.Error(w, "Missing Field \"message\"", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := v.Get("message").Int64()
+	if err != nil {
+		http.Error(w, "Field \"message\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if messageID < 1 {
+		http.Error(w, "Field \"message\" must be a valid message id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving emoji
+	if !v.Exists("emoji") {
+		http.Error(w, "Missing Field \"emoji\"", http.StatusBadRequest)
+		return
+	}
+
+	emojiValue := v.Get("emoji")
+	if emojiValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"emoji\" must be a string", http.StatusBadRequest)
+		return
+	}
+
+	emoji := string(emojiValue.GetStringBytes())
+	if len(emoji) == 0 || len(emoji) > maxEmojiLength || strings.TrimSpace(emoji) != emoji {
+		http.Error(w, "Field \"emoji\" must be a non-blank string up to "+strconv.Itoa(maxEmojiLength)+" bytes", http.StatusBadRequest)
+		return
+	}
+
+	h.parsers.reactionPool.Put(parser)
+
+	err = apply(r.Context(), messageID, userID, emoji)
+	if err != nil {
+		switch err {
+		case storage.ErrMessageNotExist:
+			http.Error(w, "Message does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrUserNotExist:
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrUserNotChatMember:
+			http.Error(w, "User is not chat member", http.StatusBadRequest)
+			return
+		case storage.ErrReactionNotExist:
+			http.Error(w, "Reaction does not exist", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
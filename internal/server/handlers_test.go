@@ -2,14 +2,21 @@ package server
 
 import (
 	"avito-trainee-assignment/internal/storage"
+	"avito-trainee-assignment/internal/storage/zapadapter"
 	mytesting "avito-trainee-assignment/internal/testing"
 	"bytes"
 	"context"
 	"encoding/json"
 	"github.com/stretchr/testify/require"
 	"github.com/valyala/fastjson"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/oteltest"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -174,6 +181,235 @@ func TestEnforcePOSTJSON_MalformedJSON(t *testing.T) {
 	require.Equal(t, "Malformed JSON\n", rr.Body.String())
 }
 
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+
+	var deadline time.Time
+	var hasDeadline bool
+	srv := &Server{timeout: &requestTimeout{}}
+	handler := timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+		w.WriteHeader(http.StatusOK)
+	}), srv.timeout)
+
+	req, err := http.NewRequest("POST", "/", nil)
+	require.NoError(t, err)
+
+	// zero timeout is disabled
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.False(t, hasDeadline)
+
+	srv.SetRequestTimeout(time.Minute)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.True(t, hasDeadline)
+	require.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+}
+
+func TestLogAccess(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := log(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := zapadapter.IDFromContext(r.Context())
+		require.True(t, ok)
+		require.Equal(t, "client-id.1", id)
+
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":1}`))
+	}), zap.New(core), time.Minute)
+
+	req, err := http.NewRequest("POST", "/users/add", nil)
+	require.NoError(t, err)
+	req.Header.Set(requestIDHeader, "client-id.1")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, "client-id.1", rr.Header().Get(requestIDHeader))
+
+	entries := logs.FilterMessage("completed http request").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "client-id.1", fields["id"])
+	require.Equal(t, int64(http.StatusCreated), fields["status"])
+	require.Equal(t, int64(len(`{"id":1}`)), fields["bytes"])
+	require.Contains(t, fields, "duration")
+}
+
+func TestLogAccess_FlushAndHijack(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	srv := httptest.NewServer(log(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			_, _ = w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: close\r\n\r\n")
+		_ = rw.Flush()
+	}), zap.New(core), 0))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.Equal(t, "chunk", string(body))
+
+	resp, err = http.Get(srv.URL + "/upgrade")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// the hijacked request is logged after the handler returns, which may happen after the client got the response
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("completed http request").Len() == 2
+	}, time.Second, time.Millisecond)
+	entries := logs.FilterMessage("completed http request").All()
+	require.Equal(t, int64(http.StatusOK), entries[0].ContextMap()["status"])
+	require.Equal(t, int64(http.StatusSwitchingProtocols), entries[1].ContextMap()["status"])
+
+	// the underlying writer is reachable for http.ResponseController
+	rec := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	require.IsType(t, &httptest.ResponseRecorder{}, rec.Unwrap())
+}
+
+func TestLogAccess_GeneratedIDAndSlowRequest(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := log(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}), zap.New(core), 10*time.Millisecond)
+
+	req, err := http.NewRequest("POST", "/users/add", nil)
+	require.NoError(t, err)
+	// ids with unexpected characters are replaced
+	req.Header.Set(requestIDHeader, "bad id\n")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	id := rr.Header().Get(requestIDHeader)
+	require.NotEqual(t, "bad id\n", id)
+	require.True(t, validRequestID(id))
+
+	entries := logs.FilterMessage("slow http request").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	require.Equal(t, id, entries[0].ContextMap()["id"])
+	require.Equal(t, int64(http.StatusOK), entries[0].ContextMap()["status"])
+}
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	recorder := new(oteltest.StandardSpanRecorder)
+	tracer := oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder)).Tracer(instrumentationName)
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	handler := tracing(log(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}), zap.New(core), 0), tracer, "/users/add")
+
+	req, err := http.NewRequest("POST", "/users/add", nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(requestIDHeader, "client-id")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Completed()
+	require.Len(t, spans, 1)
+	span := spans[0]
+	require.Equal(t, "/users/add", span.Name())
+	// the span continues the trace of the caller
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID.String())
+	require.Equal(t, "00f067aa0ba902b7", span.ParentSpanID().String())
+	require.Equal(t, codes.Error, span.StatusCode())
+	require.Equal(t, label.StringValue("client-id"), span.Attributes()["http.request_id"])
+	require.Equal(t, label.Int64Value(http.StatusInternalServerError), span.Attributes()["http.status_code"])
+
+	entries := logs.FilterMessage("completed http request").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", entries[0].ContextMap()["trace_id"])
+}
+
+func TestRecovery(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	srv := &Server{panics: &panicCounter{}}
+	handler := log(recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), zap.New(core), srv.panics, false), zap.New(core), 0)
+
+	req, err := http.NewRequest("POST", "/users/add", nil)
+	require.NoError(t, err)
+	req.Header.Set(requestIDHeader, "client-id")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"request_id":"client-id"}`, rr.Body.String())
+	require.Equal(t, uint64(1), srv.Panics())
+
+	entries := logs.FilterMessage("panic while handling http request").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "client-id", fields["id"])
+	require.Equal(t, "boom", fields["panic"])
+	require.Contains(t, fields["stack"], "TestRecovery")
+
+	// the response is logged as a regular one
+	entries = logs.FilterMessage("completed http request").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, int64(http.StatusInternalServerError), entries[0].ContextMap()["status"])
+}
+
+func TestRecovery_StartedResponse(t *testing.T) {
+	t.Parallel()
+
+	panics := &panicCounter{}
+	handler := recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":1},`))
+		panic("boom")
+	}), zap.NewNop(), panics, false)
+
+	req, err := http.NewRequest("POST", "/messages/get", nil)
+	require.NoError(t, err)
+
+	// http.Server aborts the connection instead of completing a partial response
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+	require.Equal(t, uint64(1), panics.load())
+}
+
+func TestRecovery_Repanic(t *testing.T) {
+	t.Parallel()
+
+	panics := &panicCounter{}
+	handler := recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), zap.NewNop(), panics, true)
+
+	req, err := http.NewRequest("POST", "/users/add", nil)
+	require.NoError(t, err)
+
+	require.PanicsWithValue(t, "boom", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+	require.Equal(t, uint64(1), panics.load())
+}
+
 func TestCreateUser(t *testing.T) {
 	t.Parallel()
 
@@ -1371,3 +1607,462 @@ func TestMessagesByChatID_InternalOnStoreCall(t *testing.T) {
 	require.Equal(t, http.StatusInternalServerError, rr.Code)
 
 }
+
+func TestSearchMessages(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	word := mytesting.RandString()
+	messageID, err := h.store.CreateMessage(context.Background(), chatID, userTwoID, "ping "+word)
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"user":` + strconv.FormatInt(userOneID, 10) + `,"query":"` + word + `"}`))
+
+	req, err := http.NewRequest("POST", "/messages/search", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.searchMessages)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	v, err := fastjson.ParseBytes(rr.Body.Bytes())
+	require.NoError(t, err)
+	resultValues, err := v.Get("results").Array()
+	require.NoError(t, err)
+	require.Len(t, resultValues, 1)
+
+	id, err := resultValues[0].Get("id").Int64()
+	require.NoError(t, err)
+	require.Equal(t, messageID, id)
+	require.Contains(t, string(resultValues[0].GetStringBytes("snippet")), "<b>"+word+"</b>")
+	require.False(t, v.Exists("next_cursor"))
+}
+
+func TestSearchMessages_NoQueryField(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"user":1}`))
+
+	req, err := http.NewRequest("POST", "/messages/search", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.searchMessages)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Missing Field \"query\"\n", rr.Body.String())
+}
+
+func TestSearchMessages_LimitOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"user":1,"query":"hello","limit":1000}`))
+
+	req, err := http.NewRequest("POST", "/messages/search", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.searchMessages)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Field \"limit\" must be in range [1, 100]\n", rr.Body.String())
+}
+
+func TestSearchMessages_BadCursor(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"user":` + strconv.FormatInt(userID, 10) + `,"query":"hello","cursor":"?"}`))
+
+	req, err := http.NewRequest("POST", "/messages/search", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.searchMessages)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Bad cursor\n", rr.Body.String())
+}
+
+func TestMarkChatRead(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	messageID, err := h.store.CreateMessage(context.Background(), chatID, userTwoID, mytesting.RandString())
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"chat":` + strconv.FormatInt(chatID, 10) +
+		`,"user":` + strconv.FormatInt(userOneID, 10) +
+		`,"message":` + strconv.FormatInt(messageID, 10) + `}`))
+
+	req, err := http.NewRequest("POST", "/chats/read", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.markChatRead)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	require.Equal(t, `{"last_read_message_id":`+strconv.FormatInt(messageID, 10)+`}`, rr.Body.String())
+}
+
+func TestMarkChatRead_NoMessageField(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"chat":1,"user":1}`))
+
+	req, err := http.NewRequest("POST", "/chats/read", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.markChatRead)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Missing Field \"message\"\n", rr.Body.String())
+}
+
+func TestMarkChatRead_ChatNotExist(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"chat":` + strconv.FormatInt(math.MaxInt64, 10) + `,"user":1,"message":1}`))
+
+	req, err := http.NewRequest("POST", "/chats/read", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.markChatRead)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Chat does not exist\n", rr.Body.String())
+}
+
+func TestCreateDirectChat(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	body := []byte(`{"user_a":` + strconv.FormatInt(userOneID, 10) + `,"user_b":` + strconv.FormatInt(userTwoID, 10) + `}`)
+
+	// the first request creates chat, the second one returns the same chat
+	var ids []int64
+	for _, status := range []int{http.StatusCreated, http.StatusOK} {
+		req, err := http.NewRequest("POST", "/chats/direct", bytes.NewBuffer(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(h.createDirectChat)
+
+		handler.ServeHTTP(rr, req)
+
+		require.Equal(t, status, rr.Code)
+		require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+		v, err := fastjson.ParseBytes(rr.Body.Bytes())
+		require.NoError(t, err)
+		id, err := v.Get("id").Int64()
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	require.Equal(t, ids[0], ids[1])
+}
+
+func TestCreateDirectChat_NoUserBField(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"user_a":1}`))
+
+	req, err := http.NewRequest("POST", "/chats/direct", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.createDirectChat)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Missing Field \"user_b\"\n", rr.Body.String())
+}
+
+func TestCreateDirectChat_SameUser(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"user_a":1,"user_b":1}`))
+
+	req, err := http.NewRequest("POST", "/chats/direct", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.createDirectChat)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Bad user pair\n", rr.Body.String())
+}
+
+func TestCreateMessageReplyFieldNotInteger(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"chat":1,"author":1,"text":"hi","reply_to_message_id":"1"}`))
+	req, err := http.NewRequest("POST", "/messages/add", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.createMessage)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Field \"reply_to_message_id\" must be a 64-bit integer value\n", rr.Body.String())
+}
+
+func TestCreateMessageReplyAcrossChats(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatOneID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	chatTwoID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	messageID, err := h.store.CreateMessage(context.Background(), chatOneID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"chat":` + strconv.FormatInt(chatTwoID, 10) +
+		`,"author":` + strconv.FormatInt(userTwoID, 10) +
+		`,"text":"hi","reply_to_message_id":` + strconv.FormatInt(messageID, 10) + `}`))
+	req, err := http.NewRequest("POST", "/messages/add", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.createMessage)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Replied message belongs to another chat\n", rr.Body.String())
+}
+
+func TestThread(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	rootID, err := h.store.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+	replyID, err := h.store.CreateMessage(context.Background(), chatID, userTwoID, mytesting.RandString(), storage.ReplyTo(rootID))
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"message":` + strconv.FormatInt(rootID, 10) + `}`))
+	req, err := http.NewRequest("POST", "/messages/thread", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.thread)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	v, err := fastjson.ParseBytes(rr.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, rootID, v.GetInt64("root", "id"))
+	require.Equal(t, int64(1), v.GetInt64("root", "reply_count"))
+
+	replyValues, err := v.Get("replies").Array()
+	require.NoError(t, err)
+	require.Len(t, replyValues, 1)
+	require.Equal(t, replyID, replyValues[0].GetInt64("id"))
+}
+
+func TestThread_MessageNotExist(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"message":` + strconv.FormatInt(math.MaxInt64, 10) + `}`))
+	req, err := http.NewRequest("POST", "/messages/thread", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.thread)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Message does not exist\n", rr.Body.String())
+}
+
+func TestReact(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	messageID, err := h.store.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"message":` + strconv.FormatInt(messageID, 10) +
+		`,"user":` + strconv.FormatInt(userTwoID, 10) + `,"emoji":"👍"}`))
+	req, err := http.NewRequest("POST", "/messages/react", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.react)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	// reactions are visible in "/messages/get" response
+	payload = bytes.NewBuffer([]byte(`{"chat":` + strconv.FormatInt(chatID, 10) + `,"user":` + strconv.FormatInt(userTwoID, 10) + `}`))
+	req, err = http.NewRequest("POST", "/messages/get", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr = httptest.NewRecorder()
+	handler = http.HandlerFunc(h.messagesByChatID)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	v, err := fastjson.ParseBytes(rr.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, 1, v.GetInt("0", "reactions", "👍", "count"))
+	require.True(t, v.GetBool("0", "reactions", "👍", "reacted"))
+}
+
+func TestReact_BlankEmoji(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"message":1,"user":1,"emoji":" "}`))
+	req, err := http.NewRequest("POST", "/messages/react", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.react)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Field \"emoji\" must be a non-blank string up to 32 bytes\n", rr.Body.String())
+}
+
+func TestUnreact_ReactionNotExist(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userOneID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	messageID, err := h.store.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"message":` + strconv.FormatInt(messageID, 10) +
+		`,"user":` + strconv.FormatInt(userTwoID, 10) + `,"emoji":"👍"}`))
+	req, err := http.NewRequest("POST", "/messages/unreact", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(h.unreact)
+
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "Reaction does not exist\n", rr.Body.String())
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"encoding/json"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultMentionsLimit is used when "limit" field is omitted in "/mentions/get" request
+	defaultMentionsLimit = 20
+	// maxMentionsLimit is the maximum allowed "limit" field value in "/mentions/get" request
+	maxMentionsLimit = 100
+)
+
+// unreadMentions handles HTTP requests on "/mentions/get" endpoint listing unread mentions of the user across chats.
+// Pages are requested with "cursor" field set to "next_cursor" of the previous page.
+func (h *handler) unreadMentions(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.mentionsPool.Get()
+	defer h.parsers.mentionsPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving optional limit
+	limit := defaultMentionsLimit
+	if v.Exists("limit") {
+		limit, err = v.Get("limit").Int()
+		if err != nil {
+			http.Error(w, "Field \"limit\" must be an integer value", http.StatusBadRequest)
+			return
+		}
+
+		if limit < 1 || limit > maxMentionsLimit {
+			http.Error(w, "Field \"limit\" must be in range [1, "+strconv.Itoa(maxMentionsLimit)+"]", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// retrieving optional cursor
+	var cursor string
+	if v.Exists("cursor") {
+		cursorValue := v.Get("cursor")
+		if cursorValue.Type() != fastjson.TypeString {
+			http.Error(w, "Field \"cursor\" must be a string", http.StatusBadRequest)
+			return
+		}
+		cursor = string(cursorValue.GetStringBytes())
+	}
+
+	mentions, next, err := h.store.UnreadMentions(r.Context(), userID, limit, cursor)
+	if err != nil {
+		switch err {
+		case storage.ErrUserNotExist:
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		case storage.ErrBadCursor:
+			http.Error(w, "Bad cursor", http.StatusBadRequest)
+			return
+		default:
+			h.logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	page := struct {
+		Mentions   []storage.Mention `json:"mentions"`
+		NextCursor string            `json:"next_cursor,omitempty"`
+	}{
+		Mentions:   mentions,
+		NextCursor: next,
+	}
+
+	payload, err := json.Marshal(page)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
+
+// markMentionsRead handles HTTP requests on "/mentions/read" endpoint marking mentions in provided messages as read
+func (h *handler) markMentionsRead(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.mentionsPool.Get()
+	defer h.parsers.mentionsPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving message ids
+	if !v.Exists("messages") {
+		http.Error(w, "Missing Field \"messages\"", http.StatusBadRequest)
+		return
+	}
+
+	messageValues, err := v.Get("messages").Array()
+	if err != nil {
+		http.Error(w, "Field \"messages\" must be an array", http.StatusBadRequest)
+		return
+	}
+
+	if len(messageValues) == 0 {
+		http.Error(w, "Field \"messages\" must be a non-empty array", http.StatusBadRequest)
+		return
+	}
+
+	messageIDs := make([]int64, 0, len(messageValues))
+	for _, v := range messageValues {
+		messageID, err := v.Int64()
+		if err != nil || messageID < 1 {
+			http.Error(w, "Each item in \"messages\" array must be a valid message id grater than zero", http.StatusBadRequest)
+			return
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+
+	marked, err := h.store.MarkMentionsRead(r.Context(), userID, messageIDs)
+	if err != nil {
+		if err == storage.ErrUserNotExist {
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	payload := []byte(`{"marked":` + strconv.FormatInt(marked, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnreadMentionsBadLimit(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	req, err := http.NewRequest("POST", "/mentions/get", bytes.NewBuffer([]byte(`{"user":1,"limit":1000}`)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.unreadMentions).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestMarkMentionsReadBadMessages(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	for _, messages := range []string{`[]`, `1`, `[0]`, `["1"]`} {
+		req, err := http.NewRequest("POST", "/mentions/read", bytes.NewBuffer([]byte(`{"user":1,"messages":`+messages+`}`)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.markMentionsRead).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code, messages)
+	}
+}
@@ -2,14 +2,27 @@ package server
 
 import (
 	"avito-trainee-assignment/internal/storage/zapadapter"
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/rs/xid"
 	"github.com/valyala/fastjson"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"io"
 	"io/ioutil"
 	"mime"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
 )
 
 // enforcePostJson is a middleware pre-processing each HTTP request
@@ -66,20 +79,272 @@ func enforcePostJson(next http.Handler) http.Handler {
 	})
 }
 
-func log(next http.Handler, logger *zap.Logger) http.Handler {
+// requestTimeout is a duration of handling a request safe for concurrent use, zero disables the timeout
+type requestTimeout struct {
+	d int64
+}
+
+func (t *requestTimeout) load() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.d))
+}
+
+func (t *requestTimeout) store(d time.Duration) {
+	atomic.StoreInt64(&t.d, int64(d))
+}
+
+// timeout is a middleware cancelling request context after the current request timeout
+func timeout(next http.Handler, t *requestTimeout) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		id := xid.New().String()
+		d := t.load()
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+const (
+	// requestIDHeader carries request id set by a client or a proxy, it is echoed back in the response
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength limits inbound request ids, longer ones are replaced by generated ones
+	maxRequestIDLength = 64
+)
+
+// validRequestID reports whether inbound request id is safe to log and store,
+// only letters, digits and "-", "_", ".", ":" are allowed
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// responseRecorder captures response status and the number of written body bytes
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// Flush passes through to the underlying writer, so streamed responses are not held back by logging
+func (w *responseRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the underlying writer, hijacked connections are logged with 101 status
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying writer, it is used by http.ResponseController
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// log is a middleware assigning request id and writing access log.
+// Inbound X-Request-ID header is used as request id if it is valid, otherwise a new one is generated.
+// Requests handled longer than slow (if positive) are logged with Warn level.
+func log(next http.Handler, logger *zap.Logger, slow time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = xid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
 
 		ctx := zapadapter.NewContextWithID(r.Context(), id)
 		rwID := r.WithContext(ctx)
 
-		logger.Info("incoming http request",
+		logger.Debug("incoming http request",
 			zap.String("id", id),
 			zap.String("method", r.Method),
 			zap.String("uri", r.URL.RequestURI()),
 			zap.String("ip", r.RemoteAddr),
 		)
 
-		next.ServeHTTP(w, rwID)
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, rwID)
+
+		// handlers writing nothing get 200 status from http.Server
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		elapsed := time.Since(start)
+		fields := []zap.Field{
+			zap.String("id", id),
+			zap.String("method", r.Method),
+			zap.String("uri", r.URL.RequestURI()),
+			zap.Int("status", rec.status),
+			zap.Int64("bytes", rec.bytes),
+			zap.Duration("duration", elapsed),
+		}
+
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			fields = append(fields, zap.String("trace_id", sc.TraceID.String()))
+		}
+
+		if slow > 0 && elapsed >= slow {
+			logger.Warn("slow http request", fields...)
+			return
+		}
+		logger.Info("completed http request", fields...)
+	})
+}
+
+// traceContext extracts and injects W3C traceparent and tracestate headers
+var traceContext = propagation.TraceContext{}
+
+// tracing is a middleware recording a server span named after the route pattern.
+// The span continues the trace of inbound traceparent header if there is one.
+// It must wrap log middleware to put request id into span attributes and trace id into access log.
+func tracing(next http.Handler, tracer trace.Tracer, route string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContext.Extract(r.Context(), r.Header)
+		ctx, span := tracer.Start(ctx, route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, r)...),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(rec.status)...)
+		span.SetAttributes(label.String("http.request_id", w.Header().Get(requestIDHeader)))
+		code, msg := semconv.SpanStatusFromHTTPStatusCode(rec.status)
+		if code == codes.Error {
+			span.SetStatus(code, msg)
+		}
+	})
+}
+
+// panicCounter counts recovered panics, it is safe for concurrent use
+type panicCounter struct {
+	n uint64
+}
+
+func (c *panicCounter) inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *panicCounter) load() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// problem is a body of application/problem+json response defined by RFC 7807
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// recovery is a middleware converting handler panics into 500 problem responses.
+// The panic is logged with the stack trace and the request id and counted.
+// If the response is already started, the connection is aborted instead, so a partial response is not taken
+// for a complete one. Panics are propagated after that if repanic is set.
+// It must be wrapped by log middleware to log request id.
+func recovery(next http.Handler, logger *zap.Logger, panics *panicCounter, repanic bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+
+			// http.ErrAbortHandler is the way to abort a response intentionally, it is not a crash
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			panics.inc()
+
+			id, _ := zapadapter.IDFromContext(r.Context())
+			logger.Error("panic while handling http request",
+				zap.String("id", id),
+				zap.String("method", r.Method),
+				zap.String("uri", r.URL.RequestURI()),
+				zap.Any("panic", p),
+				zap.ByteString("stack", debug.Stack()),
+			)
+
+			if repanic {
+				panic(p)
+			}
+
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+
+			body, _ := json.Marshal(problem{
+				Type:      "about:blank",
+				Title:     http.StatusText(http.StatusInternalServerError),
+				Status:    http.StatusInternalServerError,
+				RequestID: id,
+			})
+
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write(body)
+		}()
+
+		next.ServeHTTP(rec, r)
 	})
 }
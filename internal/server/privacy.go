@@ -0,0 +1,207 @@
+package server
+
+import (
+	"archive/zip"
+	"avito-trainee-assignment/internal/storage"
+	"encoding/json"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// Export formats accepted in "format" field of "/users/export" request
+const (
+	exportFormatNDJSON = "ndjson"
+	exportFormatZIP    = "zip"
+)
+
+// exportFiles maps export record kinds to ZIP archive entries
+var exportFiles = map[string]string{
+	storage.ExportRecordUser:    "profile.json",
+	storage.ExportRecordChat:    "chats.ndjson",
+	storage.ExportRecordMessage: "messages.ndjson",
+}
+
+// exportWriter encodes export records into a response body
+type exportWriter interface {
+	write(kind string, record interface{}) error
+	close() error
+}
+
+// ndjsonExport writes each record as a JSON line with record kind in "type" field
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExport) write(kind string, record interface{}) error {
+	return e.enc.Encode(struct {
+		Type string      `json:"type"`
+		Data interface{} `json:"data"`
+	}{
+		Type: kind,
+		Data: record,
+	})
+}
+
+func (e *ndjsonExport) close() error {
+	return nil
+}
+
+// zipExport writes records of each kind as JSON lines into a separate archive entry.
+// Records come grouped by kind, so entries are written one after another.
+type zipExport struct {
+	zw   *zip.Writer
+	kind string
+	enc  *json.Encoder
+}
+
+func (e *zipExport) write(kind string, record interface{}) error {
+	if kind != e.kind {
+		f, err := e.zw.Create(exportFiles[kind])
+		if err != nil {
+			return err
+		}
+		e.kind = kind
+		e.enc = json.NewEncoder(f)
+	}
+
+	return e.enc.Encode(record)
+}
+
+func (e *zipExport) close() error {
+	return e.zw.Close()
+}
+
+// exportUser handles HTTP requests on "/users/export" endpoint streaming all data of the user
+// as NDJSON (default) or as ZIP archive depending on "format" field.
+func (h *handler) exportUser(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.privacyPool.Get()
+	defer h.parsers.privacyPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	// retrieving optional format
+	format := exportFormatNDJSON
+	if v.Exists("format") {
+		formatValue := v.Get("format")
+		if formatValue.Type() != fastjson.TypeString {
+			http.Error(w, "Field \"format\" must be a string", http.StatusBadRequest)
+			return
+		}
+
+		format = string(formatValue.GetStringBytes())
+		if format != exportFormatNDJSON && format != exportFormatZIP {
+			http.Error(w, "Field \"format\" must be either \"ndjson\" or \"zip\"", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// response headers are written along with the first record, so missing users still get an error status
+	var ew exportWriter
+	err = h.store.ExportUser(r.Context(), userID, func(kind string, record interface{}) error {
+		if ew == nil {
+			ew = newExportWriter(w, format, userID)
+		}
+		return ew.write(kind, record)
+	})
+	if err != nil {
+		if ew != nil {
+			// the response is partially written, so the client gets a truncated body
+			h.logger.Errorf("exporting user (id: %d): %v", userID, err)
+			return
+		}
+
+		if err == storage.ErrUserNotExist {
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = ew.close()
+	if err != nil {
+		h.logger.Errorf("exporting user (id: %d): %v", userID, err)
+	}
+}
+
+// newExportWriter writes response headers for provided format and returns exportWriter encoding records into w
+func newExportWriter(w http.ResponseWriter, format string, user int64) exportWriter {
+	filename := "user-" + strconv.FormatInt(user, 10)
+
+	var ew exportWriter
+	switch format {
+	case exportFormatZIP:
+		w.Header().Set("Content-Type", "application/zip")
+		filename += ".zip"
+		ew = &zipExport{zw: zip.NewWriter(w)}
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		filename += ".ndjson"
+		ew = &ndjsonExport{enc: json.NewEncoder(w)}
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	return ew
+}
+
+// deleteUser handles HTTP requests on "/users/delete" endpoint anonymising the user
+func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.privacyPool.Get()
+	defer h.parsers.privacyPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving user id
+	if !v.Exists("user") {
+		http.Error(w, "Missing Field \"user\"", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := v.Get("user").Int64()
+	if err != nil {
+		http.Error(w, "Field \"user\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if userID < 1 {
+		http.Error(w, "Field \"user\" must be a valid user id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	err = h.store.DeleteUser(r.Context(), userID)
+	if err != nil {
+		if err == storage.ErrUserNotExist {
+			http.Error(w, "User does not exist", http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"archive/zip"
+	"avito-trainee-assignment/internal/storage"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNDJSONExport(t *testing.T) {
+	t.Parallel()
+
+	rr := httptest.NewRecorder()
+	ew := newExportWriter(rr, exportFormatNDJSON, 1)
+	require.NoError(t, ew.write(storage.ExportRecordUser, storage.User{ID: 1, Username: "alice"}))
+	require.NoError(t, ew.write(storage.ExportRecordMessage, storage.Message{ID: 2, Text: "hi"}))
+	require.NoError(t, ew.close())
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	require.Equal(t, `attachment; filename="user-1.ndjson"`, rr.Header().Get("Content-Disposition"))
+
+	var types []string
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var line struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		types = append(types, line.Type)
+	}
+	require.Equal(t, []string{storage.ExportRecordUser, storage.ExportRecordMessage}, types)
+}
+
+func TestZIPExport(t *testing.T) {
+	t.Parallel()
+
+	rr := httptest.NewRecorder()
+	ew := newExportWriter(rr, exportFormatZIP, 1)
+	require.NoError(t, ew.write(storage.ExportRecordUser, storage.User{ID: 1, Username: "alice"}))
+	require.NoError(t, ew.write(storage.ExportRecordChat, storage.Membership{Chat: 3}))
+	require.NoError(t, ew.write(storage.ExportRecordMessage, storage.Message{ID: 2, Text: "hi"}))
+	require.NoError(t, ew.write(storage.ExportRecordMessage, storage.Message{ID: 4, Text: "bye"}))
+	require.NoError(t, ew.close())
+
+	require.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+
+	body := rr.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	require.Equal(t, []string{"profile.json", "chats.ndjson", "messages.ndjson"}, names)
+
+	f, err := zr.File[2].Open()
+	require.NoError(t, err)
+	defer f.Close()
+	messages, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(messages, []byte("\n")))
+}
+
+func TestExportUserBadFormat(t *testing.T) {
+	t.Parallel()
+
+	public, admin := bootstrapAdminServer(t)
+
+	for _, pattern := range []string{"/users/export", "/users/delete"} {
+		req := httptest.NewRequest("POST", pattern, bytes.NewBuffer([]byte(`{"user":1,"format":"csv"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		public.ServeHTTP(rr, req)
+
+		// data of any user is exposed or destroyed by these endpoints, so they are served by admin listener only
+		require.Equal(t, http.StatusNotFound, rr.Code, pattern)
+	}
+
+	req := httptest.NewRequest("POST", "/users/export", bytes.NewBuffer([]byte(`{"user":1,"format":"csv"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
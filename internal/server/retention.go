@@ -0,0 +1,85 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/storage"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetentionSeconds is the largest "max_age" field value which fits time.Duration
+const maxRetentionSeconds = math.MaxInt64 / int64(time.Second)
+
+// setChatRetention handles HTTP requests on "/chats/retention" endpoint replacing retention settings of the chat.
+// Omitted or null "max_age" (in seconds) and "max_count" fields are inherited from the global policy,
+// zero values keep messages regardless of the corresponding global limit.
+// The endpoint is served by admin listener only, since chats have no owners to authorize the change.
+func (h *handler) setChatRetention(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.retentionPool.Get()
+	defer h.parsers.retentionPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving chat id
+	if !v.Exists("chat") {
+		http.Error(w, "Missing Field \"chat\"", http.StatusBadRequest)
+		return
+	}
+
+	chatID, err := v.Get("chat").Int64()
+	if err != nil {
+		http.Error(w, "Field \"chat\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if chatID < 1 {
+		http.Error(w, "Field \"chat\" must be a valid chat id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	settings := storage.ChatRetention{Chat: chatID}
+
+	// retrieving optional max age
+	if v.Exists("max_age") && v.Get("max_age").Type() != fastjson.TypeNull {
+		seconds, err := v.Get("max_age").Int64()
+		if err != nil || seconds < 0 {
+			http.Error(w, "Field \"max_age\" must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+
+		if seconds > maxRetentionSeconds {
+			http.Error(w, "Field \"max_age\" must not exceed "+strconv.FormatInt(maxRetentionSeconds, 10)+" seconds",
+				http.StatusBadRequest)
+			return
+		}
+		maxAge := time.Duration(seconds) * time.Second
+		settings.MaxAge = &maxAge
+	}
+
+	// retrieving optional max count
+	if v.Exists("max_count") && v.Get("max_count").Type() != fastjson.TypeNull {
+		maxCount, err := v.Get("max_count").Int()
+		if err != nil || maxCount < 0 {
+			http.Error(w, "Field \"max_count\" must be a non-negative integer value", http.StatusBadRequest)
+			return
+		}
+		settings.MaxCount = &maxCount
+	}
+
+	err = h.store.SetChatRetention(r.Context(), settings)
+	if err != nil {
+		if err == storage.ErrChatNotExist {
+			http.Error(w, "Chat with provided id does not exist", http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetChatRetentionBadLimits(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	for _, payload := range []string{`{"max_age":60}`, `{"chat":1,"max_age":-1}`, `{"chat":1,"max_count":"10"}`,
+		// about 292 years overflow time.Duration
+		`{"chat":1,"max_age":9223372037}`,
+	} {
+		req, err := http.NewRequest("POST", "/chats/retention", bytes.NewBuffer([]byte(payload)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.setChatRetention).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code, payload)
+	}
+}
@@ -1,16 +1,21 @@
 package server
 
 import (
+	"avito-trainee-assignment/internal/gql"
+	"avito-trainee-assignment/internal/retention"
 	"avito-trainee-assignment/internal/storage"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/valyala/fastjson"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // Server defines fields used in HTTP processing.
@@ -18,6 +23,18 @@ type Server struct {
 	logger        *zap.SugaredLogger
 	httpServer    *http.Server
 	afterShutdown []func()
+	janitor       *retention.Janitor
+	timeout       *requestTimeout
+	reload        func() error
+	panics        *panicCounter
+	// auxiliary are plaintext servers of HTTPS redirect and admin endpoints if they are enabled
+	auxiliary []auxServer
+}
+
+// auxServer is an auxiliary http.Server started and shut down along with the main one
+type auxServer struct {
+	name string
+	*http.Server
 }
 
 // NewServer constructs a Server. See the various Options for available customizations.
@@ -30,7 +47,16 @@ func NewServer(logger *zap.SugaredLogger, store *storage.Store, opts ...Option)
 		return nil, errors.New("no store provided")
 	}
 
-	cfg := &config{httpServer: &http.Server{}}
+	panics := &panicCounter{}
+	cfg := &config{
+		httpServer:    &http.Server{},
+		timeout:       &requestTimeout{},
+		panics:        panics,
+		tlsMinVersion: tls.VersionTLS12,
+		adminHandlers: adminHandlers(store, panics),
+		compressMin:   defaultCompressMinSize,
+		maxRequest:    defaultMaxRequestSize,
+	}
 
 	// setting application-specific default handlers
 	h := handler{
@@ -41,24 +67,73 @@ func NewServer(logger *zap.SugaredLogger, store *storage.Store, opts ...Option)
 			createMessagePool:    fastjson.ParserPool{},
 			chatsByUserIDPool:    fastjson.ParserPool{},
 			messagesByChatIDPool: fastjson.ParserPool{},
+			searchMessagesPool:   fastjson.ParserPool{},
+			markChatReadPool:     fastjson.ParserPool{},
+			createDirectChatPool: fastjson.ParserPool{},
+			threadPool:           fastjson.ParserPool{},
+			reactionPool:         fastjson.ParserPool{},
+			webhookPool:          fastjson.ParserPool{},
+			deliveriesPool:       fastjson.ParserPool{},
+			botPool:              fastjson.ParserPool{},
+			mentionsPool:         fastjson.ParserPool{},
+			retentionPool:        fastjson.ParserPool{},
+			privacyPool:          fastjson.ParserPool{},
+			auditPool:            fastjson.ParserPool{},
 		},
 	}
 
+	graphqlHandler, err := gql.NewHandler(logger, store)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create GraphQL handler: %w", err)
+	}
+
 	defaultHandlers := map[string]http.Handler{
-		"/users/add":    http.HandlerFunc(h.createUser),
-		"/chats/add":    http.HandlerFunc(h.createChat),
-		"/messages/add": http.HandlerFunc(h.createMessage),
-		"/chats/get":    http.HandlerFunc(h.chatsByUserID),
-		"/messages/get": http.HandlerFunc(h.messagesByChatID),
+		"/users/add":        http.HandlerFunc(h.createUser),
+		"/chats/add":        http.HandlerFunc(h.createChat),
+		"/chats/direct":     http.HandlerFunc(h.createDirectChat),
+		"/messages/add":     http.HandlerFunc(h.createMessage),
+		"/chats/get":        http.HandlerFunc(h.chatsByUserID),
+		"/chats/read":       http.HandlerFunc(h.markChatRead),
+		"/messages/get":     http.HandlerFunc(h.messagesByChatID),
+		"/messages/search":  http.HandlerFunc(h.searchMessages),
+		"/messages/thread":  http.HandlerFunc(h.thread),
+		"/messages/react":   http.HandlerFunc(h.react),
+		"/messages/unreact": http.HandlerFunc(h.unreact),
+		"/mentions/get":     http.HandlerFunc(h.unreadMentions),
+		"/mentions/read":    http.HandlerFunc(h.markMentionsRead),
+		"/webhooks/add":     http.HandlerFunc(h.createWebhook),
+		"/graphql":          graphqlHandler,
 	}
 
 	cfg.handlers = defaultHandlers
 
+	// endpoints changing settings beyond the reach of a single client or exposing data of any user
+	// are served by admin listener only
+	for pattern, handler := range map[string]http.Handler{
+		"/users/export":          http.HandlerFunc(h.exportUser),
+		"/users/delete":          http.HandlerFunc(h.deleteUser),
+		"/chats/retention":       http.HandlerFunc(h.setChatRetention),
+		"/admin/webhooks/add":    http.HandlerFunc(h.createGlobalWebhook),
+		"/admin/webhooks/failed": http.HandlerFunc(h.failedDeliveries),
+		"/admin/webhooks/replay": http.HandlerFunc(h.replayDelivery),
+		"/admin/audit":           http.HandlerFunc(h.auditEvents),
+		"/admin/audit/verify":    http.HandlerFunc(h.verifyAuditChain),
+	} {
+		cfg.adminHandlers[pattern] = enforcePostJson(handler)
+	}
+
 	// extending given options with mandatory
 	opts = append(
 		opts,
+		applyBots(&h),
 		applyEnforcePostJson(),
+		registerAttachmentHandlers(logger, store),
+		applyAudit(logger, store),
+		applyCompression(),
+		applyRequestTimeout(),
+		applyRecovery(logger.Desugar()),
 		applyLog(logger.Desugar()),
+		applyTracing(),
 		registerHandlers(),
 		RegisterAfterShutdown(func() {
 			store.Close()
@@ -70,24 +145,102 @@ func NewServer(logger *zap.SugaredLogger, store *storage.Store, opts ...Option)
 		o.apply(cfg)
 	}
 
+	var auxiliary []auxServer
+	if cfg.certFile != "" || cfg.keyFile != "" {
+		cfg.httpServer.TLSConfig, err = newTLSConfig(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.redirectAddr != "" {
+			auxiliary = append(auxiliary, auxServer{name: "HTTPS redirect", Server: &http.Server{
+				Addr:        cfg.redirectAddr,
+				Handler:     redirectHTTPS(cfg.httpServer.Addr),
+				ReadTimeout: cfg.httpServer.ReadTimeout,
+			}})
+		}
+	}
+
+	if cfg.adminAddr != "" {
+		mux := http.NewServeMux()
+		for pattern, h := range cfg.adminHandlers {
+			h = recovery(h, logger.Desugar(), cfg.panics, cfg.repanic)
+			mux.Handle(pattern, log(h, logger.Desugar(), 0))
+		}
+
+		// write timeout is not inherited from the main server since profiling responses take a while
+		auxiliary = append(auxiliary, auxServer{name: "admin", Server: &http.Server{
+			Addr:        cfg.adminAddr,
+			Handler:     mux,
+			ReadTimeout: cfg.httpServer.ReadTimeout,
+		}})
+	}
+
 	srv := &Server{
 		logger:        logger,
 		httpServer:    cfg.httpServer,
 		afterShutdown: cfg.afterShutdown,
+		janitor:       cfg.janitor,
+		timeout:       cfg.timeout,
+		reload:        cfg.reload,
+		panics:        cfg.panics,
+		auxiliary:     auxiliary,
 	}
 
 	return srv, nil
 }
 
-// Start calls ListenAndServe on http.Server instance inside Server struct
-// and implements graceful shutdown via goroutine waiting for signals.
+// SetRequestTimeout changes the maximum duration of handling a request, see RequestTimeout option.
+// Requests being handled keep their timeouts.
+func (s *Server) SetRequestTimeout(d time.Duration) {
+	s.timeout.store(d)
+}
+
+// Panics returns the number of handler panics recovered since the start
+func (s *Server) Panics() uint64 {
+	return s.panics.load()
+}
+
+// Start calls ListenAndServe (ListenAndServeTLS if TLS option was provided) on http.Server instance inside Server struct
+// along with auxiliary HTTPS redirect and admin servers and implements graceful shutdown of all of them
+// via goroutine waiting for signals.
+// SIGHUP reloads configuration if OnReload option was provided.
 func (s *Server) Start() error {
+	// the main listener is bound first, so nothing is left running if the address is not available
+	addr := s.httpServer.Addr
+	if addr == "" {
+		addr = ":http"
+		if s.httpServer.TLSConfig != nil {
+			addr = ":https"
+		}
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen: %v", err)
+	}
+
 	idleConnsClosed := make(chan struct{})
 
 	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM)
-		<-sigint
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		if s.reload != nil {
+			signal.Notify(signals, syscall.SIGHUP)
+		}
+
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				break
+			}
+
+			s.logger.Info("Reloading configuration")
+			if err := s.reload(); err != nil {
+				s.logger.Errorf("Configuration reload is rejected, keeping the previous one: %v", err)
+				continue
+			}
+			s.logger.Info("Configuration is reloaded")
+		}
 
 		s.logger.Info("Shutting down HTTP server")
 
@@ -96,12 +249,39 @@ func (s *Server) Start() error {
 		}
 		s.logger.Info("HTTP server is stopped")
 
+		// auxiliary servers are stopped last, so admin endpoints are available while requests are drained
+		s.shutdownAuxiliary()
+
 		close(idleConnsClosed)
 	}()
 
-	s.logger.Infof("Starting HTTP server on %s", s.httpServer.Addr)
-	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		return fmt.Errorf("s.httpServer.ListenAndServe: %v", err)
+	for _, aux := range s.auxiliary {
+		go func(aux auxServer) {
+			s.logger.Infof("Starting %s server on %s", aux.name, aux.Addr)
+			if err := aux.ListenAndServe(); err != http.ErrServerClosed {
+				s.logger.Errorf("%s server: %v", aux.name, err)
+			}
+		}(aux)
+	}
+
+	// the janitor is started once the listener is bound
+	if s.janitor != nil {
+		s.logger.Info("Starting retention janitor")
+		s.janitor.Start()
+	}
+
+	err = s.serve(ln, addr)
+
+	// the janitor is closed on any exit, including serving failures, and before afterShutdown functions
+	// which may close the store it uses
+	if s.janitor != nil {
+		s.janitor.Close()
+		s.logger.Info("Retention janitor is stopped")
+	}
+
+	if err != nil {
+		s.shutdownAuxiliary()
+		return err
 	}
 
 	<-idleConnsClosed
@@ -112,3 +292,32 @@ func (s *Server) Start() error {
 
 	return nil
 }
+
+// shutdownAuxiliary gracefully shuts down HTTPS redirect and admin servers
+func (s *Server) shutdownAuxiliary() {
+	for _, aux := range s.auxiliary {
+		if err := aux.Shutdown(context.Background()); err != nil {
+			s.logger.Errorf("%s server shutdown: %v", aux.name, err)
+		}
+		s.logger.Infof("%s server is stopped", aux.name)
+	}
+}
+
+// serve accepts connections on ln until http.Server is shut down
+func (s *Server) serve(ln net.Listener, addr string) error {
+	if s.httpServer.TLSConfig != nil {
+		s.logger.Infof("Starting HTTPS server on %s", addr)
+		// the certificate is provided by TLSConfig.GetCertificate
+		if err := s.httpServer.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+			return fmt.Errorf("s.httpServer.ServeTLS: %v", err)
+		}
+		return nil
+	}
+
+	s.logger.Infof("Starting HTTP server on %s", addr)
+	if err := s.httpServer.Serve(ln); err != http.ErrServerClosed {
+		return fmt.Errorf("s.httpServer.Serve: %v", err)
+	}
+
+	return nil
+}
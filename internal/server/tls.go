@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often certificate files are checked for changes during handshakes
+const certCheckInterval = time.Second
+
+// certificate keeps TLS certificate loaded from a pair of files and reloads it when either file changes,
+// so renewed certificates are served without a restart
+type certificate struct {
+	certFile, keyFile string
+	logger            *zap.SugaredLogger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// newCertificate loads certificate and key pair from provided PEM files
+func newCertificate(certFile, keyFile string, logger *zap.SugaredLogger) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile, logger: logger}
+
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load reads both files and replaces the current certificate, c.mu must be held unless c is being created
+func (c *certificate) load() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("cannot read TLS certificate: %w", err)
+	}
+
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read TLS key: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+
+	return nil
+}
+
+// changed reports whether either file was modified after the current certificate was loaded, c.mu must be held
+func (c *certificate) changed() bool {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false
+	}
+
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false
+	}
+
+	return !certInfo.ModTime().Equal(c.certMod) || !keyInfo.ModTime().Equal(c.keyMod)
+}
+
+// getCertificate implements tls.Config.GetCertificate. Certificate files are checked for changes
+// at most once per certCheckInterval. If changed files can not be loaded, e.g. the key is not renewed yet,
+// the previous certificate is served.
+func (c *certificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	if c.changed() {
+		if err := c.load(); err != nil {
+			c.logger.Errorf("Cannot reload TLS certificate, keeping the previous one: %v", err)
+		} else {
+			c.logger.Infof("TLS certificate is reloaded from %s", c.certFile)
+		}
+	}
+
+	return c.cert, nil
+}
+
+// newTLSConfig builds tls.Config of http.Server from TLS options with HTTP/2 enabled
+func newTLSConfig(c *config, logger *zap.SugaredLogger) (*tls.Config, error) {
+	if c.certFile == "" || c.keyFile == "" {
+		return nil, errors.New("both TLS certificate and key must be provided")
+	}
+
+	cert, err := newCertificate(c.certFile, c.keyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     c.tlsMinVersion,
+		GetCertificate: cert.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if c.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.clientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// redirectHTTPS is a handler of plaintext listener permanently redirecting requests
+// to the same host and URI on the port of httpsAddr.
+// 308 status is used, so clients repeat POST requests with the body instead of switching to GET.
+func redirectHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		// RequestURI keeps the original escaping of the path, e.g. "%2F" is not turned into a slash
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
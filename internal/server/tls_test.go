@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes self-signed certificate for localhost with provided serial number
+// and its key into dir and returns paths of both files along with the certificate in PEM format
+func writeCertificate(t *testing.T, dir string, serial int64) (string, string, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	return certFile, keyFile, certPEM
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// serialOf returns serial number of the leaf certificate
+func serialOf(t *testing.T, cert *tls.Certificate) int64 {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertificateReload(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	certFile, keyFile, _ := writeCertificate(t, dir, 1)
+
+	c, err := newCertificate(certFile, keyFile, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	cert, err := c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), serialOf(t, cert))
+
+	writeCertificate(t, dir, 2)
+	// modification times of rewritten files may be equal to the previous ones on coarse file systems
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+
+	// files are not checked again until certCheckInterval passes
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), serialOf(t, cert))
+
+	c.checked = time.Time{}
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), serialOf(t, cert))
+
+	// a broken key keeps the previous certificate
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	c.checked = time.Time{}
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), serialOf(t, cert))
+}
+
+func TestTLSConfigHTTP2AndClientCA(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	certFile, keyFile, certPEM := writeCertificate(t, dir, 1)
+
+	tlsConfig, err := newTLSConfig(&config{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		tlsMinVersion: tls.VersionTLS12,
+		// the self-signed certificate is its own CA
+		clientCAFile: certFile,
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Proto))
+		}),
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(certPEM))
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+
+	resp, err := newClient(clientCert).Get("https://" + l.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/2.0", string(body))
+
+	// clients without certificates are rejected
+	_, err = newClient().Get("https://" + l.Addr().String())
+	require.Error(t, err)
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	certFile, keyFile, _ := writeCertificate(t, dir, 1)
+
+	for _, c := range []*config{
+		{certFile: certFile},
+		{certFile: certFile, keyFile: filepath.Join(dir, "missing.pem")},
+		{certFile: keyFile, keyFile: certFile},
+		{certFile: certFile, keyFile: keyFile, clientCAFile: keyFile},
+	} {
+		_, err := newTLSConfig(c, zap.NewNop().Sugar())
+		require.Error(t, err)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		httpsAddr, host, uri, location string
+	}{
+		{"0.0.0.0:9443", "example.com:9000", "/messages/get?x=1", "https://example.com:9443/messages/get?x=1"},
+		{":443", "example.com", "/messages/get?x=1", "https://example.com/messages/get?x=1"},
+		{":443", "example.com", "/attachments/a%2Fb%20c?q=%26", "https://example.com/attachments/a%2Fb%20c?q=%26"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://"+test.host+test.uri, nil)
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		redirectHTTPS(test.httpsAddr).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusPermanentRedirect, rr.Code)
+		require.Equal(t, test.location, rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/storage"
+	"encoding/json"
+	"errors"
+	"github.com/valyala/fastjson"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultDeliveriesLimit is used when "limit" field is omitted in "/admin/webhooks/failed" request
+	defaultDeliveriesLimit = 50
+	// maxDeliveriesLimit is the maximum allowed "limit" field value in "/admin/webhooks/failed" request
+	maxDeliveriesLimit = 500
+	// minSecretLength is the minimum length of webhook secret used for signing payloads
+	minSecretLength = 16
+)
+
+// createWebhook handles HTTP requests on "/webhooks/add" endpoint subscribing url to events of a chat.
+// The url must resolve to public addresses only, so webhooks can not be used to reach internal services.
+func (h *handler) createWebhook(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.webhookPool.Get()
+	defer h.parsers.webhookPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	rawURL, secret, ok := h.parseWebhook(w, r, v)
+	if !ok {
+		return
+	}
+
+	// retrieving chat id, subscriptions to events of all chats are created on admin listener only
+	if !v.Exists("chat") {
+		http.Error(w, "Missing Field \"chat\"", http.StatusBadRequest)
+		return
+	}
+
+	chat, err := v.Get("chat").Int64()
+	if err != nil {
+		http.Error(w, "Field \"chat\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if chat < 1 {
+		http.Error(w, "Field \"chat\" must be a valid chat id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	h.storeWebhook(w, r, &chat, rawURL, secret)
+}
+
+// createGlobalWebhook handles HTTP requests on "/admin/webhooks/add" endpoint subscribing url to events of all chats
+func (h *handler) createGlobalWebhook(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.webhookPool.Get()
+	defer h.parsers.webhookPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	rawURL, secret, ok := h.parseWebhook(w, r, v)
+	if !ok {
+		return
+	}
+
+	h.storeWebhook(w, r, nil, rawURL, secret)
+}
+
+// parseWebhook retrieves "url" and "secret" fields of webhook creation request.
+// It responds with 400 status and returns false if the fields are invalid.
+func (h *handler) parseWebhook(w http.ResponseWriter, r *http.Request, v *fastjson.Value) (string, string, bool) {
+	// retrieving url
+	if !v.Exists("url") {
+		http.Error(w, "Missing Field \"url\"", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	urlValue := v.Get("url")
+	if urlValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"url\" must be a string", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	rawURL := string(urlValue.GetStringBytes())
+	err := egress.CheckURL(r.Context(), rawURL)
+	if err != nil {
+		if errors.Is(err, egress.ErrBadURL) {
+			http.Error(w, "Field \"url\" must be an absolute http or https URL", http.StatusBadRequest)
+			return "", "", false
+		}
+		// resolved addresses and resolver errors are logged only, so clients can not probe internal DNS
+		h.logger.Warnf("Rejecting webhook url %q: %v", rawURL, err)
+		http.Error(w, "Field \"url\" must point to a public address", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	// retrieving secret
+	if !v.Exists("secret") {
+		http.Error(w, "Missing Field \"secret\"", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	secretValue := v.Get("secret")
+	if secretValue.Type() != fastjson.TypeString {
+		http.Error(w, "Field \"secret\" must be a string", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	secret := string(secretValue.GetStringBytes())
+	if len(secret) < minSecretLength {
+		http.Error(w, "Field \"secret\" must have length of at least "+strconv.Itoa(minSecretLength), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return rawURL, secret, true
+}
+
+// storeWebhook creates the webhook and responds with its id, nil chat subscribes it to events of all chats
+func (h *handler) storeWebhook(w http.ResponseWriter, r *http.Request, chat *int64, rawURL, secret string) {
+	id, err := h.store.CreateWebhook(r.Context(), chat, rawURL, secret)
+	if err != nil {
+		if err == storage.ErrChatNotExist {
+			http.Error(w, "Chat with provided id does not exist", http.StatusBadRequest)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// returning id
+	payload := []byte(`{"id":` + strconv.FormatInt(id, 10) + `}`)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
+
+// failedDeliveries handles HTTP requests on "/admin/webhooks/failed" endpoint listing dead-lettered deliveries.
+// Pages are requested with "after" field set to the id of the last delivery from the previous page.
+func (h *handler) failedDeliveries(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.deliveriesPool.Get()
+	defer h.parsers.deliveriesPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving optional cursor
+	var after int64
+	if v.Exists("after") {
+		var err error
+		after, err = v.Get("after").Int64()
+		if err != nil || after < 0 {
+			http.Error(w, "Field \"after\" must be a non-negative 64-bit integer value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// retrieving optional limit
+	limit := defaultDeliveriesLimit
+	if v.Exists("limit") {
+		var err error
+		limit, err = v.Get("limit").Int()
+		if err != nil {
+			http.Error(w, "Field \"limit\" must be an integer value", http.StatusBadRequest)
+			return
+		}
+
+		if limit < 1 || limit > maxDeliveriesLimit {
+			http.Error(w, "Field \"limit\" must be in range [1, "+strconv.Itoa(maxDeliveriesLimit)+"]", http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := h.store.DeadWebhookDeliveries(r.Context(), after, limit)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	payload, err := json.Marshal(deliveries)
+	if err != nil {
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(payload)
+	if err != nil {
+		h.logger.Errorf("writing marshaled data to ResponseWriter: %v", err)
+	}
+}
+
+// replayDelivery handles HTTP requests on "/admin/webhooks/replay" endpoint moving dead-lettered delivery back to queue
+func (h *handler) replayDelivery(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	parser := h.parsers.deliveriesPool.Get()
+	defer h.parsers.deliveriesPool.Put(parser)
+	v, _ := parser.ParseBytes(body)
+
+	// retrieving delivery id
+	if !v.Exists("id") {
+		http.Error(w, "Missing Field \"id\"", http.StatusBadRequest)
+		return
+	}
+
+	id, err := v.Get("id").Int64()
+	if err != nil {
+		http.Error(w, "Field \"id\" must be a 64-bit integer value", http.StatusBadRequest)
+		return
+	}
+
+	if id < 1 {
+		http.Error(w, "Field \"id\" must be a valid delivery id grater than zero", http.StatusBadRequest)
+		return
+	}
+
+	err = h.store.ReplayWebhookDelivery(r.Context(), id)
+	if err != nil {
+		if err == storage.ErrDeliveryNotExist {
+			http.Error(w, "Dead delivery with provided id does not exist", http.StatusNotFound)
+			return
+		}
+		h.logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/storage"
+	mytesting "avito-trainee-assignment/internal/testing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	userID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+
+	payload := bytes.NewBuffer([]byte(`{"url":"https://93.184.216.34/hook","secret":"0123456789abcdef","chat":` +
+		strconv.FormatInt(chatID, 10) + `}`))
+	req, err := http.NewRequest("POST", "/webhooks/add", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.createWebhook).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusCreated, rr.Code)
+}
+
+func TestCreateWebhook_BadURL(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	for _, u := range []string{
+		"ftp://example.com",
+		"/relative",
+		"https://",
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/hook",
+	} {
+		payload := bytes.NewBuffer([]byte(`{"url":"` + u + `","secret":"0123456789abcdef"}`))
+		req, err := http.NewRequest("POST", "/webhooks/add", payload)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.createWebhook).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code, u)
+		// resolved addresses are not disclosed to clients
+		require.NotContains(t, rr.Body.String(), egress.ErrNotPublic.Error(), u)
+	}
+}
+
+func TestCreateWebhook_NoChat(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"url":"https://93.184.216.34/hook","secret":"0123456789abcdef"}`))
+	req, err := http.NewRequest("POST", "/webhooks/add", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.createWebhook).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestCreateGlobalWebhook(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	payload := bytes.NewBuffer([]byte(`{"url":"https://93.184.216.34/` + mytesting.RandString() +
+		`","secret":"0123456789abcdef"}`))
+	req, err := http.NewRequest("POST", "/admin/webhooks/add", payload)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.createGlobalWebhook).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+
+	userID, err := h.store.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chats := make(map[int64]bool)
+	for i := 0; i < 2; i++ {
+		chatID, err := h.store.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+		require.NoError(t, err)
+		_, err = h.store.CreateMessage(context.Background(), chatID, userID, mytesting.RandString())
+		require.NoError(t, err)
+		chats[chatID] = false
+	}
+
+	// deliveries of parallel tests may be claimed as well, the short lease returns them to the queue at once
+	received := 0
+	for received < len(chats) {
+		deliveries, err := h.store.ClaimWebhookDeliveries(context.Background(), 100, time.Millisecond)
+		require.NoError(t, err)
+		require.NotEmpty(t, deliveries)
+
+		for _, d := range deliveries {
+			if d.Webhook != created.ID {
+				continue
+			}
+
+			var event struct {
+				Message storage.Message `json:"message"`
+			}
+			require.NoError(t, json.Unmarshal(d.Payload, &event))
+			seen, ok := chats[event.Message.Chat]
+			require.True(t, ok)
+			if !seen {
+				chats[event.Message.Chat] = true
+				received++
+			}
+			require.NoError(t, h.store.MarkWebhookDelivered(context.Background(), d.ID))
+		}
+	}
+}
+
+func TestReplayDelivery_NotExist(t *testing.T) {
+	t.Parallel()
+
+	h := bootstrapHandler(t)
+
+	req, err := http.NewRequest("POST", "/admin/webhooks/replay", bytes.NewBuffer([]byte(`{"id":9223372036854775807}`)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.replayDelivery).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
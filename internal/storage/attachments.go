@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+var (
+	ErrAttachmentNotExist = errors.New("attachment does not exist")
+	ErrBadAttachments     = errors.New("bad attachments list")
+)
+
+// CheckChatMember returns nil if both chat and user exist and the user is a member of the chat
+func (s *Store) CheckChatMember(ctx context.Context, chat, user int64) (err error) {
+	ctx, span := s.startSpan(ctx, "CheckChatMember")
+	defer endSpan(span, &err)
+
+	// check if chat exists
+	var i int8
+	sql := "select 1 from chats where id = $1"
+	err = s.db.QueryRow(ctx, sql, chat).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrChatNotExist
+		}
+		return err
+	}
+
+	// check if user exists
+	sql = "select 1 from users where id = $1"
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		return err
+	}
+
+	sql = "select 1 from chat_users where chat_id = $1 and user_id = $2"
+	err = s.db.QueryRow(ctx, sql, chat, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotChatMember
+		}
+		return err
+	}
+
+	return nil
+}
+
+// CreateAttachment stores metadata of an uploaded blob and returns attachment id.
+// ID, Message and CreatedAt fields of provided attachment are ignored.
+func (s *Store) CreateAttachment(ctx context.Context, a Attachment) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "CreateAttachment")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Creating attachment (%s) from user (id: %d) in chat (id: %d)", a.Filename, a.Uploader, a.Chat)
+
+	var id int64
+	sql := `insert into attachments (chat_id, uploader_id, filename, content_type, size, checksum, blob_key, created_at)
+		    values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+	err = s.db.QueryRow(ctx, sql, a.Chat, a.Uploader, a.Filename, a.ContentType, a.Size, a.Checksum, a.BlobKey, time.Now()).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return 0, ErrUserNotChatMember
+		}
+		return 0, err
+	}
+
+	s.logger.Debugf("Created attachment with id %d", id)
+
+	return id, nil
+}
+
+// AttachmentByID returns attachment metadata if provided user is a member of the attachment chat
+func (s *Store) AttachmentByID(ctx context.Context, id, user int64) (_ Attachment, err error) {
+	ctx, span := s.startSpan(ctx, "AttachmentByID")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving attachment (id: %d) for user (id: %d)", id, user)
+
+	var a Attachment
+	sql := `select id,
+				   chat_id,
+				   uploader_id,
+				   message_id,
+				   filename,
+				   content_type,
+				   size,
+				   checksum,
+				   blob_key,
+				   created_at,
+				   thumbnail_error
+			  from attachments
+			 where id = $1`
+	err = s.db.QueryRow(ctx, sql, id).Scan(
+		&a.ID, &a.Chat, &a.Uploader, &a.Message, &a.Filename, &a.ContentType, &a.Size, &a.Checksum, &a.BlobKey, &a.CreatedAt,
+		&a.ThumbnailError,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Attachment{}, ErrAttachmentNotExist
+		}
+		return Attachment{}, err
+	}
+
+	var i int8
+	sql = "select 1 from chat_users where chat_id = $1 and user_id = $2"
+	err = s.db.QueryRow(ctx, sql, a.Chat, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Attachment{}, ErrUserNotChatMember
+		}
+		return Attachment{}, err
+	}
+
+	sql = `select size, width, height, content_type, blob_key
+			 from attachment_thumbnails
+			where attachment_id = $1
+			order by size`
+	rows, err := s.db.Query(ctx, sql, a.ID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Thumbnail
+		err = rows.Scan(&t.Size, &t.Width, &t.Height, &t.ContentType, &t.BlobKey)
+		if err != nil {
+			return Attachment{}, err
+		}
+		a.Thumbnails = append(a.Thumbnails, t)
+	}
+
+	if rows.Err() != nil {
+		return Attachment{}, rows.Err()
+	}
+
+	return a, nil
+}
+
+// CreateThumbnail stores metadata of a generated thumbnail, storing the same size twice replaces previous one
+func (s *Store) CreateThumbnail(ctx context.Context, attachment int64, t Thumbnail) (err error) {
+	ctx, span := s.startSpan(ctx, "CreateThumbnail")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Creating %dpx thumbnail for attachment (id: %d)", t.Size, attachment)
+
+	sql := `insert into attachment_thumbnails (attachment_id, size, width, height, content_type, blob_key, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			    on conflict (attachment_id, size) do update
+			   set width = excluded.width,
+				   height = excluded.height,
+				   content_type = excluded.content_type,
+				   blob_key = excluded.blob_key,
+				   created_at = excluded.created_at`
+	_, err = s.db.Exec(ctx, sql, attachment, t.Size, t.Width, t.Height, t.ContentType, t.BlobKey, time.Now())
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return ErrAttachmentNotExist
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SetThumbnailError records why thumbnails of provided attachment could not be generated
+func (s *Store) SetThumbnailError(ctx context.Context, attachment int64, reason string) (err error) {
+	ctx, span := s.startSpan(ctx, "SetThumbnailError")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Recording thumbnail failure for attachment (id: %d): %s", attachment, reason)
+
+	sql := "update attachments set thumbnail_error = $2 where id = $1"
+	tag, err := s.db.Exec(ctx, sql, attachment, reason)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrAttachmentNotExist
+	}
+
+	return nil
+}
+
+// linkAttachments links attachments to a message inside provided transaction.
+// It fails with ErrBadAttachments if any attachment is missing, already linked, uploaded by another user
+// or into another chat.
+func linkAttachments(ctx context.Context, tx pgx.Tx, message, chat, author int64, ids []int64) error {
+	unique := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		unique[id] = struct{}{}
+	}
+
+	sql := `update attachments
+			   set message_id = $1
+			 where id = any($2)
+			   and chat_id = $3
+			   and uploader_id = $4
+			   and message_id is null`
+	tag, err := tx.Exec(ctx, sql, message, ids, chat, author)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() != int64(len(unique)) {
+		return ErrBadAttachments
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"avito-trainee-assignment/internal/storage/zapadapter"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAuditChainBroken is wrapped by errors reporting the first audit event which does not match the hash chain
+var ErrAuditChainBroken = errors.New("audit chain is broken")
+
+// Audit event outcomes
+const (
+	AuditOutcomeSuccess  = "success"
+	AuditOutcomeRejected = "rejected"
+	AuditOutcomeError    = "error"
+)
+
+// Actions recorded by the store itself in the same transaction as the audited change
+const (
+	AuditUserExported = "user.exported"
+	AuditUserDeleted  = "user.deleted"
+)
+
+// auditLockKey is the advisory lock key serializing appends to the audit hash chain
+const auditLockKey = 0x61756469
+
+// auditGenesisHash is the previous hash of the first audit event
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// AuditFilter defines optional conditions of AuditEvents query, zero fields match all events
+type AuditFilter struct {
+	ClaimedActor *int64
+	Target       string
+	From         *time.Time
+	To           *time.Time
+	// After is the id of the last event of the previous page
+	After int64
+	Limit int
+}
+
+// hashAuditEvent returns hex-encoded SHA-256 of the previous hash followed by canonical JSON of the event
+func hashAuditEvent(e AuditEvent) (string, error) {
+	canonical, err := json.Marshal(struct {
+		ID               int64   `json:"id"`
+		ClaimedActor     *int64  `json:"claimed_actor"`
+		Action           string  `json:"action"`
+		Target           string  `json:"target"`
+		ClaimedRequestID *string `json:"claimed_request_id"`
+		Outcome          string  `json:"outcome"`
+		CreatedAt        string  `json:"created_at"`
+	}{
+		ID:               e.ID,
+		ClaimedActor:     e.ClaimedActor,
+		Action:           e.Action,
+		Target:           e.Target,
+		ClaimedRequestID: e.ClaimedRequestID,
+		Outcome:          e.Outcome,
+		CreatedAt:        e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(e.PrevHash))
+	h.Write(canonical)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// auditActorKey is the context key of the actor claimed by the client
+type auditActorKey struct{}
+
+// NewContextWithClaimedActor returns context carrying the user id claimed by the client. It is recorded by audit
+// events which the store appends itself, e.g. by DeleteUser.
+func NewContextWithClaimedActor(ctx context.Context, actor int64) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// UserTarget formats audit event target referring to the user
+func UserTarget(user int64) string {
+	return "user:" + strconv.FormatInt(user, 10)
+}
+
+// RecordAuditEvent appends event to the audit log and returns its id.
+// ID, PrevHash, Hash and CreatedAt fields of provided event are ignored.
+func (s *Store) RecordAuditEvent(ctx context.Context, e AuditEvent) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "RecordAuditEvent")
+	defer endSpan(span, &err)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	id, err := insertAuditEvent(ctx, tx, e)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// insertAuditEvent appends event to the hash chain inside provided transaction.
+// Appends are serialized by an advisory lock held until the transaction ends, so ids follow the chain order.
+// Missing claimed actor and request id are taken from the context if there are ones.
+func insertAuditEvent(ctx context.Context, tx pgx.Tx, e AuditEvent) (int64, error) {
+	if actor, ok := ctx.Value(auditActorKey{}).(int64); ok && e.ClaimedActor == nil {
+		e.ClaimedActor = &actor
+	}
+	if id, ok := zapadapter.IDFromContext(ctx); ok && e.ClaimedRequestID == nil {
+		e.ClaimedRequestID = &id
+	}
+
+	_, err := tx.Exec(ctx, "select pg_advisory_xact_lock($1)", auditLockKey)
+	if err != nil {
+		return 0, err
+	}
+
+	sql := "select hash from audit_events order by id desc limit 1"
+	err = tx.QueryRow(ctx, sql).Scan(&e.PrevHash)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, err
+		}
+		e.PrevHash = auditGenesisHash
+	}
+
+	err = tx.QueryRow(ctx, "select nextval('audit_events_id_seq')").Scan(&e.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Postgres keeps microseconds, so the hashed time must be truncated to match the stored one
+	e.CreatedAt = time.Now().Truncate(time.Microsecond)
+	e.Hash, err = hashAuditEvent(e)
+	if err != nil {
+		return 0, err
+	}
+
+	sql = `insert into audit_events (id, claimed_actor_id, action, target, claimed_request_id, outcome, prev_hash,
+									 hash, created_at)
+		   values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err = tx.Exec(ctx, sql, e.ID, e.ClaimedActor, e.Action, e.Target, e.ClaimedRequestID, e.Outcome, e.PrevHash,
+		e.Hash, e.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.ID, nil
+}
+
+// AuditEvents returns audit events matching provided filter sorted by id (from oldest to latest)
+func (s *Store) AuditEvents(ctx context.Context, f AuditFilter) (_ []AuditEvent, err error) {
+	ctx, span := s.startSpan(ctx, "AuditEvents")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving audit events after id %d", f.After)
+
+	var target *string
+	if f.Target != "" {
+		target = &f.Target
+	}
+
+	sql := `select id, claimed_actor_id, action, target, claimed_request_id, outcome, prev_hash, hash, created_at
+			  from audit_events
+			 where id > $1
+			   and ($2::bigint is null or claimed_actor_id = $2)
+			   and ($3::text is null or target = $3)
+			   and ($4::timestamptz is null or created_at >= $4)
+			   and ($5::timestamptz is null or created_at < $5)
+			 order by id
+			 limit $6`
+	rows, err := s.db.Query(ctx, sql, f.After, f.ClaimedActor, target, f.From, f.To, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]AuditEvent, 0)
+	for rows.Next() {
+		var e AuditEvent
+		err = rows.Scan(&e.ID, &e.ClaimedActor, &e.Action, &e.Target, &e.ClaimedRequestID, &e.Outcome, &e.PrevHash,
+			&e.Hash, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return events, nil
+}
+
+// VerifyAuditChain recomputes hashes of all audit events and returns the number of verified ones.
+// The returned error wraps ErrAuditChainBroken if an event was modified, deleted or inserted out of the chain.
+func (s *Store) VerifyAuditChain(ctx context.Context) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "VerifyAuditChain")
+	defer endSpan(span, &err)
+
+	s.logger.Debug("Verifying audit chain")
+
+	sql := `select id, claimed_actor_id, action, target, claimed_request_id, outcome, prev_hash, hash, created_at
+			  from audit_events
+			 order by id`
+	rows, err := s.db.Query(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	prevHash := auditGenesisHash
+	for rows.Next() {
+		var e AuditEvent
+		err = rows.Scan(&e.ID, &e.ClaimedActor, &e.Action, &e.Target, &e.ClaimedRequestID, &e.Outcome, &e.PrevHash,
+			&e.Hash, &e.CreatedAt)
+		if err != nil {
+			return n, err
+		}
+
+		if e.PrevHash != prevHash {
+			return n, fmt.Errorf("%w: event (id: %d) does not follow the previous one", ErrAuditChainBroken, e.ID)
+		}
+
+		hash, err := hashAuditEvent(e)
+		if err != nil {
+			return n, err
+		}
+
+		if hash != e.Hash {
+			return n, fmt.Errorf("%w: event (id: %d) does not match its hash", ErrAuditChainBroken, e.ID)
+		}
+
+		prevHash = e.Hash
+		n++
+	}
+
+	if rows.Err() != nil {
+		return n, rows.Err()
+	}
+
+	return n, nil
+}
@@ -0,0 +1,191 @@
+package storage
+
+import "context"
+
+// UsersByIDs returns users with provided ids in a single query. The order of returned users is not specified
+// and ids which do not exist are silently skipped.
+func (s *Store) UsersByIDs(ctx context.Context, ids []int64) (_ []User, err error) {
+	ctx, span := s.startSpan(ctx, "UsersByIDs")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving users by ids (%v)", ids)
+
+	sql := `select id,
+				   trim(username),
+				   type,
+				   created_at
+			  from users
+			 where id = any($1)`
+
+	rows, err := s.db.Query(ctx, sql, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := make([]User, 0, len(ids))
+	for rows.Next() {
+		var u User
+		err = rows.Scan(&u.ID, &u.Username, &u.Type, &u.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return users, nil
+}
+
+// ChatsByIDs returns chats with provided ids in a single query. Users field of each returned chat is left empty,
+// use MemberIDsByChatIDs to resolve chat members. The order of returned chats is not specified
+// and ids which do not exist are silently skipped.
+func (s *Store) ChatsByIDs(ctx context.Context, ids []int64) (_ []Chat, err error) {
+	ctx, span := s.startSpan(ctx, "ChatsByIDs")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving chats by ids (%v)", ids)
+
+	sql := `select id,
+				   trim(name),
+				   type,
+				   created_at
+			  from chats
+			 where id = any($1)`
+
+	rows, err := s.db.Query(ctx, sql, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	chats := make([]Chat, 0, len(ids))
+	for rows.Next() {
+		var c Chat
+		err = rows.Scan(&c.ID, &c.Name, &c.Type, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, c)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return chats, nil
+}
+
+// MemberIDsByChatIDs returns ids of chat members grouped by chat id in a single query
+func (s *Store) MemberIDsByChatIDs(ctx context.Context, chats []int64) (_ map[int64][]int64, err error) {
+	ctx, span := s.startSpan(ctx, "MemberIDsByChatIDs")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving members for chats (%v)", chats)
+
+	sql := `select chat_id,
+				   user_id
+			  from chat_users
+			 where chat_id = any($1)
+			 order by chat_id, user_id`
+
+	return s.groupIDs(ctx, sql, chats)
+}
+
+// ChatIDsByUserIDs returns ids of chats grouped by member id in a single query
+func (s *Store) ChatIDsByUserIDs(ctx context.Context, users []int64) (_ map[int64][]int64, err error) {
+	ctx, span := s.startSpan(ctx, "ChatIDsByUserIDs")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving chats for users (%v)", users)
+
+	sql := `select user_id,
+				   chat_id
+			  from chat_users
+			 where user_id = any($1)
+			 order by user_id, chat_id`
+
+	return s.groupIDs(ctx, sql, users)
+}
+
+// groupIDs executes sql with ids as the only argument and groups the second column of each row by the first one
+func (s *Store) groupIDs(ctx context.Context, sql string, ids []int64) (map[int64][]int64, error) {
+	rows, err := s.db.Query(ctx, sql, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	grouped := make(map[int64][]int64, len(ids))
+	for rows.Next() {
+		var key, value int64
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		grouped[key] = append(grouped[key], value)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return grouped, nil
+}
+
+// LatestMessagesByChatIDs returns up to limit latest messages of each provided chat in a single query.
+// Messages are grouped by chat id and sorted by creation time (from earliest to latest) inside each group.
+func (s *Store) LatestMessagesByChatIDs(ctx context.Context, chats []int64, limit int) (_ map[int64][]Message, err error) {
+	ctx, span := s.startSpan(ctx, "LatestMessagesByChatIDs")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving %d latest messages for chats (%v)", limit, chats)
+
+	sql := `select latest.id,
+				   latest.chat_id,
+				   latest.author_id,
+				   latest.text,
+				   latest.created_at
+			  from unnest($1::bigint[]) as requested(chat_id)
+			 cross join lateral (
+				select messages.id,
+					   messages.chat_id,
+					   messages.author_id,
+					   messages.text,
+					   messages.created_at
+				  from messages
+				 where messages.chat_id = requested.chat_id
+				 order by messages.created_at desc
+				 limit $2
+			 ) as latest
+			 order by latest.chat_id, latest.created_at asc`
+
+	rows, err := s.db.Query(ctx, sql, chats, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	messages := make(map[int64][]Message, len(chats))
+	for rows.Next() {
+		var m Message
+		err = rows.Scan(&m.ID, &m.Chat, &m.Author, &m.Text, &m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages[m.Chat] = append(messages[m.Chat], m)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// CreateBot creates a bot user along with its settings and returns the user id.
+// ID and CreatedAt fields of provided bot are ignored.
+func (s *Store) CreateBot(ctx context.Context, b Bot) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "CreateBot")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Creating bot (%s)", b.Username)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var id int64
+	createdAt := time.Now()
+	sql := "insert into users (username, type, created_at) values ($1, $2, $3) returning id"
+	err = tx.QueryRow(ctx, sql, b.Username, UserTypeBot, createdAt).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return 0, ErrUserExists
+		}
+		return 0, err
+	}
+
+	sql = `insert into bots (user_id, callback_url, secret, commands, rate_limit, timeout_ms, created_at)
+		   values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = tx.Exec(ctx, sql, id, b.CallbackURL, b.Secret, b.Commands, b.RateLimit, b.Timeout, createdAt)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	s.logger.Debugf("Created bot (%s) with id %d", b.Username, id)
+
+	return id, nil
+}
+
+// EnsureBot returns id of the bot with provided username creating it with provided settings if it does not exist.
+// Settings of existing bot are updated. It fails with ErrUserExists if the username belongs to a human.
+func (s *Store) EnsureBot(ctx context.Context, b Bot) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "EnsureBot")
+	defer endSpan(span, &err)
+
+	var id int64
+	var userType string
+	sql := "select id, type from users where username = $1"
+	err = s.db.QueryRow(ctx, sql, b.Username).Scan(&id, &userType)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, err
+		}
+
+		id, err = s.CreateBot(ctx, b)
+		if !errors.Is(err, ErrUserExists) {
+			return id, err
+		}
+
+		// the bot was created concurrently
+		err = s.db.QueryRow(ctx, sql, b.Username).Scan(&id, &userType)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if userType != UserTypeBot {
+		return 0, ErrUserExists
+	}
+
+	sql = `update bots
+			  set callback_url = $2,
+				  secret = $3,
+				  commands = $4,
+				  rate_limit = $5,
+				  timeout_ms = $6
+			where user_id = $1`
+	_, err = s.db.Exec(ctx, sql, id, b.CallbackURL, b.Secret, b.Commands, b.RateLimit, b.Timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// CallbackBots returns all bots served by HTTP callbacks
+func (s *Store) CallbackBots(ctx context.Context) (_ []Bot, err error) {
+	ctx, span := s.startSpan(ctx, "CallbackBots")
+	defer endSpan(span, &err)
+
+	s.logger.Debug("Retrieving callback bots")
+
+	sql := `select users.id,
+				   trim(users.username),
+				   bots.callback_url,
+				   bots.secret,
+				   bots.commands,
+				   bots.rate_limit,
+				   bots.timeout_ms,
+				   bots.created_at
+			  from bots
+			  join users on users.id = bots.user_id
+			 where bots.callback_url is not null
+			 order by users.id`
+	rows, err := s.db.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := make([]Bot, 0)
+	for rows.Next() {
+		var b Bot
+		err = rows.Scan(&b.ID, &b.Username, &b.CallbackURL, &b.Secret, &b.Commands, &b.RateLimit, &b.Timeout, &b.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, b)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return bots, nil
+}
@@ -2,21 +2,136 @@ package storage
 
 import (
 	"github.com/jackc/pgx/v4/pgxpool"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"time"
 )
 
-// Option alters the default configuration of the pgxpool.Config used during new Store construction
+const (
+	// defaultSearchLanguage is a text search configuration used by SearchMessages unless SearchLanguage option is provided
+	defaultSearchLanguage = "english"
+	// defaultPreviewLength is a number of characters kept in last message preview unless PreviewLength option is provided
+	defaultPreviewLength = 100
+)
+
+// Option alters the default configuration used during new Store construction
 type Option interface {
-	apply(*pgxpool.Config)
+	apply(*config)
 }
 
-type optionFunc func(c *pgxpool.Config)
+type optionFunc func(c *config)
 
-func (f optionFunc) apply(c *pgxpool.Config) { f(c) }
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Store instance
+type config struct {
+	pool           *pgxpool.Config
+	searchLanguage string
+	previewLength  int
+	queryLogger    *zap.Logger
+	tracerProvider trace.TracerProvider
+}
 
 // ConnectionTimeout sets timeout for connection to be established
 func ConnectionTimeout(d time.Duration) Option {
-	return optionFunc(func(c *pgxpool.Config) {
-		c.ConnConfig.ConnectTimeout = d
+	return optionFunc(func(c *config) {
+		c.pool.ConnConfig.ConnectTimeout = d
+	})
+}
+
+// Endpoint sets Postgres server host and port overriding PGHOST and PGPORT environment variables
+func Endpoint(host string, port uint16) Option {
+	return optionFunc(func(c *config) {
+		c.pool.ConnConfig.Host = host
+		c.pool.ConnConfig.Port = port
+		// fallbacks (e.g. non-TLS connection for sslmode=prefer) are parsed with the default endpoint
+		for _, f := range c.pool.ConnConfig.Fallbacks {
+			f.Host = host
+			f.Port = port
+		}
+	})
+}
+
+// Database sets database name overriding PGDATABASE environment variable
+func Database(name string) Option {
+	return optionFunc(func(c *config) {
+		c.pool.ConnConfig.Database = name
+	})
+}
+
+// Credentials sets user and password overriding PGUSER and PGPASSWORD environment variables
+func Credentials(user, password string) Option {
+	return optionFunc(func(c *config) {
+		c.pool.ConnConfig.User = user
+		c.pool.ConnConfig.Password = password
+	})
+}
+
+// MaxConns sets the maximum size of connection pool
+func MaxConns(n int32) Option {
+	return optionFunc(func(c *config) {
+		c.pool.MaxConns = n
+	})
+}
+
+// QueryLogger sets logger used by pgx for queries and connection events instead of Store logger,
+// so they can be logged with a different level
+func QueryLogger(logger *zap.Logger) Option {
+	return optionFunc(func(c *config) {
+		c.queryLogger = logger
+	})
+}
+
+// TracerProvider sets provider of tracers recording spans of Store methods and executed queries
+// instead of the global one
+func TracerProvider(tp trace.TracerProvider) Option {
+	return optionFunc(func(c *config) {
+		c.tracerProvider = tp
+	})
+}
+
+// SearchLanguage sets Postgres text search configuration (e.g. "english", "russian", "simple")
+// used to build message search vectors and to parse search queries.
+// Search vectors of already stored messages are not rebuilt when the language changes.
+func SearchLanguage(lang string) Option {
+	return optionFunc(func(c *config) {
+		c.searchLanguage = lang
+	})
+}
+
+// PreviewLength sets the maximum number of characters of the last message text embedded in chat listings
+func PreviewLength(n int) Option {
+	return optionFunc(func(c *config) {
+		c.previewLength = n
+	})
+}
+
+// MessageOption sets optional fields of a message created by CreateMessage
+type MessageOption interface {
+	apply(*messageConfig)
+}
+
+type messageOptionFunc func(c *messageConfig)
+
+func (f messageOptionFunc) apply(c *messageConfig) { f(c) }
+
+// messageConfig defines optional fields of a new message
+type messageConfig struct {
+	replyTo     *int64
+	attachments []int64
+}
+
+// ReplyTo makes a new message a reply to the message with provided id which must belong to the same chat
+func ReplyTo(message int64) MessageOption {
+	return messageOptionFunc(func(c *messageConfig) {
+		c.replyTo = &message
+	})
+}
+
+// WithAttachments links previously uploaded attachments to a new message.
+// Each attachment must be uploaded by the message author into the same chat and not linked to another message.
+func WithAttachments(ids ...int64) MessageOption {
+	return messageOptionFunc(func(c *messageConfig) {
+		c.attachments = append(c.attachments, ids...)
 	})
 }
@@ -1,27 +1,224 @@
 package storage
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // User defines database user model and json tags for marshaling
 type User struct {
 	ID        int64     `json:"id"`
 	Username  string    `json:"username"`
+	Type      string    `json:"type"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// Chat defines database chat model and json tags for marshaling
+const (
+	UserTypeHuman = "human"
+	UserTypeBot   = "bot"
+)
+
+// Bot defines database bot model and json tags for marshaling.
+// ID is the id of the bot user authoring replies. Bots without CallbackURL are served by Go handlers.
+type Bot struct {
+	ID          int64     `json:"id"`
+	Username    string    `json:"username"`
+	CallbackURL *string   `json:"callback_url"`
+	Secret      string    `json:"-"`
+	Commands    []string  `json:"commands"`
+	RateLimit   int       `json:"rate_limit"`
+	Timeout     int       `json:"timeout_ms"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Chat types stored in chats.type column
+const (
+	ChatTypeGroup  = "group"
+	ChatTypeDirect = "direct"
+)
+
+// Chat defines database chat model and json tags for marshaling.
+// UnreadCount and LastReadMessageID are relative to the user chats are requested for.
 type Chat struct {
+	ID                int64     `json:"id"`
+	Name              string    `json:"name"`
+	Type              string    `json:"type"`
+	Users             []User    `json:"users"`
+	CreatedAt         time.Time `json:"created_at"`
+	UnreadCount       int64     `json:"unread_count"`
+	LastReadMessageID *int64    `json:"last_read_message_id"`
+	LastMessage       *Preview  `json:"last_message,omitempty"`
+}
+
+// Preview defines the last chat message with text cut to configured length
+type Preview struct {
 	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Users     []User    `json:"users"`
+	Author    int64     `json:"author"`
+	Text      string    `json:"text"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
 // Message defines database message model and json tags for marshaling
 type Message struct {
+	ID          int64               `json:"id"`
+	Chat        int64               `json:"chat"`
+	Author      int64               `json:"author"`
+	Text        string              `json:"text"`
+	ReplyTo     *int64              `json:"reply_to_message_id"`
+	ReplyCount  int64               `json:"reply_count"`
+	Reactions   map[string]Reaction `json:"reactions,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+}
+
+// Reaction defines aggregated reactions with the same emoji on a message.
+// Reacted reports whether the user messages are requested for is among reacted ones.
+type Reaction struct {
+	Count   int64 `json:"count"`
+	Reacted bool  `json:"reacted"`
+}
+
+// SearchResult defines a message found by full-text search along with its rank and highlighted snippet.
+// Snippet is HTML: the message text is escaped and matches are wrapped in <b> tags.
+type SearchResult struct {
+	Message
+	Snippet string  `json:"snippet"`
+	Rank    float32 `json:"rank"`
+}
+
+// Mention defines a message mentioning the user along with the name of the chat it was posted to
+type Mention struct {
+	Message
+	ChatName string `json:"chat_name"`
+}
+
+// RetentionPolicy limits how long messages of a chat are kept, zero fields mean no limit
+type RetentionPolicy struct {
+	// MaxAge is the maximum age of kept messages
+	MaxAge time.Duration
+	// MaxCount is the maximum number of the latest messages kept
+	MaxCount int
+}
+
+// ChatRetention defines per-chat retention settings. Nil fields are inherited from the global policy,
+// zero fields disable the corresponding global limit for the chat.
+type ChatRetention struct {
+	Chat     int64
+	MaxAge   *time.Duration
+	MaxCount *int
+}
+
+// RetentionTarget defines a chat along with its effective retention policy
+type RetentionTarget struct {
+	Chat   int64
+	Policy RetentionPolicy
+}
+
+// Purge defines the result of purging a batch of expired messages.
+// BlobKeys lists blobs of deleted attachments and their thumbnails, they are left for the caller to delete.
+type Purge struct {
+	Messages    int64
+	Attachments int64
+	BlobKeys    []string
+}
+
+// Attachment defines database attachment model and json tags for marshaling.
+// Message is nil until the attachment is linked to a message with WithAttachments option.
+type Attachment struct {
+	ID          int64     `json:"id"`
+	Chat        int64     `json:"chat"`
+	Uploader    int64     `json:"uploader"`
+	Message     *int64    `json:"message"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+	BlobKey     string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Thumbnails are generated in background after upload of an image, so they may appear later
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+	// ThumbnailError describes why thumbnails could not be generated
+	ThumbnailError *string `json:"thumbnail_error,omitempty"`
+}
+
+// Thumbnail is a downscaled copy of an image attachment fitting into Size x Size square
+type Thumbnail struct {
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	BlobKey     string `json:"-"`
+}
+
+// Webhook defines database webhook subscription model and json tags for marshaling.
+// Chat is nil for global subscriptions receiving events of all chats.
+type Webhook struct {
 	ID        int64     `json:"id"`
+	Chat      *int64    `json:"chat"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusDead      = "dead"
+)
+
+// WebhookDelivery defines database model of a single event delivery attempt series to a webhook.
+// URL and Secret are copied from the webhook when the delivery is claimed for sending.
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	Webhook       int64           `json:"webhook"`
+	URL           string          `json:"url"`
+	Secret        string          `json:"-"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     *string         `json:"last_error"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// OutboxEvent defines database model of a domain event waiting to be published
+type OutboxEvent struct {
+	ID          int64           `json:"id"`
+	Aggregate   string          `json:"aggregate"`
+	AggregateID int64           `json:"aggregate_id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// AuditEvent defines database audit event model and json tags for marshaling.
+// ClaimedActor and ClaimedRequestID are supplied by the client or a proxy in front of the service and are not
+// verified, they are nil when nothing is claimed. Hash covers all other fields and PrevHash,
+// which is the hash of the previous event, so modification of any event breaks the chain.
+type AuditEvent struct {
+	ID               int64     `json:"id"`
+	ClaimedActor     *int64    `json:"claimed_actor"`
+	Action           string    `json:"action"`
+	Target           string    `json:"target"`
+	ClaimedRequestID *string   `json:"claimed_request_id"`
+	Outcome          string    `json:"outcome"`
+	PrevHash         string    `json:"prev_hash"`
+	Hash             string    `json:"hash"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// Export record kinds passed to the callback of ExportUser
+const (
+	ExportRecordUser    = "user"
+	ExportRecordChat    = "chat"
+	ExportRecordMessage = "message"
+)
+
+// Membership defines a chat the user is a member of as it is exported by ExportUser
+type Membership struct {
 	Chat      int64     `json:"chat"`
-	Author    int64     `json:"author"`
-	Text      string    `json:"text"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
 	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mentionRe matches "@username" which is not a part of a word or an email address
+var mentionRe = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@([\p{L}\p{N}_][\p{L}\p{N}_.\-]*)`)
+
+// ParseMentions returns distinct usernames mentioned in text as "@username" in order of appearance.
+// Trailing dots and dashes are treated as punctuation and are not included in usernames.
+func ParseMentions(text string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, match := range mentionRe.FindAllStringSubmatch(text, -1) {
+		username := strings.TrimRight(match[1], ".-")
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+
+	return usernames
+}
+
+// insertMentions stores mentions of chat members found in message text.
+// Usernames of non-members and of the author are ignored.
+func insertMentions(ctx context.Context, tx pgx.Tx, message, chat, author int64, text string, createdAt time.Time) error {
+	usernames := ParseMentions(text)
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	// users.username is char(128), so it is padded with spaces and must be trimmed before comparing
+	sql := `insert into message_mentions (message_id, chat_id, user_id, created_at)
+			select $1, chat_users.chat_id, chat_users.user_id, $5
+			  from chat_users
+			  join users on users.id = chat_users.user_id
+			 where chat_users.chat_id = $2
+			   and chat_users.user_id <> $3
+			   and trim(users.username) = any($4::text[])
+			    on conflict do nothing`
+	_, err := tx.Exec(ctx, sql, message, chat, author, usernames, createdAt)
+
+	return err
+}
+
+// mentionCursor points to the last returned mention, next page starts right after it
+type mentionCursor struct {
+	message int64
+}
+
+func (c mentionCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.message, 10)))
+}
+
+func decodeMentionCursor(cursor string) (mentionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return mentionCursor{}, ErrBadCursor
+	}
+
+	message, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return mentionCursor{}, ErrBadCursor
+	}
+
+	return mentionCursor{message: message}, nil
+}
+
+// UnreadMentions returns unread mentions of the user across all chats sorted by message (from latest to oldest).
+// Blank cursor requests the first page, the returned cursor is blank when there are no more mentions.
+func (s *Store) UnreadMentions(ctx context.Context, user int64, limit int, cursor string) (_ []Mention, _ string, err error) {
+	ctx, span := s.startSpan(ctx, "UnreadMentions")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving unread mentions of user (id: %d)", user)
+
+	// nil value makes the query start from the latest mention
+	var before *int64
+	if cursor != "" {
+		c, err := decodeMentionCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		before = &c.message
+	}
+
+	// check if user exists
+	var i int8
+	sql := "select 1 from users where id = $1"
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", ErrUserNotExist
+		}
+		return nil, "", err
+	}
+
+	sql = `select messages.id,
+				  messages.chat_id,
+				  messages.author_id,
+				  messages.text,
+				  messages.reply_to_message_id,
+				  messages.created_at,
+				  chats.name
+			 from message_mentions
+			 join messages on messages.id = message_mentions.message_id
+			 join chats on chats.id = message_mentions.chat_id
+			where message_mentions.user_id = $1
+			  and message_mentions.read_at is null
+			  and ($2::bigint is null or message_mentions.message_id < $2)
+			order by message_mentions.message_id desc
+			limit $3`
+
+	// requesting one extra row to find out whether the next page exists
+	rows, err := s.db.Query(ctx, sql, user, before, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	mentions := make([]Mention, 0, limit)
+	for rows.Next() {
+		var m Mention
+		err = rows.Scan(&m.ID, &m.Chat, &m.Author, &m.Text, &m.ReplyTo, &m.CreatedAt, &m.ChatName)
+		if err != nil {
+			return nil, "", err
+		}
+		mentions = append(mentions, m)
+	}
+
+	if rows.Err() != nil {
+		return nil, "", rows.Err()
+	}
+
+	var next string
+	if len(mentions) > limit {
+		mentions = mentions[:limit]
+		next = mentionCursor{message: mentions[limit-1].ID}.encode()
+	}
+
+	s.logger.Debugf("Retrieved %d unread mentions", len(mentions))
+
+	return mentions, next, nil
+}
+
+// MarkMentionsRead marks mentions of the user in provided messages as read and returns the number of marked ones.
+// Messages without unread mentions of the user are ignored.
+func (s *Store) MarkMentionsRead(ctx context.Context, user int64, messages []int64) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "MarkMentionsRead")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Marking %d mentions of user (id: %d) as read", len(messages), user)
+
+	// check if user exists
+	var i int8
+	sql := "select 1 from users where id = $1"
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrUserNotExist
+		}
+		return 0, err
+	}
+
+	sql = `update message_mentions
+			  set read_at = $3
+			where user_id = $1
+			  and message_id = any($2)
+			  and read_at is null`
+	tag, err := s.db.Exec(ctx, sql, user, messages, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
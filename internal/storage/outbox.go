@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+const (
+	EventChatCreated = "chat.created"
+
+	AggregateChat    = "chat"
+	AggregateMessage = "message"
+
+	// outboxChannel is notified on commit of every transaction writing into outbox
+	outboxChannel = "outbox_events"
+)
+
+// chatCreated is a payload of EventChatCreated, members are referenced by ids only
+type chatCreated struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Users     []int64   `json:"users"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// insertOutboxEvent writes domain event into outbox inside the transaction of the domain change,
+// so the event is stored if and only if the change is committed
+func insertOutboxEvent(ctx context.Context, tx pgx.Tx, aggregate string, aggregateID int64, event string, payload interface{}) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	sql := `insert into outbox (aggregate_type, aggregate_id, event_type, payload, created_at)
+			values ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(ctx, sql, aggregate, aggregateID, event, encoded, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// notifications are delivered on commit only and duplicates within a transaction are folded by postgres
+	_, err = tx.Exec(ctx, "select pg_notify($1, '')", outboxChannel)
+
+	return err
+}
+
+// DispatchOutbox passes up to limit undispatched events to publish in order of creation
+// and marks successfully published ones as dispatched. It stops at the first publishing error,
+// so failed and following events are passed again by the next call.
+// Selected rows stay locked until the end of the call, concurrent callers skip them.
+// Returns number of dispatched events.
+func (s *Store) DispatchOutbox(ctx context.Context, limit int, publish func(OutboxEvent) error) (_ int, err error) {
+	ctx, span := s.startSpan(ctx, "DispatchOutbox")
+	defer endSpan(span, &err)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	sql := `select id, aggregate_type, aggregate_id, event_type, payload, created_at
+			  from outbox
+			 where dispatched_at is null
+			 order by id
+			 limit $1
+			   for update skip locked`
+	rows, err := tx.Query(ctx, sql, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	events := make([]OutboxEvent, 0, limit)
+	for rows.Next() {
+		var e OutboxEvent
+		err = rows.Scan(&e.ID, &e.Aggregate, &e.AggregateID, &e.Type, &e.Payload, &e.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+
+	dispatched := make([]int64, 0, len(events))
+	var publishErr error
+	for _, e := range events {
+		publishErr = publish(e)
+		if publishErr != nil {
+			break
+		}
+		dispatched = append(dispatched, e.ID)
+	}
+
+	if len(dispatched) > 0 {
+		sql = "update outbox set dispatched_at = $2 where id = any($1)"
+		_, err = tx.Exec(ctx, sql, dispatched, time.Now())
+		if err != nil {
+			return 0, err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(dispatched), publishErr
+}
+
+// OutboxListener receives notifications about new outbox events over a dedicated connection
+type OutboxListener struct {
+	conn *pgxpool.Conn
+}
+
+// ListenOutbox acquires a connection from the pool and subscribes it to outbox notifications.
+// The connection is held until Close is called.
+func (s *Store) ListenOutbox(ctx context.Context) (_ *OutboxListener, err error) {
+	ctx, span := s.startSpan(ctx, "ListenOutbox")
+	defer endSpan(span, &err)
+
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Exec(ctx, "listen "+outboxChannel)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return &OutboxListener{conn: conn}, nil
+}
+
+// Wait blocks until a new outbox event is committed or ctx is done, in the latter case ctx error is returned
+func (l *OutboxListener) Wait(ctx context.Context) error {
+	_, err := l.conn.Conn().WaitForNotification(ctx)
+	// pgconn interrupts reading by the deadline of ctx, so its expiry is reported as a network i/o timeout
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Close unsubscribes the connection and returns it to the pool
+func (l *OutboxListener) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := l.conn.Exec(ctx, "unlisten "+outboxChannel)
+	if err != nil {
+		// connection state is unknown, so it must not be reused
+		l.conn.Conn().Close(ctx)
+	}
+	l.conn.Release()
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/xid"
+	"time"
+)
+
+// tombstonePrefix starts usernames of deleted users. The rest of the username is random,
+// so nobody is able to block deletion by registering the tombstone beforehand.
+const tombstonePrefix = "deleted-"
+
+// ExportUser passes all data of the user to emit in order: the profile (User), chat memberships (Membership)
+// and authored messages (Message) sorted by id. Records are read from a consistent snapshot and streamed,
+// so emit should not block for long. The export is recorded in the audit log before any record is emitted.
+func (s *Store) ExportUser(ctx context.Context, user int64, emit func(kind string, record interface{}) error) (err error) {
+	ctx, span := s.startSpan(ctx, "ExportUser")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Exporting user (id: %d)", user)
+
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var u User
+	sql := "select id, trim(username), type, created_at from users where id = $1"
+	err = tx.QueryRow(ctx, sql, user).Scan(&u.ID, &u.Username, &u.Type, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		return err
+	}
+
+	// the snapshot transaction is read-only, so the event is appended in its own one
+	_, err = s.RecordAuditEvent(ctx, AuditEvent{
+		Action:  AuditUserExported,
+		Target:  UserTarget(user),
+		Outcome: AuditOutcomeSuccess,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = emit(ExportRecordUser, u)
+	if err != nil {
+		return err
+	}
+
+	sql = `select chats.id, chats.name, chats.type, chats.created_at
+			 from chat_users
+			 join chats on chats.id = chat_users.chat_id
+			where chat_users.user_id = $1
+			order by chats.id`
+	rows, err := tx.Query(ctx, sql, user)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var m Membership
+		err = rows.Scan(&m.Chat, &m.Name, &m.Type, &m.CreatedAt)
+		if err == nil {
+			err = emit(ExportRecordChat, m)
+		}
+		if err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	sql = `select id, chat_id, author_id, text, reply_to_message_id, created_at
+			 from messages
+			where author_id = $1
+			order by id`
+	rows, err = tx.Query(ctx, sql, user)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		var m Message
+		err = rows.Scan(&m.ID, &m.Chat, &m.Author, &m.Text, &m.ReplyTo, &m.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = emit(ExportRecordMessage, m)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	s.logger.Debugf("Exported user (id: %d) with %d messages", user, n)
+
+	return nil
+}
+
+// DeleteUser anonymises the user replacing the username with a tombstone and removes bot settings if there are any.
+// Chat memberships and messages are kept, so chat history stays intact, but deleted users can not post messages.
+// The deletion is recorded in the audit log in the same transaction. Deleting already deleted user is a no-op.
+func (s *Store) DeleteUser(ctx context.Context, user int64) (err error) {
+	ctx, span := s.startSpan(ctx, "DeleteUser")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Deleting user (id: %d)", user)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var deletedAt *time.Time
+	sql := "select deleted_at from users where id = $1 for update"
+	err = tx.QueryRow(ctx, sql, user).Scan(&deletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		return err
+	}
+
+	if deletedAt != nil {
+		return nil
+	}
+
+	sql = "update users set username = $2, deleted_at = $3 where id = $1"
+	_, err = tx.Exec(ctx, sql, user, tombstonePrefix+xid.New().String(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	sql = "delete from bots where user_id = $1"
+	_, err = tx.Exec(ctx, sql, user)
+	if err != nil {
+		return err
+	}
+
+	_, err = insertAuditEvent(ctx, tx, AuditEvent{
+		Action:  AuditUserDeleted,
+		Target:  UserTarget(user),
+		Outcome: AuditOutcomeSuccess,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debugf("Deleted user (id: %d)", user)
+
+	return nil
+}
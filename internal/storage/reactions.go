@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+var ErrReactionNotExist = errors.New("reaction does not exist")
+
+// React adds emoji reaction of the user to the message. Reacting twice with the same emoji is a no-op.
+// Only members of the message chat may react.
+func (s *Store) React(ctx context.Context, message, user int64, emoji string) (err error) {
+	ctx, span := s.startSpan(ctx, "React")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Adding reaction (%s) of user (id: %d) to message (id: %d)", emoji, user, message)
+
+	chat, err := s.messageChatID(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	// check if user exists
+	var i int8
+	sql := "select 1 from users where id = $1"
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		return err
+	}
+
+	sql = `insert into message_reactions (message_id, chat_id, user_id, emoji, created_at)
+		   values ($1, $2, $3, $4, $5)
+		   on conflict (message_id, user_id, emoji) do nothing`
+	_, err = s.db.Exec(ctx, sql, message, chat, user, emoji, time.Now())
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			if pgErr.ConstraintName == "message_reactions_chat_id_user_id_fkey" {
+				return ErrUserNotChatMember
+			}
+			// message might be deleted between the check and the insert
+			return ErrMessageNotExist
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Unreact removes emoji reaction of the user from the message
+func (s *Store) Unreact(ctx context.Context, message, user int64, emoji string) (err error) {
+	ctx, span := s.startSpan(ctx, "Unreact")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Removing reaction (%s) of user (id: %d) from message (id: %d)", emoji, user, message)
+
+	_, err = s.messageChatID(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	sql := "delete from message_reactions where message_id = $1 and user_id = $2 and emoji = $3"
+	tag, err := s.db.Exec(ctx, sql, message, user, emoji)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrReactionNotExist
+	}
+
+	return nil
+}
+
+// messageChatID returns id of the chat message belongs to
+func (s *Store) messageChatID(ctx context.Context, message int64) (int64, error) {
+	var chat int64
+	sql := "select chat_id from messages where id = $1"
+	err := s.db.QueryRow(ctx, sql, message).Scan(&chat)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrMessageNotExist
+		}
+		return 0, err
+	}
+
+	return chat, nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// SetChatRetention replaces retention settings of the chat.
+// Settings with both fields nil are removed, so the chat follows the global policy.
+func (s *Store) SetChatRetention(ctx context.Context, r ChatRetention) (err error) {
+	ctx, span := s.startSpan(ctx, "SetChatRetention")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Setting retention of chat (id: %d)", r.Chat)
+
+	if r.MaxAge == nil && r.MaxCount == nil {
+		// check if chat exists
+		var i int8
+		sql := "select 1 from chats where id = $1"
+		err := s.db.QueryRow(ctx, sql, r.Chat).Scan(&i)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrChatNotExist
+			}
+			return err
+		}
+
+		sql = "delete from chat_retention where chat_id = $1"
+		_, err = s.db.Exec(ctx, sql, r.Chat)
+
+		return err
+	}
+
+	var maxAge *int64
+	if r.MaxAge != nil {
+		seconds := int64(r.MaxAge.Seconds())
+		maxAge = &seconds
+	}
+
+	sql := `insert into chat_retention (chat_id, max_age_seconds, max_count, updated_at)
+			values ($1, $2, $3, $4)
+			on conflict (chat_id) do update
+			set max_age_seconds = excluded.max_age_seconds,
+				max_count = excluded.max_count,
+				updated_at = excluded.updated_at`
+	_, err = s.db.Exec(ctx, sql, r.Chat, maxAge, r.MaxCount, time.Now())
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return ErrChatNotExist
+		}
+		return err
+	}
+
+	return nil
+}
+
+// RetentionTargets returns chats having at least one retention limit along with their effective policies.
+// Per-chat settings take precedence over provided global policy.
+func (s *Store) RetentionTargets(ctx context.Context, global RetentionPolicy) (_ []RetentionTarget, err error) {
+	ctx, span := s.startSpan(ctx, "RetentionTargets")
+	defer endSpan(span, &err)
+
+	s.logger.Debug("Retrieving retention targets")
+
+	sql := `select chats.id,
+				   coalesce(chat_retention.max_age_seconds, $1),
+				   coalesce(chat_retention.max_count, $2)
+			  from chats
+			  left join chat_retention on chat_retention.chat_id = chats.id
+			 where coalesce(chat_retention.max_age_seconds, $1) > 0
+				or coalesce(chat_retention.max_count, $2) > 0
+			 order by chats.id`
+	rows, err := s.db.Query(ctx, sql, int64(global.MaxAge.Seconds()), global.MaxCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []RetentionTarget
+	for rows.Next() {
+		var t RetentionTarget
+		var maxAge int64
+		err = rows.Scan(&t.Chat, &maxAge, &t.Policy.MaxCount)
+		if err != nil {
+			return nil, err
+		}
+		t.Policy.MaxAge = time.Duration(maxAge) * time.Second
+		targets = append(targets, t)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return targets, nil
+}
+
+// PurgeMessages deletes up to limit oldest messages of the chat violating provided policy in a single transaction.
+// Replies to deleted messages lose their reply_to_message_id, attachments of deleted messages are deleted as well
+// while reactions and mentions are cascaded. Webhook deliveries and outbox events are not affected.
+func (s *Store) PurgeMessages(ctx context.Context, chat int64, p RetentionPolicy, limit int) (_ Purge, err error) {
+	ctx, span := s.startSpan(ctx, "PurgeMessages")
+	defer endSpan(span, &err)
+
+	var before *time.Time
+	if p.MaxAge > 0 {
+		t := time.Now().Add(-p.MaxAge)
+		before = &t
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Purge{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	// the oldest messages are locked first, so concurrent purges of the same chat skip each other's batches
+	sql := `select id
+			  from messages
+			 where chat_id = $1
+			   and (($2::timestamptz is not null and created_at < $2)
+					or ($3::integer > 0 and id <= (
+						select id
+						  from messages
+						 where chat_id = $1
+						 order by id desc
+						offset $3
+						 limit 1
+					)))
+			 order by id
+			 limit $4
+			   for update skip locked`
+	rows, err := tx.Query(ctx, sql, chat, before, p.MaxCount, limit)
+	if err != nil {
+		return Purge{}, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return Purge{}, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return Purge{}, rows.Err()
+	}
+
+	if len(ids) == 0 {
+		return Purge{}, nil
+	}
+
+	// messages_reply_to_message_id_chat_id_fkey has no action on delete
+	sql = `update messages
+			  set reply_to_message_id = null
+			where reply_to_message_id = any($1)
+			  and not id = any($1)`
+	_, err = tx.Exec(ctx, sql, ids)
+	if err != nil {
+		return Purge{}, err
+	}
+
+	var purge Purge
+
+	sql = `select attachment_thumbnails.blob_key
+			 from attachment_thumbnails
+			 join attachments on attachments.id = attachment_thumbnails.attachment_id
+			where attachments.message_id = any($1)`
+	rows, err = tx.Query(ctx, sql, ids)
+	if err != nil {
+		return Purge{}, err
+	}
+
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return Purge{}, err
+		}
+		purge.BlobKeys = append(purge.BlobKeys, key)
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return Purge{}, rows.Err()
+	}
+
+	// thumbnails are cascaded
+	sql = "delete from attachments where message_id = any($1) returning blob_key"
+	rows, err = tx.Query(ctx, sql, ids)
+	if err != nil {
+		return Purge{}, err
+	}
+
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return Purge{}, err
+		}
+		purge.BlobKeys = append(purge.BlobKeys, key)
+		purge.Attachments++
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return Purge{}, rows.Err()
+	}
+
+	sql = "delete from messages where id = any($1)"
+	tag, err := tx.Exec(ctx, sql, ids)
+	if err != nil {
+		return Purge{}, err
+	}
+	purge.Messages = tag.RowsAffected()
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return Purge{}, err
+	}
+
+	return purge, nil
+}
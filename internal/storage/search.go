@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"html"
+	"strconv"
+	"strings"
+)
+
+var ErrBadCursor = errors.New("bad cursor")
+
+const (
+	// headlineStart and headlineStop are control characters delimiting matches in ts_headline output,
+	// they are replaced with HTML tags after the message text is escaped
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+	// headlineOptions configures ts_headline used to build highlighted snippets
+	headlineOptions = `StartSel="` + headlineStart + `", StopSel="` + headlineStop + `", MaxFragments=2, MinWords=5, MaxWords=20`
+)
+
+// snippetReplacer turns match delimiters of HTML-escaped headline into <b> tags
+var snippetReplacer = strings.NewReplacer(headlineStart, "<b>", headlineStop, "</b>")
+
+// snippet converts ts_headline output into HTML: the message text is escaped and matches are wrapped in <b> tags.
+// Delimiters typed by the user are removed from the text passed to ts_headline, so they can not unbalance the tags.
+func snippet(headline string) string {
+	return snippetReplacer.Replace(html.EscapeString(headline))
+}
+
+// searchCursor points to the last returned search result, next page starts right after it
+type searchCursor struct {
+	rank float32
+	id   int64
+}
+
+func (c searchCursor) encode() string {
+	raw := strconv.FormatFloat(float64(c.rank), 'g', -1, 32) + ":" + strconv.FormatInt(c.id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSearchCursor(cursor string) (searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return searchCursor{}, ErrBadCursor
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return searchCursor{}, ErrBadCursor
+	}
+
+	rank, err := strconv.ParseFloat(parts[0], 32)
+	if err != nil {
+		return searchCursor{}, ErrBadCursor
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return searchCursor{}, ErrBadCursor
+	}
+
+	return searchCursor{rank: float32(rank), id: id}, nil
+}
+
+// SearchMessages performs full-text search over messages of chats the user is a member of.
+// Results are sorted by rank (from most to least relevant) and contain highlighted snippets
+// which are safe to render as HTML.
+// Blank cursor requests the first page, the returned cursor is blank when there are no more results.
+func (s *Store) SearchMessages(ctx context.Context, user int64, query string, limit int, cursor string) (_ []SearchResult, _ string, err error) {
+	ctx, span := s.startSpan(ctx, "SearchMessages")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Searching messages for user (id: %d)", user)
+
+	// nil values make the query start from the most relevant result
+	var afterRank *float32
+	var afterID *int64
+	if cursor != "" {
+		c, err := decodeSearchCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		afterRank = &c.rank
+		afterID = &c.id
+	}
+
+	// check if user exists
+	var i int8
+	sql := "select 1 from users where id = $1"
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", ErrUserNotExist
+		}
+		return nil, "", err
+	}
+
+	// ts_headline is expensive, so it is computed only for rows of the requested page
+	sql = `select ranked.id,
+				  ranked.chat_id,
+				  ranked.author_id,
+				  ranked.text,
+				  ranked.created_at,
+				  ranked.rank,
+				  ts_headline($2::regconfig, translate(ranked.text, E'\x02\x03', ''), ranked.query, $7)
+			 from (
+				select messages.id,
+					   messages.chat_id,
+					   messages.author_id,
+					   messages.text,
+					   messages.created_at,
+					   ts_rank(messages.text_tsv, query) as rank,
+					   query
+				  from messages
+				  join chat_users
+					on chat_users.chat_id = messages.chat_id
+				   and chat_users.user_id = $1
+				 cross join websearch_to_tsquery($2::regconfig, $3) as query
+				 where messages.text_tsv @@ query
+			 ) as ranked
+			where $4::real is null
+			   or (ranked.rank, ranked.id) < ($4::real, $5::bigint)
+			order by ranked.rank desc, ranked.id desc
+			limit $6`
+
+	// requesting one extra row to find out whether the next page exists
+	rows, err := s.db.Query(ctx, sql, user, s.searchLanguage, query, afterRank, afterID, limit+1, headlineOptions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	results := make([]SearchResult, 0, limit)
+	for rows.Next() {
+		var r SearchResult
+		err = rows.Scan(&r.ID, &r.Chat, &r.Author, &r.Text, &r.CreatedAt, &r.Rank, &r.Snippet)
+		if err != nil {
+			return nil, "", err
+		}
+		r.Snippet = snippet(r.Snippet)
+		results = append(results, r)
+	}
+
+	if rows.Err() != nil {
+		return nil, "", rows.Err()
+	}
+
+	var next string
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[limit-1]
+		next = searchCursor{rank: last.Rank, id: last.ID}.encode()
+	}
+
+	s.logger.Debugf("Found %d messages", len(results))
+
+	return results, next, nil
+}
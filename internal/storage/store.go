@@ -13,6 +13,8 @@ import (
 	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"time"
 )
@@ -26,12 +28,17 @@ var (
 	ErrChatBadUsers      = errors.New("bad users list")
 	ErrChatNotExist      = errors.New("chat does not exist")
 	ErrChatHasNoMessages = errors.New("chat does not have messages")
+	ErrMessageNotExist   = errors.New("message does not exist")
+	ErrMessageNotInChat  = errors.New("message does not belong to chat")
 )
 
 // Store defines fields used in db interaction processes
 type Store struct {
-	logger *zap.SugaredLogger
-	db     *pgxpool.Pool
+	logger         *zap.SugaredLogger
+	db             *pgxpool.Pool
+	searchLanguage string
+	previewLength  int
+	tracer         trace.Tracer
 }
 
 // NewStore constructs Store instance with configured logger and extends default pgxpool.Config with options.
@@ -42,32 +49,104 @@ func NewStore(ctx context.Context, logger *zap.SugaredLogger, opts ...Option) (*
 		return nil, errors.New("no logger provided")
 	}
 
-	config, _ := pgxpool.ParseConfig("")
+	poolConfig, _ := pgxpool.ParseConfig("")
+	cfg := &config{
+		pool:           poolConfig,
+		searchLanguage: defaultSearchLanguage,
+		previewLength:  defaultPreviewLength,
+	}
 	for _, o := range opts {
-		o.apply(config)
+		o.apply(cfg)
 	}
 
-	config.ConnConfig.Logger = zapadapter.NewLogger(logger.Desugar())
+	if cfg.queryLogger == nil {
+		cfg.queryLogger = logger.Desugar()
+	}
+	if cfg.tracerProvider == nil {
+		cfg.tracerProvider = otel.GetTracerProvider()
+	}
+	tracer := cfg.tracerProvider.Tracer(instrumentationName)
+	poolConfig.ConnConfig.Logger = &queryTracer{tracer: tracer, next: zapadapter.NewLogger(cfg.queryLogger)}
 
-	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if cfg.previewLength < 1 {
+		return nil, fmt.Errorf("preview length must be positive, got %d", cfg.previewLength)
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
 	if err != nil {
-		return nil, fmt.Errorf("cannot connect using config %+v: %w", config, err)
+		return nil, fmt.Errorf("cannot connect using config %+v: %w", poolConfig, err)
+	}
+
+	// check that provided text search configuration exists to fail early instead of on each search
+	var i int8
+	err = pool.QueryRow(ctx, "select 1 from pg_ts_config where cfgname = $1", cfg.searchLanguage).Scan(&i)
+	if err != nil {
+		pool.Close()
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("unknown text search configuration %q", cfg.searchLanguage)
+		}
+		return nil, err
 	}
 
 	return &Store{
-		logger: logger,
-		db:     pool,
+		logger:         logger,
+		db:             pool,
+		searchLanguage: cfg.searchLanguage,
+		previewLength:  cfg.previewLength,
+		tracer:         tracer,
 	}, nil
 }
 
 // Close closes all database connections in pool
 func (s *Store) Close() {
+	_, span := s.startSpan(context.Background(), "Close")
+	defer span.End()
+
 	s.logger.Info("Closing store connections")
 	s.db.Close()
 }
 
+// PoolStats is a snapshot of connection pool statistics
+type PoolStats struct {
+	// AcquireCount is the number of successful acquires of connections from the pool
+	AcquireCount int64 `json:"acquire_count"`
+	// AcquireDuration is the total duration of successful acquires
+	AcquireDuration time.Duration `json:"acquire_duration_ns"`
+	// CanceledAcquireCount is the number of acquires cancelled by a context
+	CanceledAcquireCount int64 `json:"canceled_acquire_count"`
+	// EmptyAcquireCount is the number of acquires which waited for a connection since the pool was empty
+	EmptyAcquireCount int64 `json:"empty_acquire_count"`
+	AcquiredConns     int32 `json:"acquired_conns"`
+	ConstructingConns int32 `json:"constructing_conns"`
+	IdleConns         int32 `json:"idle_conns"`
+	TotalConns        int32 `json:"total_conns"`
+	MaxConns          int32 `json:"max_conns"`
+}
+
+// PoolStats returns the current statistics of the connection pool
+func (s *Store) PoolStats() PoolStats {
+	_, span := s.startSpan(context.Background(), "PoolStats")
+	defer span.End()
+
+	stat := s.db.Stat()
+	return PoolStats{
+		AcquireCount:         stat.AcquireCount(),
+		AcquireDuration:      stat.AcquireDuration(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		AcquiredConns:        stat.AcquiredConns(),
+		ConstructingConns:    stat.ConstructingConns(),
+		IdleConns:            stat.IdleConns(),
+		TotalConns:           stat.TotalConns(),
+		MaxConns:             stat.MaxConns(),
+	}
+}
+
 // CreateUser creates user and returns its id.
-func (s *Store) CreateUser(ctx context.Context, username string) (int64, error) {
+func (s *Store) CreateUser(ctx context.Context, username string) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "CreateUser")
+	defer endSpan(span, &err)
+
 	requestID, ok := zapadapter.IDFromContext(ctx)
 	logger := s.logger
 	if ok {
@@ -79,7 +158,7 @@ func (s *Store) CreateUser(ctx context.Context, username string) (int64, error)
 	// check if user exists to prevent error log during s.db.QueryRow insert call
 	var i int8
 	sql := "select 1 from users where username = $1"
-	err := s.db.QueryRow(ctx, sql, username).Scan(&i)
+	err = s.db.QueryRow(ctx, sql, username).Scan(&i)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return 0, err
@@ -105,7 +184,10 @@ func (s *Store) CreateUser(ctx context.Context, username string) (int64, error)
 // CreateChat performs two-step transaction to create chat
 // (1. insert chat record; 2. bulk insert on "chat-users" table) and returns its id
 // TODO decide whether several chats with same users possible (different chat names)
-func (s *Store) CreateChat(ctx context.Context, name string, users []int64) (int64, error) {
+func (s *Store) CreateChat(ctx context.Context, name string, users []int64) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "CreateChat")
+	defer endSpan(span, &err)
+
 	s.logger.Debugf("Creating chat (%s) with users (%v)", name, users)
 
 	tx, err := s.db.Begin(ctx)
@@ -118,8 +200,9 @@ func (s *Store) CreateChat(ctx context.Context, name string, users []int64) (int
 
 	// creating chat record
 	var id int64
-	sql := "insert into chats (name, created_at) values ($1, $2) returning id"
-	err = tx.QueryRow(ctx, sql, name, time.Now()).Scan(&id)
+	createdAt := time.Now()
+	sql := "insert into chats (name, type, created_at) values ($1, $2, $3) returning id"
+	err = tx.QueryRow(ctx, sql, name, ChatTypeGroup, createdAt).Scan(&id)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
@@ -147,6 +230,12 @@ func (s *Store) CreateChat(ctx context.Context, name string, users []int64) (int
 		return 0, err
 	}
 
+	event := chatCreated{ID: id, Name: name, Type: ChatTypeGroup, Users: users, CreatedAt: createdAt}
+	err = insertOutboxEvent(ctx, tx, AggregateChat, id, EventChatCreated, event)
+	if err != nil {
+		return 0, err
+	}
+
 	err = tx.Commit(ctx)
 	if err != nil {
 		return 0, err
@@ -157,14 +246,126 @@ func (s *Store) CreateChat(ctx context.Context, name string, users []int64) (int
 	return id, nil
 }
 
-// CreateMessage creates new message in database and returns its id
-func (s *Store) CreateMessage(ctx context.Context, chat, author int64, text string) (int64, error) {
+// CreateDirectChat returns id of the direct chat between two users creating it if it does not exist yet.
+// The second returned value reports whether the chat was created by this call.
+// Concurrent calls for the same pair are resolved by direct_chats_pair_key constraint:
+// the loser rolls back and returns the chat created by the winner.
+func (s *Store) CreateDirectChat(ctx context.Context, userA, userB int64) (_ int64, _ bool, err error) {
+	ctx, span := s.startSpan(ctx, "CreateDirectChat")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Creating direct chat between users (%d, %d)", userA, userB)
+
+	if userA == userB {
+		return 0, false, ErrChatBadUsers
+	}
+
+	// canonical order of the pair
+	low, high := userA, userB
+	if low > high {
+		low, high = high, low
+	}
+
+	id, err := s.directChatID(ctx, low, high)
+	if err == nil {
+		return id, false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, err
+	}
+
+	id, err = s.insertDirectChat(ctx, low, high)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == "direct_chats_pair_key" {
+			// chat was created by concurrent call
+			id, err = s.directChatID(ctx, low, high)
+			if err != nil {
+				return 0, false, err
+			}
+			return id, false, nil
+		}
+		return 0, false, err
+	}
+
+	s.logger.Debugf("Created direct chat with id %d", id)
+
+	return id, true, nil
+}
+
+// directChatID returns id of direct chat between users with canonically ordered ids
+func (s *Store) directChatID(ctx context.Context, low, high int64) (int64, error) {
+	var id int64
+	sql := "select chat_id from direct_chats where user_low_id = $1 and user_high_id = $2"
+	err := s.db.QueryRow(ctx, sql, low, high).Scan(&id)
+
+	return id, err
+}
+
+// insertDirectChat performs transaction inserting chat record, canonical pair record and chat members
+func (s *Store) insertDirectChat(ctx context.Context, low, high int64) (int64, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	// direct chats have blank names as they are exempt from name uniqueness
+	var id int64
+	createdAt := time.Now()
+	sql := "insert into chats (name, type, created_at) values ('', $1, $2) returning id"
+	err = tx.QueryRow(ctx, sql, ChatTypeDirect, createdAt).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	sql = "insert into direct_chats (chat_id, user_low_id, user_high_id) values ($1, $2, $3)"
+	_, err = tx.Exec(ctx, sql, id, low, high)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return 0, ErrChatBadUsers
+		}
+		return 0, err
+	}
+
+	rows := []chatRow{{chatId: id, userId: low}, {chatId: id, userId: high}}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"chat_users"}, []string{"chat_id", "user_id"}, copyFromBulk(rows))
+	if err != nil {
+		return 0, err
+	}
+
+	event := chatCreated{ID: id, Type: ChatTypeDirect, Users: []int64{low, high}, CreatedAt: createdAt}
+	err = insertOutboxEvent(ctx, tx, AggregateChat, id, EventChatCreated, event)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// CreateMessage creates new message in database and returns its id.
+// See the various MessageOptions for optional message fields.
+func (s *Store) CreateMessage(ctx context.Context, chat, author int64, text string, opts ...MessageOption) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "CreateMessage")
+	defer endSpan(span, &err)
+
 	s.logger.Debugf("Creating message from user (id: %d) in chat (id: %d)", author, chat)
 
+	cfg := &messageConfig{}
+	for _, o := range opts {
+		o.apply(cfg)
+	}
+
 	// check if chat exists
 	var i int8
 	sql := "select 1 from chats where id = $1"
-	err := s.db.QueryRow(ctx, sql, chat).Scan(&i)
+	err = s.db.QueryRow(ctx, sql, chat).Scan(&i)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return 0, ErrChatNotExist
@@ -172,8 +373,8 @@ func (s *Store) CreateMessage(ctx context.Context, chat, author int64, text stri
 		return 0, err
 	}
 
-	// check if user exists
-	sql = "select 1 from users where id = $1"
+	// check if user exists, deleted users can not post
+	sql = "select 1 from users where id = $1 and deleted_at is null"
 	err = s.db.QueryRow(ctx, sql, author).Scan(&i)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -182,31 +383,89 @@ func (s *Store) CreateMessage(ctx context.Context, chat, author int64, text stri
 		return 0, err
 	}
 
+	// check if replied message exists in the same chat
+	if cfg.replyTo != nil {
+		var replyChat int64
+		sql = "select chat_id from messages where id = $1"
+		err = s.db.QueryRow(ctx, sql, *cfg.replyTo).Scan(&replyChat)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return 0, ErrMessageNotExist
+			}
+			return 0, err
+		}
+
+		if replyChat != chat {
+			return 0, ErrMessageNotInChat
+		}
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
 	var id int64
-	sql = "insert into messages (chat_id, author_id, text, created_at) values ($1, $2, $3, $4) returning id"
-	err = s.db.QueryRow(ctx, sql, chat, author, text, time.Now()).Scan(&id)
+	createdAt := time.Now()
+	sql = `insert into messages (chat_id, author_id, text, text_tsv, reply_to_message_id, created_at)
+		   values ($1, $2, $3, to_tsvector($4::regconfig, $3), $5, $6) returning id`
+	err = tx.QueryRow(ctx, sql, chat, author, text, s.searchLanguage, cfg.replyTo, createdAt).Scan(&id)
 	if err != nil {
 		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			if pgErr.Code == pgerrcode.ForeignKeyViolation {
-				return 0, ErrUserNotChatMember
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			// replied message might be deleted between the check and the insert
+			if pgErr.ConstraintName == "messages_reply_to_message_id_chat_id_fkey" {
+				return 0, ErrMessageNotExist
 			}
+			return 0, ErrUserNotChatMember
 		}
 		return 0, err
 	}
 
+	if len(cfg.attachments) > 0 {
+		err = linkAttachments(ctx, tx, id, chat, author, cfg.attachments)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = insertMentions(ctx, tx, id, chat, author, text, createdAt)
+	if err != nil {
+		return 0, err
+	}
+
+	m := Message{ID: id, Chat: chat, Author: author, Text: text, ReplyTo: cfg.replyTo, CreatedAt: createdAt}
+	err = enqueueWebhookDeliveries(ctx, tx, chat, EventMessageCreated, map[string]interface{}{"message": m})
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertOutboxEvent(ctx, tx, AggregateMessage, id, EventMessageCreated, m)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
 	return id, nil
 }
 
 // ChatsByUserID returns a list of all chats with all fields, sorted by the time of the last message in the chat
-//(from latest to oldest)
-func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
+//(from latest to oldest). Unread counter of each chat includes only messages of other users.
+func (s *Store) ChatsByUserID(ctx context.Context, user int64) (_ []Chat, err error) {
+	ctx, span := s.startSpan(ctx, "ChatsByUserID")
+	defer endSpan(span, &err)
+
 	s.logger.Debugf("Retrieving chats for user (id: %d)", user)
 
 	// check if user exists
 	var i int8
 	sql := "select 1 from users where id = $1"
-	err := s.db.QueryRow(ctx, sql, user).Scan(&i)
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrUserNotExist
@@ -225,10 +484,14 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 	}
 
 	type retrievedChat struct {
-		id        int64
-		name      string
-		users     pgtype.JSONBArray
-		createdAt time.Time
+		id                int64
+		name              string
+		chatType          string
+		users             pgtype.JSONBArray
+		createdAt         time.Time
+		unreadCount       int64
+		lastReadMessageID *int64
+		lastMessage       Preview
 	}
 
 	// TODO update sql to retrieve chats without messages ordered by creation time
@@ -236,6 +499,7 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 			with user_chats as (
 				select chats.id, 
 					   chats.name, 
+					   chats.type, 
 					   chats.created_at, 
 					   chat_users.user_id, 
 					   min(age(clock_timestamp(), messages.created_at)) as time_since_message_creation
@@ -244,7 +508,7 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 					on chat_users.chat_id = chats.id
 				  join messages
 					on chats.id = messages.chat_id
-				 group by chats.id, chats.name, chats.created_at, chat_users.user_id 
+				 group by chats.id, chats.name, chats.type, chats.created_at, chat_users.user_id 
 				having chat_users.user_id = $1 
 				 order by time_since_message_creation
 			), 
@@ -252,7 +516,12 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 			users_per_chat as (
 				select
 					chat_id,
-					array_agg(jsonb_build_object('id', users.id, 'username', trim(users.username), 'created_at', users.created_at)) as users
+					array_agg(jsonb_build_object(
+						'id', users.id,
+						'username', trim(users.username),
+						'type', users.type,
+						'created_at', users.created_at
+					)) as users
 				from chat_users 
 				join users 
 				  on chat_users.user_id = users.id
@@ -262,13 +531,44 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 			
 			select user_chats.id, 
 				   trim(user_chats.name),
+				   user_chats.type,
 				   users_per_chat.users,
-				   user_chats.created_at
+				   user_chats.created_at,
+				   unread.count,
+				   chat_reads.last_read_message_id,
+				   last_message.id,
+				   last_message.author_id,
+				   last_message.text,
+				   last_message.created_at
 			  from user_chats
 			  join users_per_chat
-				on user_chats.id = users_per_chat.chat_id`
-
-	rows, err := s.db.Query(ctx, sql, user)
+				on user_chats.id = users_per_chat.chat_id
+			  left join chat_reads
+				on chat_reads.chat_id = user_chats.id
+			   and chat_reads.user_id = $1
+			 -- counting only messages of other users which are newer than the last read one,
+			 -- messages_chat_id_id_idx keeps it an index range scan per chat
+			 cross join lateral (
+				select count(*) as count
+				  from messages
+				 where messages.chat_id = user_chats.id
+				   and messages.id > coalesce(chat_reads.last_read_message_id, 0)
+				   and messages.author_id <> $1
+			 ) as unread
+			 -- user_chats contains only chats with messages, so there is always a row to join
+			 cross join lateral (
+				select messages.id,
+					   messages.author_id,
+					   left(messages.text, $2) as text,
+					   messages.created_at
+				  from messages
+				 where messages.chat_id = user_chats.id
+				 order by messages.created_at desc, messages.id desc
+				 limit 1
+			 ) as last_message
+			 order by user_chats.time_since_message_creation`
+
+	rows, err := s.db.Query(ctx, sql, user, s.previewLength)
 	if err != nil {
 		return nil, err
 	}
@@ -276,16 +576,23 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 	var chats []Chat
 	for rows.Next() {
 		var c retrievedChat
-		err = rows.Scan(&c.id, &c.name, &c.users, &c.createdAt)
+		err = rows.Scan(
+			&c.id, &c.name, &c.chatType, &c.users, &c.createdAt, &c.unreadCount, &c.lastReadMessageID,
+			&c.lastMessage.ID, &c.lastMessage.Author, &c.lastMessage.Text, &c.lastMessage.CreatedAt,
+		)
 		if err != nil {
 			return nil, err
 		}
 
 		currentChat := Chat{
-			ID:        c.id,
-			Name:      c.name,
-			Users:     make([]User, len(c.users.Elements)),
-			CreatedAt: c.createdAt,
+			ID:                c.id,
+			Name:              c.name,
+			Type:              c.chatType,
+			Users:             make([]User, len(c.users.Elements)),
+			CreatedAt:         c.createdAt,
+			UnreadCount:       c.unreadCount,
+			LastReadMessageID: c.lastReadMessageID,
+			LastMessage:       &c.lastMessage,
 		}
 
 		usersJSON := make([]string, len(c.users.Elements))
@@ -314,14 +621,18 @@ func (s *Store) ChatsByUserID(ctx context.Context, user int64) ([]Chat, error) {
 }
 
 // MessagesByChatID returns list of all chat messages with all fields, sorted by message creation time
-// (from earliest to latest)
-func (s *Store) MessagesByChatID(ctx context.Context, chat int64) ([]Message, error) {
+// (from earliest to latest). Reactions of each message are aggregated by emoji relative to provided user,
+// zero user id means that nobody is considered as reacted.
+func (s *Store) MessagesByChatID(ctx context.Context, chat, user int64) (_ []Message, err error) {
+	ctx, span := s.startSpan(ctx, "MessagesByChatID")
+	defer endSpan(span, &err)
+
 	s.logger.Debugf("Retrieving messages for chat (id: %d)", chat)
 
 	// check if chat exists
 	var i int8
 	sql := "select 1 from chats where id = $1"
-	err := s.db.QueryRow(ctx, sql, chat).Scan(&i)
+	err = s.db.QueryRow(ctx, sql, chat).Scan(&i)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrChatNotExist
@@ -343,12 +654,59 @@ func (s *Store) MessagesByChatID(ctx context.Context, chat int64) ([]Message, er
 				  messages.chat_id, 
 				  messages.author_id, 
 				  messages.text, 
+				  messages.reply_to_message_id,
+				  (select count(*) from messages as replies where replies.reply_to_message_id = messages.id),
+				  reactions.aggregated,
+				  attached.aggregated,
 				  messages.created_at
 			 from messages 
+			cross join lateral (
+				select coalesce(
+						   jsonb_agg(jsonb_build_object(
+							   'id', attachments.id,
+							   'chat', attachments.chat_id,
+							   'uploader', attachments.uploader_id,
+							   'message', attachments.message_id,
+							   'filename', attachments.filename,
+							   'content_type', attachments.content_type,
+							   'size', attachments.size,
+							   'checksum', attachments.checksum,
+							   'created_at', attachments.created_at,
+							   'thumbnail_error', attachments.thumbnail_error,
+							   'thumbnails', (
+								   select jsonb_agg(jsonb_build_object(
+											  'size', attachment_thumbnails.size,
+											  'width', attachment_thumbnails.width,
+											  'height', attachment_thumbnails.height,
+											  'content_type', attachment_thumbnails.content_type
+										  ) order by attachment_thumbnails.size)
+									 from attachment_thumbnails
+									where attachment_thumbnails.attachment_id = attachments.id
+							   )
+						   ) order by attachments.id),
+						   '[]'::jsonb
+					   ) as aggregated
+				  from attachments
+				 where attachments.message_id = messages.id
+			) as attached
+			cross join lateral (
+				select coalesce(
+						   jsonb_object_agg(per_emoji.emoji, jsonb_build_object('count', per_emoji.count, 'reacted', per_emoji.reacted)),
+						   '{}'::jsonb
+					   ) as aggregated
+				  from (
+					select emoji,
+						   count(*) as count,
+						   bool_or(user_id = $2) as reacted
+					  from message_reactions
+					 where message_reactions.message_id = messages.id
+					 group by emoji
+				  ) as per_emoji
+			) as reactions
 			where chat_id = $1 
 			order by created_at asc`
 
-	rows, err := s.db.Query(ctx, sql, chat)
+	rows, err := s.db.Query(ctx, sql, chat, user)
 	if err != nil {
 		return nil, err
 	}
@@ -358,7 +716,9 @@ func (s *Store) MessagesByChatID(ctx context.Context, chat int64) ([]Message, er
 	var messages []Message
 	for rows.Next() {
 		var m Message
-		err = rows.Scan(&m.ID, &m.Chat, &m.Author, &m.Text, &m.CreatedAt)
+		err = rows.Scan(
+			&m.ID, &m.Chat, &m.Author, &m.Text, &m.ReplyTo, &m.ReplyCount, &m.Reactions, &m.Attachments, &m.CreatedAt,
+		)
 		if err != nil {
 			return nil, err
 		}
@@ -373,3 +733,140 @@ func (s *Store) MessagesByChatID(ctx context.Context, chat int64) ([]Message, er
 
 	return messages, nil
 }
+
+// MarkChatRead advances the last read message of the user in the chat and returns the resulting last read message id.
+// The pointer never moves backwards, so marking an older message as read keeps the current one.
+// Mentions of the user in messages up to the last read one are marked as read too.
+func (s *Store) MarkChatRead(ctx context.Context, chat, user, message int64) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "MarkChatRead")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Marking chat (id: %d) as read by user (id: %d) up to message (id: %d)", chat, user, message)
+
+	// check if chat exists
+	var i int8
+	sql := "select 1 from chats where id = $1"
+	err = s.db.QueryRow(ctx, sql, chat).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrChatNotExist
+		}
+		return 0, err
+	}
+
+	// check if user exists
+	sql = "select 1 from users where id = $1"
+	err = s.db.QueryRow(ctx, sql, user).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrUserNotExist
+		}
+		return 0, err
+	}
+
+	// check if message belongs to chat
+	sql = "select 1 from messages where id = $1 and chat_id = $2"
+	err = s.db.QueryRow(ctx, sql, message, chat).Scan(&i)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrMessageNotInChat
+		}
+		return 0, err
+	}
+
+	var lastRead int64
+	sql = `insert into chat_reads (chat_id, user_id, last_read_message_id, updated_at)
+		   values ($1, $2, $3, $4)
+		   on conflict (chat_id, user_id) do update
+		   set last_read_message_id = greatest(chat_reads.last_read_message_id, excluded.last_read_message_id),
+			   updated_at = excluded.updated_at
+		   returning last_read_message_id`
+	err = s.db.QueryRow(ctx, sql, chat, user, message, time.Now()).Scan(&lastRead)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return 0, ErrUserNotChatMember
+		}
+		return 0, err
+	}
+
+	// mentions in read messages are read as well
+	sql = `update message_mentions
+			  set read_at = $4
+			where chat_id = $1
+			  and user_id = $2
+			  and message_id <= $3
+			  and read_at is null`
+	_, err = s.db.Exec(ctx, sql, chat, user, lastRead, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return lastRead, nil
+}
+
+// Thread returns the message with provided id and its direct replies sorted by creation time
+// (from earliest to latest)
+func (s *Store) Thread(ctx context.Context, message int64) (_ Message, _ []Message, err error) {
+	ctx, span := s.startSpan(ctx, "Thread")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving thread for message (id: %d)", message)
+
+	sql := `select messages.id,
+				   messages.chat_id,
+				   messages.author_id,
+				   messages.text,
+				   messages.reply_to_message_id,
+				   (select count(*) from messages as replies where replies.reply_to_message_id = messages.id),
+				   messages.created_at
+			  from messages
+			 where messages.id = $1`
+
+	var root Message
+	err = s.db.QueryRow(ctx, sql, message).Scan(
+		&root.ID, &root.Chat, &root.Author, &root.Text, &root.ReplyTo, &root.ReplyCount, &root.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Message{}, nil, ErrMessageNotExist
+		}
+		return Message{}, nil, err
+	}
+
+	sql = `select messages.id,
+				  messages.chat_id,
+				  messages.author_id,
+				  messages.text,
+				  messages.reply_to_message_id,
+				  (select count(*) from messages as replies where replies.reply_to_message_id = messages.id),
+				  messages.created_at
+			 from messages
+			where reply_to_message_id = $1
+			order by created_at asc`
+
+	rows, err := s.db.Query(ctx, sql, message)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	defer rows.Close()
+
+	replies := make([]Message, 0, root.ReplyCount)
+	for rows.Next() {
+		var m Message
+		err = rows.Scan(&m.ID, &m.Chat, &m.Author, &m.Text, &m.ReplyTo, &m.ReplyCount, &m.CreatedAt)
+		if err != nil {
+			return Message{}, nil, err
+		}
+		replies = append(replies, m)
+	}
+
+	if rows.Err() != nil {
+		return Message{}, nil, rows.Err()
+	}
+
+	s.logger.Debugf("Retrieved %d replies", len(replies))
+
+	return root, replies, nil
+}
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"avito-trainee-assignment/internal/storage/zapadapter"
 	mytesting "avito-trainee-assignment/internal/testing"
 	"context"
+	"errors"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"math"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,6 +32,19 @@ func TestNewStore(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestPoolStats(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+	_, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	stats := s.PoolStats()
+	require.Greater(t, stats.AcquireCount, int64(0))
+	require.Greater(t, stats.TotalConns, int32(0))
+	require.Equal(t, s.db.Config().MaxConns, stats.MaxConns)
+}
+
 func TestCreateUser(t *testing.T) {
 	t.Parallel()
 
@@ -262,7 +280,7 @@ func TestMessagesByChatID(t *testing.T) {
 
 	expected := messageIDs
 
-	messages, err := s.MessagesByChatID(context.Background(), chatID)
+	messages, err := s.MessagesByChatID(context.Background(), chatID, 0)
 	require.NoError(t, err)
 
 	actual := make([]int64, 0, len(messages))
@@ -278,6 +296,1157 @@ func TestMessagesByChatIDNotExist(t *testing.T) {
 
 	s := bootstrap(t)
 
-	_, err := s.MessagesByChatID(context.Background(), 0)
+	_, err := s.MessagesByChatID(context.Background(), 0, 0)
 	require.Equal(t, ErrChatNotExist, err)
 }
+
+func TestLatestMessagesByChatIDs(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	chatOneID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	chatTwoID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	// number of messages per chat
+	n := 3
+	expected := make(map[int64][]int64, 2)
+	for _, chatID := range []int64{chatOneID, chatTwoID} {
+		for i := 0; i < n; i++ {
+			id, err := s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+			require.NoError(t, err)
+			if i > 0 {
+				expected[chatID] = append(expected[chatID], id)
+			}
+		}
+	}
+
+	messages, err := s.LatestMessagesByChatIDs(context.Background(), []int64{chatOneID, chatTwoID}, n-1)
+	require.NoError(t, err)
+
+	actual := make(map[int64][]int64, len(messages))
+	for chatID, chatMessages := range messages {
+		for _, m := range chatMessages {
+			actual[chatID] = append(actual[chatID], m.ID)
+		}
+	}
+
+	require.Equal(t, expected, actual)
+}
+
+func TestMemberIDsByChatIDs(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userTwoID, userOneID})
+	require.NoError(t, err)
+
+	members, err := s.MemberIDsByChatIDs(context.Background(), []int64{chatID})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int64{userOneID, userTwoID}, members[chatID])
+}
+
+func TestSearchMessages(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userThreeID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	memberChatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	foreignChatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userTwoID, userThreeID})
+	require.NoError(t, err)
+
+	// random word guarantees that messages from other tests are not found
+	word := mytesting.RandString()
+
+	// number of matching messages in chat the first user is member of
+	n := 3
+	expected := make([]int64, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := s.CreateMessage(context.Background(), memberChatID, userTwoID, "deploy "+word+" finished")
+		require.NoError(t, err)
+		expected = append(expected, id)
+	}
+
+	_, err = s.CreateMessage(context.Background(), foreignChatID, userTwoID, "deploy "+word+" finished")
+	require.NoError(t, err)
+
+	// retrieving results page by page
+	var (
+		actual []int64
+		cursor string
+	)
+	for {
+		results, next, err := s.SearchMessages(context.Background(), userOneID, word, 2, cursor)
+		require.NoError(t, err)
+
+		for _, r := range results {
+			require.Contains(t, r.Snippet, "<b>"+word+"</b>")
+			actual = append(actual, r.ID)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	require.ElementsMatch(t, expected, actual)
+}
+
+func TestSearchMessagesEscapesSnippet(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+
+	word := mytesting.RandString()
+	text := `<script>alert("` + word + `")</script> deploy ` + word + " \x02finished\x03"
+	_, err = s.CreateMessage(context.Background(), chatID, userID, text)
+	require.NoError(t, err)
+
+	results, _, err := s.SearchMessages(context.Background(), userID, word, 10, "")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	require.NotContains(t, results[0].Snippet, "<script>")
+	require.Contains(t, results[0].Snippet, "&lt;script&gt;")
+	require.Contains(t, results[0].Snippet, "<b>"+word+"</b>")
+	// delimiters typed by the user do not turn into tags
+	require.NotContains(t, results[0].Snippet, "<b>finished</b>")
+	// the original text is kept as is
+	require.Equal(t, text, results[0].Text)
+}
+
+func TestSnippet(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, `&lt;img src=x onerror=&#34;alert(1)&#34;&gt; <b>deploy</b> &amp; go`,
+		snippet(`<img src=x onerror="alert(1)"> `+headlineStart+"deploy"+headlineStop+" & go"))
+}
+
+func TestSearchMessagesBadCursor(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	_, _, err = s.SearchMessages(context.Background(), userID, "hello", 10, "?")
+	require.Equal(t, ErrBadCursor, err)
+}
+
+func TestSearchMessagesUserNotExist(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	_, _, err := s.SearchMessages(context.Background(), 0, "hello", 10, "")
+	require.Equal(t, ErrUserNotExist, err)
+}
+
+func TestNewStoreUnknownSearchLanguage(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	_, err = NewStore(context.Background(), logger.Sugar(), SearchLanguage(mytesting.RandString()))
+	require.Error(t, err)
+}
+
+func TestMarkChatRead(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	// number of messages from the second user
+	n := 4
+	messageIDs := make([]int64, n)
+	for i := range messageIDs {
+		id, err := s.CreateMessage(context.Background(), chatID, userTwoID, mytesting.RandString())
+		require.NoError(t, err)
+		messageIDs[i] = id
+	}
+
+	// own messages must not be counted as unread
+	_, err = s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	chats, err := s.ChatsByUserID(context.Background(), userOneID)
+	require.NoError(t, err)
+	require.Len(t, chats, 1)
+	require.Equal(t, int64(n), chats[0].UnreadCount)
+	require.Nil(t, chats[0].LastReadMessageID)
+
+	lastRead, err := s.MarkChatRead(context.Background(), chatID, userOneID, messageIDs[1])
+	require.NoError(t, err)
+	require.Equal(t, messageIDs[1], lastRead)
+
+	// marking an older message keeps the pointer in place
+	lastRead, err = s.MarkChatRead(context.Background(), chatID, userOneID, messageIDs[0])
+	require.NoError(t, err)
+	require.Equal(t, messageIDs[1], lastRead)
+
+	chats, err = s.ChatsByUserID(context.Background(), userOneID)
+	require.NoError(t, err)
+	require.Equal(t, int64(n-2), chats[0].UnreadCount)
+	require.Equal(t, &messageIDs[1], chats[0].LastReadMessageID)
+}
+
+func TestMarkChatReadMessageNotInChat(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatOneID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	chatTwoID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	messageID, err := s.CreateMessage(context.Background(), chatTwoID, userTwoID, mytesting.RandString())
+	require.NoError(t, err)
+
+	_, err = s.MarkChatRead(context.Background(), chatOneID, userOneID, messageID)
+	require.Equal(t, ErrMessageNotInChat, err)
+}
+
+func TestMarkChatReadUserNotChatMember(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userThreeID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	messageID, err := s.CreateMessage(context.Background(), chatID, userTwoID, mytesting.RandString())
+	require.NoError(t, err)
+
+	_, err = s.MarkChatRead(context.Background(), chatID, userThreeID, messageID)
+	require.Equal(t, ErrUserNotChatMember, err)
+}
+
+func TestChatsByUserIDLastMessage(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	s, err := NewStore(context.Background(), logger.Sugar(), PreviewLength(5))
+	require.NoError(t, err)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	_, err = s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+	lastID, err := s.CreateMessage(context.Background(), chatID, userTwoID, "Привет, мир!")
+	require.NoError(t, err)
+
+	chats, err := s.ChatsByUserID(context.Background(), userOneID)
+	require.NoError(t, err)
+	require.Len(t, chats, 1)
+	require.NotNil(t, chats[0].LastMessage)
+	require.Equal(t, lastID, chats[0].LastMessage.ID)
+	require.Equal(t, userTwoID, chats[0].LastMessage.Author)
+	// preview length is measured in characters, not bytes
+	require.Equal(t, "Приве", chats[0].LastMessage.Text)
+}
+
+func TestNewStoreBadPreviewLength(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	_, err = NewStore(context.Background(), logger.Sugar(), PreviewLength(0))
+	require.Error(t, err)
+}
+
+func TestCreateDirectChat(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	id, created, err := s.CreateDirectChat(context.Background(), userOneID, userTwoID)
+	require.NoError(t, err)
+	require.True(t, created)
+
+	// reversed pair resolves to the same chat
+	existingID, created, err := s.CreateDirectChat(context.Background(), userTwoID, userOneID)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, id, existingID)
+}
+
+func TestCreateDirectChatConcurrent(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	// number of concurrent calls
+	n := 8
+
+	ids := make(chan int64, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			id, _, err := s.CreateDirectChat(context.Background(), userOneID, userTwoID)
+			ids <- id
+			errs <- err
+		}()
+	}
+
+	first := <-ids
+	require.NoError(t, <-errs)
+	for i := 1; i < n; i++ {
+		require.Equal(t, first, <-ids)
+		require.NoError(t, <-errs)
+	}
+}
+
+func TestCreateDirectChatSameUser(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	_, _, err = s.CreateDirectChat(context.Background(), userID, userID)
+	require.Equal(t, ErrChatBadUsers, err)
+}
+
+func TestCreateDirectChatBadUsers(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	_, _, err = s.CreateDirectChat(context.Background(), userID, math.MaxInt64)
+	require.Equal(t, ErrChatBadUsers, err)
+}
+
+func TestThread(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	rootID, err := s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	// number of replies
+	n := 3
+	expected := make([]int64, n)
+	for i := range expected {
+		id, err := s.CreateMessage(context.Background(), chatID, userTwoID, mytesting.RandString(), ReplyTo(rootID))
+		require.NoError(t, err)
+		expected[i] = id
+	}
+
+	root, replies, err := s.Thread(context.Background(), rootID)
+	require.NoError(t, err)
+	require.Equal(t, rootID, root.ID)
+	require.Equal(t, int64(n), root.ReplyCount)
+
+	actual := make([]int64, 0, len(replies))
+	for _, m := range replies {
+		require.Equal(t, &rootID, m.ReplyTo)
+		actual = append(actual, m.ID)
+	}
+	require.Equal(t, expected, actual)
+
+	messages, err := s.MessagesByChatID(context.Background(), chatID, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(n), messages[0].ReplyCount)
+}
+
+func TestThreadMessageNotExist(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	_, _, err := s.Thread(context.Background(), 0)
+	require.Equal(t, ErrMessageNotExist, err)
+}
+
+func TestCreateMessageReplyAcrossChats(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatOneID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	chatTwoID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	messageID, err := s.CreateMessage(context.Background(), chatOneID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	_, err = s.CreateMessage(context.Background(), chatTwoID, userTwoID, mytesting.RandString(), ReplyTo(messageID))
+	require.Equal(t, ErrMessageNotInChat, err)
+}
+
+func TestCreateMessageReplyNotExist(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	_, err = s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString(), ReplyTo(math.MaxInt64))
+	require.Equal(t, ErrMessageNotExist, err)
+}
+
+func TestReact(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	messageID, err := s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	require.NoError(t, s.React(context.Background(), messageID, userOneID, "👍"))
+	require.NoError(t, s.React(context.Background(), messageID, userTwoID, "👍"))
+	require.NoError(t, s.React(context.Background(), messageID, userTwoID, "🎉"))
+	// reacting twice is a no-op
+	require.NoError(t, s.React(context.Background(), messageID, userTwoID, "🎉"))
+
+	messages, err := s.MessagesByChatID(context.Background(), chatID, userOneID)
+	require.NoError(t, err)
+	require.Equal(t, map[string]Reaction{
+		"👍": {Count: 2, Reacted: true},
+		"🎉": {Count: 1, Reacted: false},
+	}, messages[0].Reactions)
+
+	require.NoError(t, s.Unreact(context.Background(), messageID, userTwoID, "🎉"))
+	require.Equal(t, ErrReactionNotExist, s.Unreact(context.Background(), messageID, userTwoID, "🎉"))
+
+	messages, err = s.MessagesByChatID(context.Background(), chatID, userOneID)
+	require.NoError(t, err)
+	require.Equal(t, map[string]Reaction{"👍": {Count: 2, Reacted: true}}, messages[0].Reactions)
+}
+
+func TestReactUserNotChatMember(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userThreeID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+	messageID, err := s.CreateMessage(context.Background(), chatID, userOneID, mytesting.RandString())
+	require.NoError(t, err)
+
+	err = s.React(context.Background(), messageID, userThreeID, "👍")
+	require.Equal(t, ErrUserNotChatMember, err)
+}
+
+func TestReactMessageNotExist(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	err = s.React(context.Background(), math.MaxInt64, userID, "👍")
+	require.Equal(t, ErrMessageNotExist, err)
+}
+
+func TestAttachments(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	outsiderID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID, userTwoID})
+	require.NoError(t, err)
+
+	require.NoError(t, s.CheckChatMember(context.Background(), chatID, userOneID))
+	require.Equal(t, ErrUserNotChatMember, s.CheckChatMember(context.Background(), chatID, outsiderID))
+
+	attachmentID, err := s.CreateAttachment(context.Background(), Attachment{
+		Chat:        chatID,
+		Uploader:    userOneID,
+		Filename:    "report.txt",
+		ContentType: "text/plain",
+		Size:        4,
+		Checksum:    "88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589",
+		BlobKey:     mytesting.RandString(),
+	})
+	require.NoError(t, err)
+
+	// another chat member can not link somebody else's attachment
+	_, err = s.CreateMessage(context.Background(), chatID, userTwoID, "", WithAttachments(attachmentID))
+	require.Equal(t, ErrBadAttachments, err)
+
+	messageID, err := s.CreateMessage(context.Background(), chatID, userOneID, "", WithAttachments(attachmentID))
+	require.NoError(t, err)
+
+	// attachment can not be linked twice
+	_, err = s.CreateMessage(context.Background(), chatID, userOneID, "", WithAttachments(attachmentID))
+	require.Equal(t, ErrBadAttachments, err)
+
+	messages, err := s.MessagesByChatID(context.Background(), chatID, userOneID)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Len(t, messages[0].Attachments, 1)
+	require.Equal(t, attachmentID, messages[0].Attachments[0].ID)
+	require.Equal(t, messageID, *messages[0].Attachments[0].Message)
+	require.Equal(t, "report.txt", messages[0].Attachments[0].Filename)
+
+	a, err := s.AttachmentByID(context.Background(), attachmentID, userTwoID)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), a.Size)
+
+	_, err = s.AttachmentByID(context.Background(), attachmentID, outsiderID)
+	require.Equal(t, ErrUserNotChatMember, err)
+
+	_, err = s.AttachmentByID(context.Background(), math.MaxInt64, userOneID)
+	require.Equal(t, ErrAttachmentNotExist, err)
+}
+
+func TestCreateAttachmentUserNotChatMember(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userOneID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	userTwoID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userOneID})
+	require.NoError(t, err)
+
+	_, err = s.CreateAttachment(context.Background(), Attachment{
+		Chat:        chatID,
+		Uploader:    userTwoID,
+		Filename:    "report.txt",
+		ContentType: "text/plain",
+		BlobKey:     mytesting.RandString(),
+	})
+	require.Equal(t, ErrUserNotChatMember, err)
+}
+
+func TestThumbnails(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+
+	imageID, err := s.CreateAttachment(context.Background(), Attachment{
+		Chat:        chatID,
+		Uploader:    userID,
+		Filename:    "cat.png",
+		ContentType: "image/png",
+		BlobKey:     mytesting.RandString(),
+	})
+	require.NoError(t, err)
+	brokenID, err := s.CreateAttachment(context.Background(), Attachment{
+		Chat:        chatID,
+		Uploader:    userID,
+		Filename:    "broken.png",
+		ContentType: "image/png",
+		BlobKey:     mytesting.RandString(),
+	})
+	require.NoError(t, err)
+
+	thumbnail := Thumbnail{Size: 128, Width: 128, Height: 64, ContentType: "image/png", BlobKey: mytesting.RandString()}
+	require.NoError(t, s.CreateThumbnail(context.Background(), imageID, thumbnail))
+	require.NoError(t, s.SetThumbnailError(context.Background(), brokenID, "decoding image: unknown format"))
+	require.Equal(t, ErrAttachmentNotExist, s.SetThumbnailError(context.Background(), math.MaxInt64, "reason"))
+
+	a, err := s.AttachmentByID(context.Background(), imageID, userID)
+	require.NoError(t, err)
+	require.Equal(t, []Thumbnail{thumbnail}, a.Thumbnails)
+	require.Nil(t, a.ThumbnailError)
+
+	_, err = s.CreateMessage(context.Background(), chatID, userID, "", WithAttachments(imageID, brokenID))
+	require.NoError(t, err)
+
+	messages, err := s.MessagesByChatID(context.Background(), chatID, userID)
+	require.NoError(t, err)
+	require.Len(t, messages[0].Attachments, 2)
+	require.Len(t, messages[0].Attachments[0].Thumbnails, 1)
+	require.Equal(t, 64, messages[0].Attachments[0].Thumbnails[0].Height)
+	require.Equal(t, "decoding image: unknown format", *messages[0].Attachments[1].ThumbnailError)
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+	anotherChatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+
+	webhookID, err := s.CreateWebhook(context.Background(), &chatID, "http://localhost/"+mytesting.RandString(), "secret")
+	require.NoError(t, err)
+	// subscription to another chat must not receive the event
+	_, err = s.CreateWebhook(context.Background(), &anotherChatID, "http://localhost/"+mytesting.RandString(), "secret")
+	require.NoError(t, err)
+
+	missingChatID := int64(math.MaxInt64)
+	_, err = s.CreateWebhook(context.Background(), &missingChatID, "http://localhost/", "secret")
+	require.Equal(t, ErrChatNotExist, err)
+
+	messageID, err := s.CreateMessage(context.Background(), chatID, userID, mytesting.RandString())
+	require.NoError(t, err)
+
+	// global webhooks created by parallel tests may be claimed as well, so only own delivery is inspected
+	var delivery *WebhookDelivery
+	for delivery == nil {
+		deliveries, err := s.ClaimWebhookDeliveries(context.Background(), 100, time.Minute)
+		require.NoError(t, err)
+		require.NotEmpty(t, deliveries)
+		for i := range deliveries {
+			if deliveries[i].Webhook == webhookID {
+				delivery = &deliveries[i]
+			}
+		}
+	}
+
+	require.Equal(t, EventMessageCreated, delivery.Event)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, "secret", delivery.Secret)
+	require.Contains(t, string(delivery.Payload), `"id": `+strconv.FormatInt(messageID, 10))
+
+	require.NoError(t, s.MarkWebhookFailed(context.Background(), delivery.ID, "connection refused", nil))
+
+	dead, err := s.DeadWebhookDeliveries(context.Background(), delivery.ID-1, 1)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, DeliveryStatusDead, dead[0].Status)
+	require.Equal(t, "connection refused", *dead[0].LastError)
+
+	require.NoError(t, s.ReplayWebhookDelivery(context.Background(), delivery.ID))
+	// only dead deliveries can be replayed
+	require.Equal(t, ErrDeliveryNotExist, s.ReplayWebhookDelivery(context.Background(), delivery.ID))
+	require.NoError(t, s.MarkWebhookDelivered(context.Background(), delivery.ID))
+}
+
+func TestDispatchOutbox(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+	messageID, err := s.CreateMessage(context.Background(), chatID, userID, mytesting.RandString())
+	require.NoError(t, err)
+
+	// failed publishing leaves events in outbox
+	errBroker := errors.New("broker is unavailable")
+	n, err := s.DispatchOutbox(context.Background(), 1, func(OutboxEvent) error {
+		return errBroker
+	})
+	require.Equal(t, errBroker, err)
+	require.Zero(t, n)
+
+	// outbox is shared with parallel tests, so only own events are inspected
+	var own []OutboxEvent
+	for {
+		n, err := s.DispatchOutbox(context.Background(), 100, func(e OutboxEvent) error {
+			if (e.Aggregate == AggregateChat && e.AggregateID == chatID) ||
+				(e.Aggregate == AggregateMessage && e.AggregateID == messageID) {
+				own = append(own, e)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		if n == 0 {
+			break
+		}
+	}
+
+	require.Len(t, own, 2)
+	require.Equal(t, EventChatCreated, own[0].Type)
+	require.Equal(t, EventMessageCreated, own[1].Type)
+	require.Contains(t, string(own[1].Payload), `"chat": `+strconv.FormatInt(chatID, 10))
+}
+
+func TestListenOutbox(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	listener, err := s.ListenOutbox(context.Background())
+	require.NoError(t, err)
+	defer listener.Close()
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	_, err = s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, listener.Wait(ctx))
+}
+
+func TestEnsureBot(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	callbackURL := "https://example.com/bot"
+	b := Bot{
+		Username:    mytesting.RandString(),
+		CallbackURL: &callbackURL,
+		Secret:      "0123456789abcdef",
+		Commands:    []string{"deploy"},
+		RateLimit:   10,
+		Timeout:     1000,
+	}
+
+	id, err := s.EnsureBot(context.Background(), b)
+	require.NoError(t, err)
+
+	b.Commands = []string{"deploy", "rollback"}
+	sameID, err := s.EnsureBot(context.Background(), b)
+	require.NoError(t, err)
+	require.Equal(t, id, sameID)
+
+	bots, err := s.CallbackBots(context.Background())
+	require.NoError(t, err)
+
+	var found bool
+	for _, cb := range bots {
+		if cb.ID == id {
+			found = true
+			require.Equal(t, b.Username, cb.Username)
+			require.Equal(t, b.Commands, cb.Commands)
+		}
+	}
+	require.True(t, found)
+
+	users, err := s.UsersByIDs(context.Background(), []int64{id})
+	require.NoError(t, err)
+	require.Equal(t, UserTypeBot, users[0].Type)
+}
+
+func TestEnsureBotHumanUsername(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	username := mytesting.RandString()
+	_, err := s.CreateUser(context.Background(), username)
+	require.NoError(t, err)
+
+	_, err = s.EnsureBot(context.Background(), Bot{Username: username, Commands: []string{"ping"}, RateLimit: 1, Timeout: 1})
+	require.Equal(t, ErrUserExists, err)
+}
+
+func TestParseMentions(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string][]string{
+		"hi @alice and @bob.":            {"alice", "bob"},
+		"@alice, @alice!":                {"alice"},
+		"mail me at alice@example.com":   nil,
+		"@@alice":                        nil,
+		"(@иван) @user.name-":            {"иван", "user.name"},
+		"/deploy@deploybot with no @ at": nil,
+	}
+
+	for text, expected := range cases {
+		require.Equal(t, expected, ParseMentions(text), text)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	authorName := mytesting.RandString()
+	authorID, err := s.CreateUser(context.Background(), authorName)
+	require.NoError(t, err)
+	mentionedName := mytesting.RandString()
+	mentionedID, err := s.CreateUser(context.Background(), mentionedName)
+	require.NoError(t, err)
+	outsiderName := mytesting.RandString()
+	_, err = s.CreateUser(context.Background(), outsiderName)
+	require.NoError(t, err)
+
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{authorID, mentionedID})
+	require.NoError(t, err)
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := s.CreateMessage(context.Background(), chatID, authorID, "@"+mentionedName+" @"+outsiderName+" @"+authorName)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	mentions, next, err := s.UnreadMentions(context.Background(), mentionedID, 2, "")
+	require.NoError(t, err)
+	require.Len(t, mentions, 2)
+	require.Equal(t, ids[2], mentions[0].ID)
+	require.NotEmpty(t, next)
+
+	mentions, next, err = s.UnreadMentions(context.Background(), mentionedID, 2, next)
+	require.NoError(t, err)
+	require.Len(t, mentions, 1)
+	require.Equal(t, ids[0], mentions[0].ID)
+	require.Empty(t, next)
+
+	// neither the author nor non-members are mentioned
+	mentions, _, err = s.UnreadMentions(context.Background(), authorID, 10, "")
+	require.NoError(t, err)
+	require.Empty(t, mentions)
+
+	marked, err := s.MarkMentionsRead(context.Background(), mentionedID, []int64{ids[2], ids[2]})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), marked)
+
+	_, err = s.MarkChatRead(context.Background(), chatID, mentionedID, ids[1])
+	require.NoError(t, err)
+
+	mentions, _, err = s.UnreadMentions(context.Background(), mentionedID, 10, "")
+	require.NoError(t, err)
+	require.Empty(t, mentions)
+}
+
+func TestUnreadMentionsBadCursor(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	userID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+
+	_, _, err = s.UnreadMentions(context.Background(), userID, 10, "!")
+	require.Equal(t, ErrBadCursor, err)
+}
+
+func TestPurgeMessages(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	authorID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	readerName := mytesting.RandString()
+	readerID, err := s.CreateUser(context.Background(), readerName)
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{authorID, readerID})
+	require.NoError(t, err)
+
+	blobKey := mytesting.RandString()
+	attachmentID, err := s.CreateAttachment(context.Background(), Attachment{
+		Chat:        chatID,
+		Uploader:    authorID,
+		Filename:    "report.txt",
+		ContentType: "text/plain",
+		Size:        4,
+		Checksum:    "88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589",
+		BlobKey:     blobKey,
+	})
+	require.NoError(t, err)
+
+	// the oldest message is mentioned, reacted, replied and has an attachment
+	oldestID, err := s.CreateMessage(context.Background(), chatID, authorID, "@"+readerName, WithAttachments(attachmentID))
+	require.NoError(t, err)
+	require.NoError(t, s.React(context.Background(), oldestID, readerID, "👍"))
+
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		id, err := s.CreateMessage(context.Background(), chatID, authorID, strconv.Itoa(i), ReplyTo(oldestID))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	maxCount := 2
+	require.NoError(t, s.SetChatRetention(context.Background(), ChatRetention{Chat: chatID, MaxCount: &maxCount}))
+
+	targets, err := s.RetentionTargets(context.Background(), RetentionPolicy{})
+	require.NoError(t, err)
+	require.Contains(t, targets, RetentionTarget{Chat: chatID, Policy: RetentionPolicy{MaxCount: 2}})
+
+	purge, err := s.PurgeMessages(context.Background(), chatID, RetentionPolicy{MaxCount: maxCount}, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), purge.Messages)
+	require.Equal(t, int64(1), purge.Attachments)
+	require.Equal(t, []string{blobKey}, purge.BlobKeys)
+
+	purge, err = s.PurgeMessages(context.Background(), chatID, RetentionPolicy{MaxCount: maxCount}, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), purge.Messages)
+
+	messages, err := s.MessagesByChatID(context.Background(), chatID, authorID)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, ids[2], messages[0].ID)
+	require.Nil(t, messages[0].ReplyTo)
+
+	mentions, _, err := s.UnreadMentions(context.Background(), readerID, 10, "")
+	require.NoError(t, err)
+	require.Empty(t, mentions)
+
+	// unlimited per-chat settings override the global policy
+	zero := 0
+	require.NoError(t, s.SetChatRetention(context.Background(), ChatRetention{Chat: chatID, MaxCount: &zero}))
+	targets, err = s.RetentionTargets(context.Background(), RetentionPolicy{MaxCount: 1})
+	require.NoError(t, err)
+	for _, target := range targets {
+		require.NotEqual(t, chatID, target.Chat)
+	}
+
+	require.Equal(t, ErrChatNotExist, s.SetChatRetention(context.Background(), ChatRetention{Chat: math.MaxInt64}))
+}
+
+func TestExportUser(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	username := mytesting.RandString()
+	userID, err := s.CreateUser(context.Background(), username)
+	require.NoError(t, err)
+	otherID, err := s.CreateUser(context.Background(), mytesting.RandString())
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID, otherID})
+	require.NoError(t, err)
+	messageID, err := s.CreateMessage(context.Background(), chatID, userID, "mine")
+	require.NoError(t, err)
+	_, err = s.CreateMessage(context.Background(), chatID, otherID, "not mine")
+	require.NoError(t, err)
+
+	var kinds []string
+	var records []interface{}
+	err = s.ExportUser(context.Background(), userID, func(kind string, record interface{}) error {
+		kinds = append(kinds, kind)
+		records = append(records, record)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{ExportRecordUser, ExportRecordChat, ExportRecordMessage}, kinds)
+	require.Equal(t, username, records[0].(User).Username)
+	require.Equal(t, chatID, records[1].(Membership).Chat)
+	require.Equal(t, messageID, records[2].(Message).ID)
+
+	events, err := s.AuditEvents(context.Background(), AuditFilter{Target: UserTarget(userID), Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, AuditUserExported, events[0].Action)
+
+	err = s.ExportUser(context.Background(), math.MaxInt64, func(string, interface{}) error {
+		return nil
+	})
+	require.Equal(t, ErrUserNotExist, err)
+}
+
+func TestDeleteUser(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	username := mytesting.RandString()
+	userID, err := s.CreateUser(context.Background(), username)
+	require.NoError(t, err)
+	chatID, err := s.CreateChat(context.Background(), mytesting.RandString(), []int64{userID})
+	require.NoError(t, err)
+	_, err = s.CreateMessage(context.Background(), chatID, userID, "before deletion")
+	require.NoError(t, err)
+
+	actor := time.Now().UnixNano()
+	ctx := zapadapter.NewContextWithID(NewContextWithClaimedActor(context.Background(), actor), "request")
+	require.NoError(t, s.DeleteUser(ctx, userID))
+	// deleting twice is a no-op
+	require.NoError(t, s.DeleteUser(ctx, userID))
+
+	// the deletion is recorded once along with claims from the context
+	events, err := s.AuditEvents(context.Background(), AuditFilter{Target: UserTarget(userID), Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, AuditUserDeleted, events[0].Action)
+	require.Equal(t, actor, *events[0].ClaimedActor)
+	require.Equal(t, "request", *events[0].ClaimedRequestID)
+
+	users, err := s.UsersByIDs(context.Background(), []int64{userID})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(users[0].Username, tombstonePrefix))
+
+	// history is kept while new messages are rejected
+	messages, err := s.MessagesByChatID(context.Background(), chatID, userID)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+
+	_, err = s.CreateMessage(context.Background(), chatID, userID, "after deletion")
+	require.Equal(t, ErrUserNotExist, err)
+
+	// the username is free again
+	_, err = s.CreateUser(context.Background(), username)
+	require.NoError(t, err)
+
+	require.Equal(t, ErrUserNotExist, s.DeleteUser(context.Background(), math.MaxInt64))
+}
+
+func TestHashAuditEvent(t *testing.T) {
+	t.Parallel()
+
+	actor := int64(1)
+	e := AuditEvent{
+		ID:           1,
+		ClaimedActor: &actor,
+		Action:       "user.deleted",
+		Target:       "user:2",
+		Outcome:      AuditOutcomeSuccess,
+		PrevHash:     auditGenesisHash,
+		CreatedAt:    time.Date(2020, 8, 1, 12, 0, 0, 1000, time.UTC),
+	}
+
+	hash, err := hashAuditEvent(e)
+	require.NoError(t, err)
+	require.Len(t, hash, 64)
+
+	// the same moment in another time zone gives the same hash
+	e.CreatedAt = e.CreatedAt.In(time.FixedZone("MSK", 3*60*60))
+	sameHash, err := hashAuditEvent(e)
+	require.NoError(t, err)
+	require.Equal(t, hash, sameHash)
+
+	e.Target = "user:3"
+	otherHash, err := hashAuditEvent(e)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, otherHash)
+}
+
+func TestAuditEvents(t *testing.T) {
+	t.Parallel()
+
+	s := bootstrap(t)
+
+	actor := time.Now().UnixNano()
+	target := "user:" + mytesting.RandString()
+	var ids []int64
+	for _, outcome := range []string{AuditOutcomeRejected, AuditOutcomeSuccess} {
+		id, err := s.RecordAuditEvent(context.Background(), AuditEvent{
+			ClaimedActor: &actor,
+			Action:       "user.deleted",
+			Target:       target,
+			Outcome:      outcome,
+		})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	require.Less(t, ids[0], ids[1])
+
+	events, err := s.AuditEvents(context.Background(), AuditFilter{ClaimedActor: &actor, Target: target, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, AuditOutcomeRejected, events[0].Outcome)
+
+	events, err = s.AuditEvents(context.Background(), AuditFilter{Target: target, After: ids[0], Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	future := time.Now().Add(time.Hour)
+	events, err = s.AuditEvents(context.Background(), AuditFilter{Target: target, From: &future, Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	n, err := s.VerifyAuditChain(context.Background())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, n, int64(2))
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// instrumentationName identifies spans recorded by the package
+const instrumentationName = "avito-trainee-assignment/internal/storage"
+
+// startSpan starts a span of Store method, the span is a child of the span in ctx if there is one
+func (s *Store) startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "Store."+method, trace.WithAttributes(semconv.DBSystemPostgres))
+}
+
+// endSpan ends span of Store method recording the error returned by the method if there is one
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// queryTracer is a pgx logger recording a span of every executed query and passing entries to the next logger.
+// pgx does not notify about started queries, so spans are recorded after the fact
+// using the query duration from entry data.
+type queryTracer struct {
+	tracer trace.Tracer
+	next   pgx.Logger
+}
+
+func (t *queryTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	t.record(ctx, msg, data)
+	t.next.Log(ctx, level, msg, data)
+}
+
+// record records a span if entry data describes a query, i.e. it has "sql" key.
+// Failed queries have no duration, their spans are empty and have error status.
+func (t *queryTracer) record(ctx context.Context, msg string, data map[string]interface{}) {
+	sql, ok := data["sql"].(string)
+	if !ok {
+		return
+	}
+
+	end := time.Now()
+	start := end
+	if d, ok := data["time"].(time.Duration); ok {
+		start = end.Add(-d)
+	}
+
+	_, span := t.tracer.Start(ctx, "pgx."+msg,
+		trace.WithTimestamp(start),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgres, semconv.DBStatementKey.String(sql)),
+	)
+
+	if n, ok := data["rowCount"].(int); ok {
+		span.SetAttributes(label.Int("db.row_count", n))
+	}
+
+	if err, ok := data["err"].(error); ok {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/oteltest"
+	"testing"
+	"time"
+)
+
+// nopLogger is a pgx logger counting entries
+type nopLogger struct {
+	entries int
+}
+
+func (l *nopLogger) Log(context.Context, pgx.LogLevel, string, map[string]interface{}) {
+	l.entries++
+}
+
+func TestQueryTracer(t *testing.T) {
+	recorder := new(oteltest.StandardSpanRecorder)
+	tracer := oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder)).Tracer(instrumentationName)
+	next := &nopLogger{}
+	qt := &queryTracer{tracer: tracer, next: next}
+
+	ctx, parent := tracer.Start(context.Background(), "Store.CreateUser")
+	qt.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{
+		"sql":      "select 1",
+		"time":     time.Second,
+		"rowCount": 1,
+	})
+	qt.Log(ctx, pgx.LogLevelError, "Exec", map[string]interface{}{
+		"sql": "delete from users",
+		"err": errors.New("permission denied"),
+	})
+	// entries not describing queries have no spans
+	qt.Log(ctx, pgx.LogLevelInfo, "closed connection", nil)
+	parent.End()
+
+	require.Equal(t, 3, next.entries)
+
+	spans := recorder.Completed()
+	require.Len(t, spans, 3)
+
+	query := spans[0]
+	require.Equal(t, "pgx.Query", query.Name())
+	require.Equal(t, parent.SpanContext().SpanID, query.ParentSpanID())
+	require.Equal(t, label.StringValue("select 1"), query.Attributes()["db.statement"])
+	end, ok := query.EndTime()
+	require.True(t, ok)
+	require.Equal(t, time.Second, end.Sub(query.StartTime()))
+
+	exec := spans[1]
+	require.Equal(t, "pgx.Exec", exec.Name())
+	require.Equal(t, codes.Error, exec.StatusCode())
+	require.Equal(t, "permission denied", exec.StatusMessage())
+}
+
+func TestStoreSpans(t *testing.T) {
+	recorder := new(oteltest.StandardSpanRecorder)
+	s := &Store{tracer: oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder)).Tracer(instrumentationName)}
+
+	method := func(fail bool) (err error) {
+		_, span := s.startSpan(context.Background(), "Method")
+		defer endSpan(span, &err)
+
+		if fail {
+			return ErrUserNotExist
+		}
+		return nil
+	}
+
+	require.NoError(t, method(false))
+	require.Equal(t, ErrUserNotExist, method(true))
+
+	spans := recorder.Completed()
+	require.Len(t, spans, 2)
+	require.Equal(t, "Store.Method", spans[0].Name())
+	require.Equal(t, codes.Unset, spans[0].StatusCode())
+	require.Empty(t, spans[0].Events())
+
+	require.Equal(t, codes.Error, spans[1].StatusCode())
+	require.Equal(t, ErrUserNotExist.Error(), spans[1].StatusMessage())
+	require.Len(t, spans[1].Events(), 1)
+	require.Equal(t, "error", spans[1].Events()[0].Name)
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// EventMessageCreated is sent to webhooks subscribed to the chat of a new message
+const EventMessageCreated = "message.created"
+
+var ErrDeliveryNotExist = errors.New("webhook delivery does not exist")
+
+// CreateWebhook subscribes provided URL to events of the chat or to events of all chats if chat is nil
+func (s *Store) CreateWebhook(ctx context.Context, chat *int64, url, secret string) (_ int64, err error) {
+	ctx, span := s.startSpan(ctx, "CreateWebhook")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Creating webhook for %s", url)
+
+	var id int64
+	sql := "insert into webhooks (chat_id, url, secret, created_at) values ($1, $2, $3, $4) returning id"
+	err = s.db.QueryRow(ctx, sql, chat, url, secret, time.Now()).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return 0, ErrChatNotExist
+		}
+		return 0, err
+	}
+
+	s.logger.Debugf("Created webhook with id %d", id)
+
+	return id, nil
+}
+
+// enqueueWebhookDeliveries schedules delivery of the event to every webhook subscribed to the chat.
+// It is called inside the transaction of the domain change, so the event is never lost after commit.
+func enqueueWebhookDeliveries(ctx context.Context, tx pgx.Tx, chat int64, event string, data map[string]interface{}) error {
+	payload := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		payload[k] = v
+	}
+	payload["event"] = event
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	sql := `insert into webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+			select webhooks.id, $2, $3, 'pending', 0, $4, $4
+			  from webhooks
+			 where webhooks.chat_id = $1
+			    or webhooks.chat_id is null`
+	_, err = tx.Exec(ctx, sql, chat, event, encoded, time.Now())
+
+	return err
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries which are due and postpones them by lease,
+// so concurrent dispatchers do not send the same delivery twice while it is in flight.
+// Attempts counter of returned deliveries already includes the upcoming attempt.
+func (s *Store) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (_ []WebhookDelivery, err error) {
+	ctx, span := s.startSpan(ctx, "ClaimWebhookDeliveries")
+	defer endSpan(span, &err)
+
+	sql := `with due as (
+				select id
+				  from webhook_deliveries
+				 where status = 'pending'
+				   and next_attempt_at <= now()
+				 order by next_attempt_at
+				 limit $1
+				   for update skip locked
+			)
+			update webhook_deliveries
+			   set attempts = webhook_deliveries.attempts + 1,
+				   next_attempt_at = now() + $2::interval
+			  from due, webhooks
+			 where webhook_deliveries.id = due.id
+			   and webhooks.id = webhook_deliveries.webhook_id
+		 returning webhook_deliveries.id,
+				   webhook_deliveries.webhook_id,
+				   webhooks.url,
+				   webhooks.secret,
+				   webhook_deliveries.event,
+				   webhook_deliveries.payload,
+				   webhook_deliveries.status,
+				   webhook_deliveries.attempts,
+				   webhook_deliveries.last_error,
+				   webhook_deliveries.next_attempt_at,
+				   webhook_deliveries.created_at`
+	rows, err := s.db.Query(ctx, sql, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanWebhookDeliveries(rows)
+}
+
+// MarkWebhookDelivered marks delivery as successfully sent
+func (s *Store) MarkWebhookDelivered(ctx context.Context, id int64) (err error) {
+	ctx, span := s.startSpan(ctx, "MarkWebhookDelivered")
+	defer endSpan(span, &err)
+
+	sql := "update webhook_deliveries set status = 'delivered', last_error = null, delivered_at = $2 where id = $1"
+	tag, err := s.db.Exec(ctx, sql, id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeliveryNotExist
+	}
+
+	return nil
+}
+
+// MarkWebhookFailed records failed attempt of the delivery.
+// The delivery is retried at retryAt or moved to dead-letter state if retryAt is nil.
+func (s *Store) MarkWebhookFailed(ctx context.Context, id int64, reason string, retryAt *time.Time) (err error) {
+	ctx, span := s.startSpan(ctx, "MarkWebhookFailed")
+	defer endSpan(span, &err)
+
+	sql := `update webhook_deliveries
+			   set status = case when $3::timestamptz is null then 'dead' else 'pending' end,
+				   last_error = $2,
+				   next_attempt_at = coalesce($3, next_attempt_at)
+			 where id = $1`
+	tag, err := s.db.Exec(ctx, sql, id, reason, retryAt)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeliveryNotExist
+	}
+
+	return nil
+}
+
+// DeadWebhookDeliveries returns up to limit dead-lettered deliveries with id greater than after, sorted by id
+func (s *Store) DeadWebhookDeliveries(ctx context.Context, after int64, limit int) (_ []WebhookDelivery, err error) {
+	ctx, span := s.startSpan(ctx, "DeadWebhookDeliveries")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Retrieving dead webhook deliveries after id %d", after)
+
+	sql := `select webhook_deliveries.id,
+				   webhook_deliveries.webhook_id,
+				   webhooks.url,
+				   webhooks.secret,
+				   webhook_deliveries.event,
+				   webhook_deliveries.payload,
+				   webhook_deliveries.status,
+				   webhook_deliveries.attempts,
+				   webhook_deliveries.last_error,
+				   webhook_deliveries.next_attempt_at,
+				   webhook_deliveries.created_at
+			  from webhook_deliveries
+			  join webhooks on webhooks.id = webhook_deliveries.webhook_id
+			 where webhook_deliveries.status = 'dead'
+			   and webhook_deliveries.id > $1
+			 order by webhook_deliveries.id
+			 limit $2`
+	rows, err := s.db.Query(ctx, sql, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanWebhookDeliveries(rows)
+}
+
+// ReplayWebhookDelivery moves dead-lettered delivery back to the queue with reset attempts counter
+func (s *Store) ReplayWebhookDelivery(ctx context.Context, id int64) (err error) {
+	ctx, span := s.startSpan(ctx, "ReplayWebhookDelivery")
+	defer endSpan(span, &err)
+
+	s.logger.Debugf("Replaying webhook delivery (id: %d)", id)
+
+	sql := `update webhook_deliveries
+			   set status = 'pending',
+				   attempts = 0,
+				   next_attempt_at = $2
+			 where id = $1
+			   and status = 'dead'`
+	tag, err := s.db.Exec(ctx, sql, id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeliveryNotExist
+	}
+
+	return nil
+}
+
+func scanWebhookDeliveries(rows pgx.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(
+			&d.ID, &d.Webhook, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.LastError,
+			&d.NextAttemptAt, &d.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return deliveries, nil
+}
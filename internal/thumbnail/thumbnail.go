@@ -0,0 +1,354 @@
+// Package thumbnail generates downscaled copies of image attachments in a bounded pool of background workers.
+package thumbnail
+
+import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/storage"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/image/draw"
+	"image"
+	// registering gif decoder, png and jpeg ones are registered by encoders imports
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers   = 2
+	defaultQueueSize = 64
+	// defaultMaxPixels rejects images which would take too much memory once decoded
+	defaultMaxPixels = 50_000_000
+	// jobTimeout bounds time spent on a single attachment
+	jobTimeout  = 30 * time.Second
+	jpegQuality = 85
+)
+
+var (
+	ErrQueueFull = errors.New("thumbnail queue is full")
+	ErrClosed    = errors.New("thumbnail pool is closed")
+)
+
+// defaultSizes are maximum dimensions of generated thumbnails
+var defaultSizes = []int{128, 512}
+
+// Recorder persists results of thumbnail generation, it is implemented by storage.Store
+type Recorder interface {
+	CreateThumbnail(ctx context.Context, attachment int64, t storage.Thumbnail) error
+	SetThumbnailError(ctx context.Context, attachment int64, reason string) error
+}
+
+// Job describes uploaded attachment to generate thumbnails for
+type Job struct {
+	Attachment int64
+	BlobKey    string
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Pool instance
+type config struct {
+	sizes     []int
+	workers   int
+	queueSize int
+	maxPixels int
+}
+
+// EnvConfig defines fields used for parsing from environment variables
+type EnvConfig struct {
+	Sizes     []int `env:"THUMBNAIL_SIZES" envDefault:"128,512" envSeparator:","`
+	Workers   int   `env:"THUMBNAIL_WORKERS" envDefault:"2"`
+	QueueSize int   `env:"THUMBNAIL_QUEUE_SIZE" envDefault:"64"`
+}
+
+// WithEnvConfig enables processing exported EnvConfig struct to acts as a source of config parameters for Pool
+func WithEnvConfig(cfg EnvConfig) Option {
+	return optionFunc(func(c *config) {
+		c.sizes = cfg.Sizes
+		c.workers = cfg.Workers
+		c.queueSize = cfg.QueueSize
+	})
+}
+
+// Sizes sets maximum dimensions of generated thumbnails, one thumbnail is generated per size
+func Sizes(sizes ...int) Option {
+	return optionFunc(func(c *config) {
+		c.sizes = sizes
+	})
+}
+
+// Workers sets number of goroutines generating thumbnails concurrently
+func Workers(n int) Option {
+	return optionFunc(func(c *config) {
+		c.workers = n
+	})
+}
+
+// QueueSize sets number of jobs waiting for a free worker before Enqueue starts failing with ErrQueueFull
+func QueueSize(n int) Option {
+	return optionFunc(func(c *config) {
+		c.queueSize = n
+	})
+}
+
+// MaxPixels sets the maximum width*height of source images, larger images are rejected before decoding
+func MaxPixels(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxPixels = n
+	})
+}
+
+// Pool generates thumbnails of enqueued attachments using fixed number of workers
+type Pool struct {
+	logger    *zap.SugaredLogger
+	blobs     blob.BlobStore
+	recorder  Recorder
+	sizes     []int
+	maxPixels int
+
+	mu     sync.RWMutex
+	closed bool
+	jobs   chan Job
+	wg     sync.WaitGroup
+}
+
+// NewPool constructs a Pool and starts its workers. See the various Options for available customizations.
+func NewPool(logger *zap.SugaredLogger, blobs blob.BlobStore, recorder Recorder, opts ...Option) (*Pool, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+
+	if blobs == nil {
+		return nil, errors.New("no blob store provided")
+	}
+
+	if recorder == nil {
+		return nil, errors.New("no recorder provided")
+	}
+
+	cfg := &config{
+		sizes:     defaultSizes,
+		workers:   defaultWorkers,
+		queueSize: defaultQueueSize,
+		maxPixels: defaultMaxPixels,
+	}
+
+	for _, o := range opts {
+		o.apply(cfg)
+	}
+
+	if len(cfg.sizes) == 0 {
+		return nil, errors.New("no thumbnail sizes provided")
+	}
+
+	for _, size := range cfg.sizes {
+		if size < 1 {
+			return nil, fmt.Errorf("thumbnail size must be positive, got %d", size)
+		}
+	}
+
+	if cfg.workers < 1 {
+		return nil, fmt.Errorf("number of workers must be positive, got %d", cfg.workers)
+	}
+
+	if cfg.queueSize < 0 {
+		return nil, fmt.Errorf("queue size must not be negative, got %d", cfg.queueSize)
+	}
+
+	p := &Pool{
+		logger:    logger,
+		blobs:     blobs,
+		recorder:  recorder,
+		sizes:     cfg.sizes,
+		maxPixels: cfg.maxPixels,
+		jobs:      make(chan Job, cfg.queueSize),
+	}
+
+	p.wg.Add(cfg.workers)
+	for i := 0; i < cfg.workers; i++ {
+		go p.work()
+	}
+
+	return p, nil
+}
+
+// Supported reports whether thumbnails can be generated for provided content type
+func Supported(contentType string) bool {
+	switch strings.ToLower(contentType) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// Enqueue schedules thumbnail generation without blocking.
+// It fails with ErrQueueFull when all workers are busy and the queue is full.
+func (p *Pool) Enqueue(j Job) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	select {
+	case p.jobs <- j:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting new jobs and waits until already enqueued ones are processed
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for j := range p.jobs {
+		ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+		p.process(ctx, j)
+		cancel()
+	}
+}
+
+// process generates all configured thumbnails of a single attachment.
+// Failures are recorded for the attachment, so the message itself stays intact.
+func (p *Pool) process(ctx context.Context, j Job) {
+	err := p.generate(ctx, j)
+	if err == nil {
+		return
+	}
+
+	p.logger.Warnf("Cannot generate thumbnails for attachment (id: %d): %v", j.Attachment, err)
+
+	err = p.recorder.SetThumbnailError(ctx, j.Attachment, err.Error())
+	if err != nil {
+		p.logger.Errorf("Cannot record thumbnail failure for attachment (id: %d): %v", j.Attachment, err)
+	}
+}
+
+func (p *Pool) generate(ctx context.Context, j Job) error {
+	rc, err := p.blobs.Get(ctx, j.BlobKey)
+	if err != nil {
+		return fmt.Errorf("reading original: %w", err)
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, rc)
+	if err != nil {
+		return fmt.Errorf("reading original: %w", err)
+	}
+
+	// checking dimensions before decoding the whole image to protect against decompression bombs
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+
+	if cfg.Width*cfg.Height > p.maxPixels {
+		return fmt.Errorf("image is too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(&buf)
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+
+	for _, size := range p.sizes {
+		t, err := p.generateSize(ctx, j, src, format, size)
+		if err != nil {
+			return err
+		}
+
+		err = p.recorder.CreateThumbnail(ctx, j.Attachment, t)
+		if err != nil {
+			return fmt.Errorf("recording %dpx thumbnail: %w", size, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Pool) generateSize(ctx context.Context, j Job, src image.Image, format string, size int) (storage.Thumbnail, error) {
+	width, height := fit(src.Bounds().Dx(), src.Bounds().Dy(), size)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	// keeping transparency of png and gif sources, everything else becomes jpeg
+	var out bytes.Buffer
+	contentType := "image/jpeg"
+	var err error
+	if format == "png" || format == "gif" {
+		contentType = "image/png"
+		err = png.Encode(&out, dst)
+	} else {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return storage.Thumbnail{}, fmt.Errorf("encoding %dpx thumbnail: %w", size, err)
+	}
+
+	key := j.BlobKey + ".thumb-" + strconv.Itoa(size)
+	err = p.blobs.Put(ctx, key, &out, int64(out.Len()), contentType)
+	if err != nil {
+		return storage.Thumbnail{}, fmt.Errorf("storing %dpx thumbnail: %w", size, err)
+	}
+
+	return storage.Thumbnail{
+		Size:        size,
+		Width:       width,
+		Height:      height,
+		ContentType: contentType,
+		BlobKey:     key,
+	}, nil
+}
+
+// fit scales width and height preserving aspect ratio so that both fit into size, images are never upscaled
+func fit(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+
+	if width >= height {
+		h := height * size / width
+		if h < 1 {
+			h = 1
+		}
+		return size, h
+	}
+
+	w := width * size / height
+	if w < 1 {
+		w = 1
+	}
+	return w, size
+}
@@ -0,0 +1,173 @@
+package thumbnail
+
+import (
+	"avito-trainee-assignment/internal/blob"
+	"avito-trainee-assignment/internal/storage"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// memoryRecorder implements Recorder keeping results in memory
+type memoryRecorder struct {
+	mu         sync.Mutex
+	thumbnails map[int64][]storage.Thumbnail
+	failures   map[int64]string
+}
+
+func newMemoryRecorder() *memoryRecorder {
+	return &memoryRecorder{
+		thumbnails: make(map[int64][]storage.Thumbnail),
+		failures:   make(map[int64]string),
+	}
+}
+
+func (r *memoryRecorder) CreateThumbnail(_ context.Context, attachment int64, t storage.Thumbnail) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.thumbnails[attachment] = append(r.thumbnails[attachment], t)
+	return nil
+}
+
+func (r *memoryRecorder) SetThumbnailError(_ context.Context, attachment int64, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[attachment] = reason
+	return nil
+}
+
+func bootstrapPool(t *testing.T, opts ...Option) (*Pool, blob.BlobStore, *memoryRecorder) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	root, err := ioutil.TempDir("", "blobs")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+
+	blobs, err := blob.NewFilesystem(root)
+	require.NoError(t, err)
+
+	recorder := newMemoryRecorder()
+	p, err := NewPool(logger.Sugar(), blobs, recorder, opts...)
+	require.NoError(t, err)
+
+	return p, blobs, recorder
+}
+
+func putImage(t *testing.T, blobs blob.BlobStore, key string, width, height int) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	require.NoError(t, blobs.Put(context.Background(), key, &buf, int64(buf.Len()), "image/png"))
+}
+
+func TestPoolGeneratesThumbnails(t *testing.T) {
+	t.Parallel()
+
+	p, blobs, recorder := bootstrapPool(t, Sizes(16, 64))
+	putImage(t, blobs, "chats/1/image", 200, 100)
+
+	require.NoError(t, p.Enqueue(Job{Attachment: 1, BlobKey: "chats/1/image"}))
+	p.Close()
+
+	require.Empty(t, recorder.failures)
+	require.Equal(t, []storage.Thumbnail{
+		{Size: 16, Width: 16, Height: 8, ContentType: "image/png", BlobKey: "chats/1/image.thumb-16"},
+		{Size: 64, Width: 64, Height: 32, ContentType: "image/png", BlobKey: "chats/1/image.thumb-64"},
+	}, recorder.thumbnails[1])
+
+	rc, err := blobs.Get(context.Background(), "chats/1/image.thumb-16")
+	require.NoError(t, err)
+	defer rc.Close()
+	cfg, err := png.DecodeConfig(rc)
+	require.NoError(t, err)
+	require.Equal(t, 16, cfg.Width)
+	require.Equal(t, 8, cfg.Height)
+}
+
+func TestPoolRecordsDecodeFailure(t *testing.T) {
+	t.Parallel()
+
+	p, blobs, recorder := bootstrapPool(t)
+	content := []byte("definitely not an image")
+	require.NoError(t, blobs.Put(context.Background(), "chats/1/broken", bytes.NewReader(content), int64(len(content)), "image/png"))
+
+	require.NoError(t, p.Enqueue(Job{Attachment: 2, BlobKey: "chats/1/broken"}))
+	p.Close()
+
+	require.Empty(t, recorder.thumbnails)
+	require.Contains(t, recorder.failures[2], "decoding image")
+}
+
+func TestPoolRejectsTooLargeImage(t *testing.T) {
+	t.Parallel()
+
+	p, blobs, recorder := bootstrapPool(t, MaxPixels(100))
+	putImage(t, blobs, "chats/1/large", 20, 20)
+
+	require.NoError(t, p.Enqueue(Job{Attachment: 3, BlobKey: "chats/1/large"}))
+	p.Close()
+
+	require.Contains(t, recorder.failures[3], "too large")
+}
+
+func TestPoolClosed(t *testing.T) {
+	t.Parallel()
+
+	p, _, _ := bootstrapPool(t)
+	p.Close()
+	// closing twice is a no-op
+	p.Close()
+
+	require.Equal(t, ErrClosed, p.Enqueue(Job{Attachment: 1, BlobKey: "chats/1/image"}))
+}
+
+func TestNewPoolBadOptions(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	blobs, err := blob.NewFilesystem(os.TempDir())
+	require.NoError(t, err)
+
+	_, err = NewPool(logger.Sugar(), blobs, newMemoryRecorder(), Sizes())
+	require.Error(t, err)
+	_, err = NewPool(logger.Sugar(), blobs, newMemoryRecorder(), Sizes(0))
+	require.Error(t, err)
+	_, err = NewPool(logger.Sugar(), blobs, newMemoryRecorder(), Workers(0))
+	require.Error(t, err)
+}
+
+func TestFit(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		width, height, size  int
+		expectedW, expectedH int
+	}{
+		{100, 50, 200, 100, 50},
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{1000, 1, 100, 100, 1},
+	}
+
+	for _, c := range cases {
+		w, h := fit(c.width, c.height, c.size)
+		require.Equal(t, c.expectedW, w)
+		require.Equal(t, c.expectedH, h)
+	}
+}
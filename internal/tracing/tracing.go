@@ -0,0 +1,149 @@
+// Package tracing sets up OpenTelemetry tracer provider exporting spans of the application.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+)
+
+// Exporters accepted by Exporter option
+const (
+	// ExporterNone disables tracing, spans are not recorded at all
+	ExporterNone = "none"
+	// ExporterStdout writes finished spans to standard output as JSON
+	ExporterStdout = "stdout"
+	// ExporterFile appends finished spans to the file set by File option as JSON
+	ExporterFile = "file"
+)
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Provider instance
+type config struct {
+	exporter    string
+	file        string
+	serviceName string
+	sampleRatio float64
+}
+
+// Exporter sets where finished spans are exported: ExporterNone (default), ExporterStdout or ExporterFile
+func Exporter(e string) Option {
+	return optionFunc(func(c *config) {
+		c.exporter = e
+	})
+}
+
+// File sets path of the file used by ExporterFile, the file is created if it does not exist
+func File(path string) Option {
+	return optionFunc(func(c *config) {
+		c.file = path
+	})
+}
+
+// ServiceName sets service.name resource attribute of exported spans
+func ServiceName(name string) Option {
+	return optionFunc(func(c *config) {
+		c.serviceName = name
+	})
+}
+
+// SampleRatio sets the fraction of new traces which are recorded, 1 (default) records every trace.
+// Traces started by callers are recorded if callers sampled them.
+func SampleRatio(r float64) Option {
+	return optionFunc(func(c *config) {
+		c.sampleRatio = r
+	})
+}
+
+// Provider provides tracers and exports spans recorded by them
+type Provider struct {
+	trace.TracerProvider
+	sdk    *sdktrace.TracerProvider
+	closer io.Closer
+}
+
+// New constructs a Provider. See the various Options for available customizations.
+func New(opts ...Option) (*Provider, error) {
+	cfg := &config{
+		exporter:    ExporterNone,
+		serviceName: "avito-trainee-assignment",
+		sampleRatio: 1,
+	}
+
+	for _, o := range opts {
+		o.apply(cfg)
+	}
+
+	if cfg.sampleRatio < 0 || cfg.sampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio must be between 0 and 1, got %v", cfg.sampleRatio)
+	}
+
+	var w io.Writer = os.Stdout
+	var closer io.Closer
+	switch cfg.exporter {
+	case ExporterNone:
+		return &Provider{TracerProvider: trace.NewNoopTracerProvider()}, nil
+	case ExporterStdout:
+	case ExporterFile:
+		if cfg.file == "" {
+			return nil, errors.New("no file provided for file exporter")
+		}
+
+		f, err := os.OpenFile(cfg.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open trace file: %w", err)
+		}
+		w = f
+		closer = f
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.exporter)
+	}
+
+	exporter, err := stdout.NewExporter(stdout.WithWriter(w), stdout.WithoutMetricExport())
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("cannot create trace exporter: %w", err)
+	}
+
+	sdk := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithConfig(sdktrace.Config{
+			DefaultSampler: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.sampleRatio)),
+		}),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(cfg.serviceName))),
+	)
+
+	return &Provider{TracerProvider: sdk, sdk: sdk, closer: closer}, nil
+}
+
+// Close exports spans which are not exported yet and closes the trace file if there is one
+func (p *Provider) Close(ctx context.Context) error {
+	if p.sdk == nil {
+		return nil
+	}
+
+	err := p.sdk.Shutdown(ctx)
+	if p.closer != nil {
+		if cerr := p.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "traces.json")
+	p, err := New(Exporter(ExporterFile), File(path), ServiceName("test-service"))
+	require.NoError(t, err)
+
+	ctx, parent := p.Tracer("test").Start(context.Background(), "parent")
+	_, child := p.Tracer("test").Start(ctx, "child")
+	child.End()
+	parent.End()
+
+	// spans are exported on close
+	require.NoError(t, p.Close(context.Background()))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"Name":"parent"`)
+	require.Contains(t, string(data), `"Name":"child"`)
+	require.Contains(t, string(data), "test-service")
+}
+
+func TestExporterNone(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+
+	_, span := p.Tracer("test").Start(context.Background(), "span")
+	require.False(t, span.IsRecording())
+	require.Equal(t, trace.SpanContext{}, span.SpanContext())
+	require.NoError(t, p.Close(context.Background()))
+}
+
+func TestNewBadOptions(t *testing.T) {
+	for _, opts := range [][]Option{
+		{Exporter("jaeger")},
+		{Exporter(ExporterFile)},
+		{Exporter(ExporterFile), File(filepath.Join(os.DevNull, "traces.json"))},
+		{Exporter(ExporterStdout), SampleRatio(1.5)},
+	} {
+		_, err := New(opts...)
+		require.Error(t, err)
+	}
+}
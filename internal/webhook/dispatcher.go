@@ -0,0 +1,356 @@
+// Package webhook delivers chat events queued in the database to subscribed HTTP endpoints.
+// Payloads are signed with HMAC-SHA256, failed deliveries are retried with exponential backoff
+// and moved to dead-letter state after the last attempt.
+package webhook
+
+import (
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/storage"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 16
+	defaultMaxAttempts  = 8
+	defaultBaseBackoff  = 10 * time.Second
+	defaultMaxBackoff   = time.Hour
+	defaultTimeout      = 10 * time.Second
+	// maxDrainLength limits part of a response body read before closing it
+	maxDrainLength = 64 << 10
+)
+
+const (
+	// SignatureHeader carries "sha256=" prefixed hex encoded HMAC-SHA256 of request body keyed by webhook secret
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Queue is a persistent delivery queue, it is implemented by storage.Store
+type Queue interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]storage.WebhookDelivery, error)
+	MarkWebhookDelivered(ctx context.Context, id int64) error
+	MarkWebhookFailed(ctx context.Context, id int64, reason string, retryAt *time.Time) error
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(c *config)
+
+func (f optionFunc) apply(c *config) { f(c) }
+
+// config defines fields used for configuring Dispatcher instance
+type config struct {
+	client       *http.Client
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+}
+
+// EnvConfig defines fields used for parsing from environment variables
+type EnvConfig struct {
+	PollInterval time.Duration `env:"WEBHOOK_POLL_INTERVAL" envDefault:"1s"`
+	MaxAttempts  int           `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"8"`
+	Timeout      time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"10s"`
+}
+
+// WithEnvConfig enables processing exported EnvConfig struct to acts as a source of config parameters for Dispatcher
+func WithEnvConfig(cfg EnvConfig) Option {
+	return optionFunc(func(c *config) {
+		c.pollInterval = cfg.PollInterval
+		c.maxAttempts = cfg.MaxAttempts
+		c.client = egress.Client(cfg.Timeout)
+	})
+}
+
+// Client sets http.Client used for deliveries, its Timeout bounds a single attempt. The default client refuses
+// to connect to non-public addresses, a custom one is trusted to do the same if needed.
+func Client(client *http.Client) Option {
+	return optionFunc(func(c *config) {
+		c.client = client
+	})
+}
+
+// PollInterval sets how often the queue is checked for due deliveries
+func PollInterval(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.pollInterval = d
+	})
+}
+
+// BatchSize sets the maximum number of deliveries sent concurrently
+func BatchSize(n int) Option {
+	return optionFunc(func(c *config) {
+		c.batchSize = n
+	})
+}
+
+// MaxAttempts sets number of attempts after which a delivery is moved to dead-letter state
+func MaxAttempts(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxAttempts = n
+	})
+}
+
+// Backoff sets delay before the first retry, every next retry waits twice longer up to max
+func Backoff(base, max time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.baseBackoff = base
+		c.maxBackoff = max
+	})
+}
+
+// Dispatcher polls Queue for due deliveries and sends them to webhooks
+type Dispatcher struct {
+	logger *zap.SugaredLogger
+	queue  Queue
+	cfg    config
+	// lease is the time a claimed delivery stays invisible to other dispatchers
+	lease time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewDispatcher constructs a Dispatcher. See the various Options for available customizations.
+// Deliveries are not sent until Start is called.
+func NewDispatcher(logger *zap.SugaredLogger, queue Queue, opts ...Option) (*Dispatcher, error) {
+	if logger == nil {
+		return nil, errors.New("no logger provided")
+	}
+
+	if queue == nil {
+		return nil, errors.New("no queue provided")
+	}
+
+	cfg := config{
+		client:       egress.Client(defaultTimeout),
+		pollInterval: defaultPollInterval,
+		batchSize:    defaultBatchSize,
+		maxAttempts:  defaultMaxAttempts,
+		baseBackoff:  defaultBaseBackoff,
+		maxBackoff:   defaultMaxBackoff,
+	}
+
+	for _, o := range opts {
+		o.apply(&cfg)
+	}
+
+	if cfg.pollInterval <= 0 {
+		return nil, fmt.Errorf("poll interval must be positive, got %v", cfg.pollInterval)
+	}
+
+	if cfg.batchSize < 1 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", cfg.batchSize)
+	}
+
+	if cfg.maxAttempts < 1 {
+		return nil, fmt.Errorf("max attempts must be positive, got %d", cfg.maxAttempts)
+	}
+
+	if cfg.baseBackoff <= 0 || cfg.maxBackoff < cfg.baseBackoff {
+		return nil, fmt.Errorf("bad backoff range [%v, %v]", cfg.baseBackoff, cfg.maxBackoff)
+	}
+
+	lease := 2 * cfg.client.Timeout
+	if lease <= 0 {
+		lease = 2 * defaultTimeout
+	}
+
+	return &Dispatcher{
+		logger: logger,
+		queue:  queue,
+		cfg:    cfg,
+		lease:  lease,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start runs polling loop in a separate goroutine until Close is called
+func (d *Dispatcher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(d.cfg.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			d.dispatchDue(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops polling loop and waits for in-flight deliveries to finish
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		if d.cancel == nil {
+			return
+		}
+		d.cancel()
+		<-d.done
+	})
+}
+
+// dispatchDue sends batches of due deliveries until the queue has no more of them
+func (d *Dispatcher) dispatchDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := d.queue.ClaimWebhookDeliveries(ctx, d.cfg.batchSize, d.lease)
+		if err != nil {
+			if ctx.Err() == nil {
+				d.logger.Errorf("Cannot claim webhook deliveries: %v", err)
+			}
+			return
+		}
+
+		if len(deliveries) == 0 {
+			return
+		}
+
+		// in-flight deliveries are not interrupted by Close, each of them is bounded by client timeout instead
+		var wg sync.WaitGroup
+		wg.Add(len(deliveries))
+		for _, delivery := range deliveries {
+			go func(delivery storage.WebhookDelivery) {
+				defer wg.Done()
+				d.process(context.Background(), delivery)
+			}(delivery)
+		}
+		wg.Wait()
+
+		if len(deliveries) < d.cfg.batchSize {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) process(ctx context.Context, delivery storage.WebhookDelivery) {
+	err := d.send(ctx, delivery)
+	if err == nil {
+		err = d.queue.MarkWebhookDelivered(ctx, delivery.ID)
+		if err != nil {
+			d.logger.Errorf("Cannot mark webhook delivery (id: %d) as delivered: %v", delivery.ID, err)
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	if delivery.Attempts < d.cfg.maxAttempts {
+		t := time.Now().Add(d.backoff(delivery.Attempts))
+		retryAt = &t
+		d.logger.Warnf("Webhook delivery (id: %d) attempt %d failed, retrying at %v: %v",
+			delivery.ID, delivery.Attempts, t, err)
+	} else {
+		d.logger.Errorf("Webhook delivery (id: %d) is dead after %d attempts: %v", delivery.ID, delivery.Attempts, err)
+	}
+
+	err = d.queue.MarkWebhookFailed(ctx, delivery.ID, failureReason(err), retryAt)
+	if err != nil {
+		d.logger.Errorf("Cannot record failure of webhook delivery (id: %d): %v", delivery.ID, err)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery storage.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, delivery.Payload))
+
+	resp, err := d.cfg.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// draining body lets the connection be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainLength))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError(resp.StatusCode)
+	}
+
+	return nil
+}
+
+// statusError is returned by send when the receiver responds with non-2xx status
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d", int(e))
+}
+
+// failureReason returns a short description of failed attempt recorded as delivery error. Delivery errors are served
+// by the admin API, so neither response bodies nor transport error details echoing the receiver are included.
+func failureReason(err error) string {
+	var status statusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &status):
+		return status.Error()
+	case errors.Is(err, egress.ErrNotPublic):
+		return "receiver address is not public"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "request timed out"
+	default:
+		return "request failed"
+	}
+}
+
+// backoff returns delay before the next attempt after provided number of attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.baseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.cfg.maxBackoff {
+			return d.cfg.maxBackoff
+		}
+	}
+
+	return delay
+}
+
+// Sign returns value of SignatureHeader for provided payload
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature matches provided payload, receivers may use it to authenticate deliveries
+func Verify(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
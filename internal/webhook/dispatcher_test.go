@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"avito-trainee-assignment/internal/egress"
+	"avito-trainee-assignment/internal/storage"
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryQueue implements Queue keeping deliveries in memory
+type memoryQueue struct {
+	mu         sync.Mutex
+	deliveries map[int64]*storage.WebhookDelivery
+}
+
+func newMemoryQueue(deliveries ...storage.WebhookDelivery) *memoryQueue {
+	q := &memoryQueue{deliveries: make(map[int64]*storage.WebhookDelivery)}
+	for i := range deliveries {
+		d := deliveries[i]
+		d.Status = storage.DeliveryStatusPending
+		q.deliveries[d.ID] = &d
+	}
+
+	return q
+}
+
+func (q *memoryQueue) ClaimWebhookDeliveries(_ context.Context, limit int, lease time.Duration) ([]storage.WebhookDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	claimed := make([]storage.WebhookDelivery, 0)
+	for _, d := range q.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+		if d.Status != storage.DeliveryStatusPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.Attempts++
+		d.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, *d)
+	}
+
+	return claimed, nil
+}
+
+func (q *memoryQueue) MarkWebhookDelivered(_ context.Context, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.deliveries[id].Status = storage.DeliveryStatusDelivered
+	return nil
+}
+
+func (q *memoryQueue) MarkWebhookFailed(_ context.Context, id int64, reason string, retryAt *time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d := q.deliveries[id]
+	d.LastError = &reason
+	if retryAt == nil {
+		d.Status = storage.DeliveryStatusDead
+		return nil
+	}
+	d.NextAttemptAt = *retryAt
+	return nil
+}
+
+func (q *memoryQueue) delivery(id int64) storage.WebhookDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return *q.deliveries[id]
+}
+
+func bootstrapDispatcher(t *testing.T, queue Queue, opts ...Option) *Dispatcher {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	// test receivers listen on loopback which the default client refuses to connect to
+	opts = append([]Option{
+		Client(&http.Client{Timeout: time.Second}),
+		PollInterval(10 * time.Millisecond),
+		Backoff(time.Millisecond, 5*time.Millisecond),
+	}, opts...)
+	d, err := NewDispatcher(logger.Sugar(), queue, opts...)
+	require.NoError(t, err)
+
+	d.Start()
+	t.Cleanup(d.Close)
+
+	return d
+}
+
+func TestDispatcherSignedDelivery(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	payload := []byte(`{"event":"message.created","message":{"id":1}}`)
+	queue := newMemoryQueue(storage.WebhookDelivery{
+		ID:      1,
+		URL:     receiver.URL,
+		Secret:  "secret",
+		Event:   storage.EventMessageCreated,
+		Payload: payload,
+	})
+	d := bootstrapDispatcher(t, queue)
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		require.Equal(t, payload, body)
+		require.Equal(t, storage.EventMessageCreated, r.Header.Get(EventHeader))
+		require.Equal(t, "1", r.Header.Get(DeliveryHeader))
+		require.True(t, Verify("secret", body, r.Header.Get(SignatureHeader)))
+		require.False(t, Verify("another secret", body, r.Header.Get(SignatureHeader)))
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was not received")
+	}
+
+	d.Close()
+	require.Equal(t, storage.DeliveryStatusDelivered, queue.delivery(1).Status)
+}
+
+func TestDispatcherRetriesAndDeadLetters(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		http.Error(w, "broken receiver", http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	queue := newMemoryQueue(storage.WebhookDelivery{ID: 1, URL: receiver.URL, Payload: []byte(`{}`)})
+	d := bootstrapDispatcher(t, queue, MaxAttempts(3))
+
+	require.Eventually(t, func() bool {
+		return queue.delivery(1).Status == storage.DeliveryStatusDead
+	}, 5*time.Second, 10*time.Millisecond)
+	d.Close()
+
+	delivery := queue.delivery(1)
+	require.Equal(t, 3, delivery.Attempts)
+	// response body is not exposed in recorded error
+	require.Equal(t, "unexpected response status 500", *delivery.LastError)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 3, calls)
+}
+
+func TestDispatcherRecoversAfterFailure(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	queue := newMemoryQueue(storage.WebhookDelivery{ID: 1, URL: receiver.URL, Payload: []byte(`{}`)})
+	bootstrapDispatcher(t, queue)
+
+	require.Eventually(t, func() bool {
+		return queue.delivery(1).Status == storage.DeliveryStatusDelivered
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, queue.delivery(1).Attempts)
+}
+
+func TestDispatcherRefusesNonPublicReceiver(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+	}))
+	defer receiver.Close()
+
+	queue := newMemoryQueue(storage.WebhookDelivery{ID: 1, URL: receiver.URL, Payload: []byte(`{}`)})
+	d := bootstrapDispatcher(t, queue, Client(egress.Client(time.Second)), MaxAttempts(1))
+
+	require.Eventually(t, func() bool {
+		return queue.delivery(1).Status == storage.DeliveryStatusDead
+	}, 5*time.Second, 10*time.Millisecond)
+	d.Close()
+
+	require.Equal(t, "receiver address is not public", *queue.delivery(1).LastError)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Zero(t, calls)
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	d, err := NewDispatcher(logger.Sugar(), newMemoryQueue(), Backoff(time.Second, 10*time.Second))
+	require.NoError(t, err)
+
+	require.Equal(t, time.Second, d.backoff(1))
+	require.Equal(t, 2*time.Second, d.backoff(2))
+	require.Equal(t, 8*time.Second, d.backoff(4))
+	require.Equal(t, 10*time.Second, d.backoff(5))
+	require.Equal(t, 10*time.Second, d.backoff(60))
+}
+
+func TestNewDispatcherBadOptions(t *testing.T) {
+	t.Parallel()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	_, err = NewDispatcher(logger.Sugar(), nil)
+	require.Error(t, err)
+	_, err = NewDispatcher(logger.Sugar(), newMemoryQueue(), MaxAttempts(0))
+	require.Error(t, err)
+	_, err = NewDispatcher(logger.Sugar(), newMemoryQueue(), Backoff(time.Minute, time.Second))
+	require.Error(t, err)
+}
@@ -22,8 +22,11 @@ CREATE TABLE public.users
     id bigint NOT NULL DEFAULT nextval('users_id_seq'::regclass),
     username character(128) COLLATE pg_catalog."default" NOT NULL,
     created_at timestamp with time zone NOT NULL,
+    type character varying(16) COLLATE pg_catalog."default" NOT NULL DEFAULT 'human'::character varying,
+    deleted_at timestamp with time zone,
     CONSTRAINT users_pkey PRIMARY KEY (id),
-    CONSTRAINT users_username_key UNIQUE (username)
+    CONSTRAINT users_username_key UNIQUE (username),
+    CONSTRAINT users_type_check CHECK (type::text = ANY (ARRAY['human'::character varying, 'bot'::character varying]::text[]))
 )
 
 TABLESPACE pg_default;
@@ -55,9 +58,10 @@ CREATE TABLE public.chats
 (
     id bigint NOT NULL DEFAULT nextval('chats_id_seq'::regclass),
     name character(128) COLLATE pg_catalog."default" NOT NULL,
+    type character varying(16) COLLATE pg_catalog."default" NOT NULL DEFAULT 'group'::character varying,
     created_at timestamp with time zone NOT NULL,
     CONSTRAINT chats_pkey PRIMARY KEY (id),
-    CONSTRAINT chats_name_key UNIQUE (name)
+    CONSTRAINT chats_type_check CHECK (type::text = ANY (ARRAY['group'::character varying, 'direct'::character varying]::text[]))
 )
 
     TABLESPACE pg_default;
@@ -66,6 +70,18 @@ ALTER TABLE public.chats
     OWNER to kris;
 
 
+-- Index: chats_name_key
+
+-- DROP INDEX public.chats_name_key;
+
+-- direct chats are exempt from name uniqueness
+CREATE UNIQUE INDEX chats_name_key
+    ON public.chats USING btree
+    (name COLLATE pg_catalog."default")
+    TABLESPACE pg_default
+    WHERE type::text = 'group'::text;
+
+
 -- Table: public.chat_users
 
 -- DROP TABLE public.chat_users;
@@ -118,15 +134,591 @@ CREATE TABLE public.messages
     chat_id bigint NOT NULL,
     author_id bigint NOT NULL,
     text text COLLATE pg_catalog."default" NOT NULL,
+    text_tsv tsvector NOT NULL,
+    reply_to_message_id bigint,
     created_at timestamp with time zone NOT NULL,
     CONSTRAINT messages_pkey PRIMARY KEY (id),
+    CONSTRAINT messages_id_chat_id_key UNIQUE (id, chat_id),
     CONSTRAINT messages_chat_id_author_id_fkey FOREIGN KEY (author_id, chat_id)
         REFERENCES public.chat_users (user_id, chat_id) MATCH SIMPLE
         ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    -- replies must point to messages of the same chat
+    CONSTRAINT messages_reply_to_message_id_chat_id_fkey FOREIGN KEY (reply_to_message_id, chat_id)
+        REFERENCES public.messages (id, chat_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
         ON DELETE NO ACTION
 )
 
     TABLESPACE pg_default;
 
 ALTER TABLE public.messages
-    OWNER to kris;
\ No newline at end of file
+    OWNER to kris;
+
+
+-- Index: messages_text_tsv_idx
+
+-- DROP INDEX public.messages_text_tsv_idx;
+
+CREATE INDEX messages_text_tsv_idx
+    ON public.messages USING gin
+    (text_tsv)
+    TABLESPACE pg_default;
+
+
+-- Index: messages_chat_id_id_idx
+
+-- DROP INDEX public.messages_chat_id_id_idx;
+
+CREATE INDEX messages_chat_id_id_idx
+    ON public.messages USING btree
+    (chat_id, id)
+    TABLESPACE pg_default;
+
+
+-- Index: messages_chat_id_created_at_idx
+
+-- DROP INDEX public.messages_chat_id_created_at_idx;
+
+CREATE INDEX messages_chat_id_created_at_idx
+    ON public.messages USING btree
+    (chat_id, created_at)
+    TABLESPACE pg_default;
+
+
+-- Index: messages_reply_to_message_id_idx
+
+-- DROP INDEX public.messages_reply_to_message_id_idx;
+
+CREATE INDEX messages_reply_to_message_id_idx
+    ON public.messages USING btree
+    (reply_to_message_id)
+    TABLESPACE pg_default
+    WHERE reply_to_message_id IS NOT NULL;
+
+
+-- Table: public.chat_reads
+
+-- DROP TABLE public.chat_reads;
+
+CREATE TABLE public.chat_reads
+(
+    chat_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    last_read_message_id bigint NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    CONSTRAINT chat_reads_pkey PRIMARY KEY (chat_id, user_id),
+    CONSTRAINT chat_reads_chat_id_user_id_fkey FOREIGN KEY (chat_id, user_id)
+        REFERENCES public.chat_users (chat_id, user_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.chat_reads
+    OWNER to kris;
+
+
+-- Table: public.direct_chats
+
+-- DROP TABLE public.direct_chats;
+
+-- each pair of users is stored in canonical order (user_low_id < user_high_id),
+-- so direct_chats_pair_key guarantees a single direct chat per pair
+CREATE TABLE public.direct_chats
+(
+    chat_id bigint NOT NULL,
+    user_low_id bigint NOT NULL,
+    user_high_id bigint NOT NULL,
+    CONSTRAINT direct_chats_pkey PRIMARY KEY (chat_id),
+    CONSTRAINT direct_chats_pair_key UNIQUE (user_low_id, user_high_id),
+    CONSTRAINT direct_chats_pair_check CHECK (user_low_id < user_high_id),
+    CONSTRAINT direct_chats_chat_id_fkey FOREIGN KEY (chat_id)
+        REFERENCES public.chats (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT direct_chats_user_low_id_fkey FOREIGN KEY (user_low_id)
+        REFERENCES public.users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT direct_chats_user_high_id_fkey FOREIGN KEY (user_high_id)
+        REFERENCES public.users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.direct_chats
+    OWNER to kris;
+
+
+-- Table: public.message_reactions
+
+-- DROP TABLE public.message_reactions;
+
+-- chat_id is denormalized from messages to let foreign keys guarantee that only chat members react
+CREATE TABLE public.message_reactions
+(
+    message_id bigint NOT NULL,
+    chat_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    emoji character varying(32) COLLATE pg_catalog."default" NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT message_reactions_pkey PRIMARY KEY (message_id, user_id, emoji),
+    CONSTRAINT message_reactions_message_id_chat_id_fkey FOREIGN KEY (message_id, chat_id)
+        REFERENCES public.messages (id, chat_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE,
+    CONSTRAINT message_reactions_chat_id_user_id_fkey FOREIGN KEY (chat_id, user_id)
+        REFERENCES public.chat_users (chat_id, user_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.message_reactions
+    OWNER to kris;
+
+-- Table: public.chat_retention
+
+-- DROP TABLE public.chat_retention;
+
+-- null limits are inherited from the global retention policy, zero limits disable the global ones
+CREATE TABLE public.chat_retention
+(
+    chat_id bigint NOT NULL,
+    max_age_seconds bigint,
+    max_count integer,
+    updated_at timestamp with time zone NOT NULL,
+    CONSTRAINT chat_retention_pkey PRIMARY KEY (chat_id),
+    CONSTRAINT chat_retention_max_age_seconds_check CHECK (max_age_seconds >= 0),
+    CONSTRAINT chat_retention_max_count_check CHECK (max_count >= 0),
+    CONSTRAINT chat_retention_chat_id_fkey FOREIGN KEY (chat_id)
+        REFERENCES public.chats (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.chat_retention
+    OWNER to kris;
+
+
+-- Table: public.message_mentions
+
+-- DROP TABLE public.message_mentions;
+
+-- chat_id is denormalized from messages to let foreign keys guarantee that only chat members are mentioned
+CREATE TABLE public.message_mentions
+(
+    message_id bigint NOT NULL,
+    chat_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    read_at timestamp with time zone,
+    CONSTRAINT message_mentions_pkey PRIMARY KEY (message_id, user_id),
+    CONSTRAINT message_mentions_message_id_chat_id_fkey FOREIGN KEY (message_id, chat_id)
+        REFERENCES public.messages (id, chat_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE,
+    CONSTRAINT message_mentions_chat_id_user_id_fkey FOREIGN KEY (chat_id, user_id)
+        REFERENCES public.chat_users (chat_id, user_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.message_mentions
+    OWNER to kris;
+
+-- Index: message_mentions_unread_idx
+
+-- DROP INDEX public.message_mentions_unread_idx;
+
+CREATE INDEX message_mentions_unread_idx
+    ON public.message_mentions USING btree
+    (user_id, message_id DESC)
+    TABLESPACE pg_default
+    WHERE read_at IS NULL;
+
+
+-- SEQUENCE: public.attachments_id_seq
+
+-- DROP SEQUENCE public.attachments_id_seq;
+
+CREATE SEQUENCE public.attachments_id_seq
+    INCREMENT 1
+    START 1
+    MINVALUE 1
+    MAXVALUE 9223372036854775807
+    CACHE 1;
+
+ALTER SEQUENCE public.attachments_id_seq
+    OWNER TO kris;
+
+
+-- Table: public.attachments
+
+-- DROP TABLE public.attachments;
+
+-- message_id stays null until the uploader links the attachment to a message of the same chat
+CREATE TABLE public.attachments
+(
+    id bigint NOT NULL DEFAULT nextval('attachments_id_seq'::regclass),
+    chat_id bigint NOT NULL,
+    uploader_id bigint NOT NULL,
+    message_id bigint,
+    filename character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    content_type character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    size bigint NOT NULL,
+    checksum character(64) COLLATE pg_catalog."default" NOT NULL,
+    blob_key character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    thumbnail_error text COLLATE pg_catalog."default",
+    CONSTRAINT attachments_pkey PRIMARY KEY (id),
+    CONSTRAINT attachments_blob_key_key UNIQUE (blob_key),
+    CONSTRAINT attachments_chat_id_uploader_id_fkey FOREIGN KEY (chat_id, uploader_id)
+        REFERENCES public.chat_users (chat_id, user_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT attachments_message_id_chat_id_fkey FOREIGN KEY (message_id, chat_id)
+        REFERENCES public.messages (id, chat_id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT attachments_size_check CHECK (size >= 0)
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.attachments
+    OWNER to kris;
+
+-- Index: attachments_message_id_idx
+
+-- DROP INDEX public.attachments_message_id_idx;
+
+CREATE INDEX attachments_message_id_idx
+    ON public.attachments USING btree
+    (message_id ASC NULLS LAST)
+    TABLESPACE pg_default
+    WHERE message_id IS NOT NULL;
+
+-- Table: public.attachment_thumbnails
+
+-- DROP TABLE public.attachment_thumbnails;
+
+CREATE TABLE public.attachment_thumbnails
+(
+    attachment_id bigint NOT NULL,
+    size integer NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    content_type character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    blob_key character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT attachment_thumbnails_pkey PRIMARY KEY (attachment_id, size),
+    CONSTRAINT attachment_thumbnails_attachment_id_fkey FOREIGN KEY (attachment_id)
+        REFERENCES public.attachments (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.attachment_thumbnails
+    OWNER to kris;
+
+-- SEQUENCE: public.webhooks_id_seq
+
+-- DROP SEQUENCE public.webhooks_id_seq;
+
+CREATE SEQUENCE public.webhooks_id_seq
+    INCREMENT 1
+    START 1
+    MINVALUE 1
+    MAXVALUE 9223372036854775807
+    CACHE 1;
+
+ALTER SEQUENCE public.webhooks_id_seq
+    OWNER TO kris;
+
+
+-- Table: public.webhooks
+
+-- DROP TABLE public.webhooks;
+
+-- chat_id is null for global subscriptions receiving events of all chats
+CREATE TABLE public.webhooks
+(
+    id bigint NOT NULL DEFAULT nextval('webhooks_id_seq'::regclass),
+    chat_id bigint,
+    url text COLLATE pg_catalog."default" NOT NULL,
+    secret text COLLATE pg_catalog."default" NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT webhooks_pkey PRIMARY KEY (id),
+    CONSTRAINT webhooks_chat_id_fkey FOREIGN KEY (chat_id)
+        REFERENCES public.chats (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.webhooks
+    OWNER to kris;
+
+-- Index: webhooks_chat_id_idx
+
+-- DROP INDEX public.webhooks_chat_id_idx;
+
+CREATE INDEX webhooks_chat_id_idx
+    ON public.webhooks USING btree
+    (chat_id ASC NULLS LAST)
+    TABLESPACE pg_default;
+
+
+-- SEQUENCE: public.webhook_deliveries_id_seq
+
+-- DROP SEQUENCE public.webhook_deliveries_id_seq;
+
+CREATE SEQUENCE public.webhook_deliveries_id_seq
+    INCREMENT 1
+    START 1
+    MINVALUE 1
+    MAXVALUE 9223372036854775807
+    CACHE 1;
+
+ALTER SEQUENCE public.webhook_deliveries_id_seq
+    OWNER TO kris;
+
+
+-- Table: public.webhook_deliveries
+
+-- DROP TABLE public.webhook_deliveries;
+
+CREATE TABLE public.webhook_deliveries
+(
+    id bigint NOT NULL DEFAULT nextval('webhook_deliveries_id_seq'::regclass),
+    webhook_id bigint NOT NULL,
+    event character varying(64) COLLATE pg_catalog."default" NOT NULL,
+    payload jsonb NOT NULL,
+    status character varying(16) COLLATE pg_catalog."default" NOT NULL,
+    attempts integer NOT NULL,
+    last_error text COLLATE pg_catalog."default",
+    next_attempt_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    delivered_at timestamp with time zone,
+    CONSTRAINT webhook_deliveries_pkey PRIMARY KEY (id),
+    CONSTRAINT webhook_deliveries_webhook_id_fkey FOREIGN KEY (webhook_id)
+        REFERENCES public.webhooks (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE,
+    CONSTRAINT webhook_deliveries_status_check CHECK (status::text = ANY (ARRAY['pending'::character varying, 'delivered'::character varying, 'dead'::character varying]::text[]))
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.webhook_deliveries
+    OWNER to kris;
+
+-- Index: webhook_deliveries_next_attempt_at_idx
+
+-- DROP INDEX public.webhook_deliveries_next_attempt_at_idx;
+
+CREATE INDEX webhook_deliveries_next_attempt_at_idx
+    ON public.webhook_deliveries USING btree
+    (next_attempt_at ASC NULLS LAST)
+    TABLESPACE pg_default
+    WHERE status = 'pending';
+
+-- Index: webhook_deliveries_dead_idx
+
+-- DROP INDEX public.webhook_deliveries_dead_idx;
+
+CREATE INDEX webhook_deliveries_dead_idx
+    ON public.webhook_deliveries USING btree
+    (id ASC NULLS LAST)
+    TABLESPACE pg_default
+    WHERE status = 'dead';
+
+-- SEQUENCE: public.outbox_id_seq
+
+-- DROP SEQUENCE public.outbox_id_seq;
+
+CREATE SEQUENCE public.outbox_id_seq
+    INCREMENT 1
+    START 1
+    MINVALUE 1
+    MAXVALUE 9223372036854775807
+    CACHE 1;
+
+ALTER SEQUENCE public.outbox_id_seq
+    OWNER TO kris;
+
+
+-- Table: public.outbox
+
+-- DROP TABLE public.outbox;
+
+-- rows are written in the same transaction as the domain change and published by relay afterwards
+CREATE TABLE public.outbox
+(
+    id bigint NOT NULL DEFAULT nextval('outbox_id_seq'::regclass),
+    aggregate_type character varying(32) COLLATE pg_catalog."default" NOT NULL,
+    aggregate_id bigint NOT NULL,
+    event_type character varying(64) COLLATE pg_catalog."default" NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    dispatched_at timestamp with time zone,
+    CONSTRAINT outbox_pkey PRIMARY KEY (id)
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.outbox
+    OWNER to kris;
+
+-- Index: outbox_undispatched_idx
+
+-- DROP INDEX public.outbox_undispatched_idx;
+
+CREATE INDEX outbox_undispatched_idx
+    ON public.outbox USING btree
+    (id ASC NULLS LAST)
+    TABLESPACE pg_default
+    WHERE dispatched_at IS NULL;
+
+-- Table: public.bots
+
+-- DROP TABLE public.bots;
+
+-- callback_url is null for bots served by Go handlers registered in the application
+CREATE TABLE public.bots
+(
+    user_id bigint NOT NULL,
+    callback_url text COLLATE pg_catalog."default",
+    secret text COLLATE pg_catalog."default" NOT NULL,
+    commands character varying(32)[] COLLATE pg_catalog."default" NOT NULL,
+    rate_limit integer NOT NULL,
+    timeout_ms integer NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT bots_pkey PRIMARY KEY (user_id),
+    CONSTRAINT bots_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES public.users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE,
+    CONSTRAINT bots_rate_limit_check CHECK (rate_limit > 0),
+    CONSTRAINT bots_timeout_ms_check CHECK (timeout_ms > 0)
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.bots
+    OWNER to kris;
+
+
+-- SEQUENCE: public.audit_events_id_seq
+
+-- DROP SEQUENCE public.audit_events_id_seq;
+
+CREATE SEQUENCE public.audit_events_id_seq
+    INCREMENT 1
+    START 1
+    MINVALUE 1
+    MAXVALUE 9223372036854775807
+    CACHE 1;
+
+ALTER SEQUENCE public.audit_events_id_seq
+    OWNER TO kris;
+
+
+-- Table: public.audit_events
+
+-- DROP TABLE public.audit_events;
+
+-- audit events are append-only and outlive their actors and targets, so there are no foreign keys
+CREATE TABLE public.audit_events
+(
+    id bigint NOT NULL DEFAULT nextval('audit_events_id_seq'::regclass),
+    claimed_actor_id bigint,
+    action character varying(64) COLLATE pg_catalog."default" NOT NULL,
+    target character varying(128) COLLATE pg_catalog."default" NOT NULL,
+    claimed_request_id character varying(64) COLLATE pg_catalog."default",
+    outcome character varying(16) COLLATE pg_catalog."default" NOT NULL,
+    prev_hash character(64) COLLATE pg_catalog."default" NOT NULL,
+    hash character(64) COLLATE pg_catalog."default" NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT audit_events_pkey PRIMARY KEY (id),
+    CONSTRAINT audit_events_outcome_check CHECK (outcome::text = ANY (ARRAY['success'::character varying, 'rejected'::character varying, 'error'::character varying]::text[]))
+)
+
+    TABLESPACE pg_default;
+
+ALTER TABLE public.audit_events
+    OWNER to kris;
+
+-- Index: audit_events_claimed_actor_id_idx
+
+-- DROP INDEX public.audit_events_claimed_actor_id_idx;
+
+CREATE INDEX audit_events_claimed_actor_id_idx
+    ON public.audit_events USING btree
+    (claimed_actor_id, id)
+    TABLESPACE pg_default
+    WHERE claimed_actor_id IS NOT NULL;
+
+
+-- Index: audit_events_target_idx
+
+-- DROP INDEX public.audit_events_target_idx;
+
+CREATE INDEX audit_events_target_idx
+    ON public.audit_events USING btree
+    (target COLLATE pg_catalog."default", id)
+    TABLESPACE pg_default;
+
+
+-- Index: audit_events_created_at_idx
+
+-- DROP INDEX public.audit_events_created_at_idx;
+
+CREATE INDEX audit_events_created_at_idx
+    ON public.audit_events USING btree
+    (created_at)
+    TABLESPACE pg_default;
+
+
+-- FUNCTION: public.audit_events_append_only()
+
+-- DROP FUNCTION public.audit_events_append_only();
+
+-- the hash chain reveals tampering, the trigger prevents accidental modifications
+CREATE FUNCTION public.audit_events_append_only()
+    RETURNS trigger
+    LANGUAGE 'plpgsql'
+    COST 100
+    VOLATILE NOT LEAKPROOF
+AS $BODY$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$BODY$;
+
+ALTER FUNCTION public.audit_events_append_only()
+    OWNER TO kris;
+
+
+-- Trigger: audit_events_append_only
+
+-- DROP TRIGGER audit_events_append_only ON public.audit_events;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE
+    ON public.audit_events
+    FOR EACH ROW
+    EXECUTE PROCEDURE public.audit_events_append_only();